@@ -0,0 +1,64 @@
+package computations
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// count counts the occurrences of a byte, 'a' unless the parameters say
+// otherwise, e.g. {"byte": "b"}.
+type count struct{}
+
+type countParameters struct {
+	Byte string `json:"byte"`
+}
+
+func (count) parse(parameters []byte) (byte, error) {
+	if len(parameters) == 0 {
+		return 'a', nil
+	}
+	var p countParameters
+	if err := json.Unmarshal(parameters, &p); err != nil {
+		return 0, invalidParameters("%s", err)
+	}
+	if len(p.Byte) != 1 {
+		return 0, invalidParameters("byte must be a single byte, got %q", p.Byte)
+	}
+	return p.Byte[0], nil
+}
+
+func (c count) Validate(parameters []byte) error {
+	_, err := c.parse(parameters)
+	return err
+}
+
+func (c count) Run(ctx context.Context, plaintext []byte, parameters []byte) (messages.Value, error) {
+	b, err := c.parse(parameters)
+	if err != nil {
+		return messages.Value{}, err
+	}
+	n := 0
+	for i := 0; i < len(plaintext); i++ {
+		if plaintext[i] == b {
+			n += 1
+		}
+	}
+	return messages.IntValue(int64(n)), nil
+}
+
+// length returns the length of the plaintext, in bytes. It takes no
+// parameters.
+type length struct{}
+
+func (length) Validate(parameters []byte) error {
+	if len(parameters) != 0 {
+		return invalidParameters("length takes none")
+	}
+	return nil
+}
+
+func (length) Run(ctx context.Context, plaintext []byte, parameters []byte) (messages.Value, error) {
+	return messages.IntValue(int64(len(plaintext))), nil
+}
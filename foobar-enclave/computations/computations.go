@@ -0,0 +1,119 @@
+// Package computations holds what the enclave can compute on decrypted
+// plaintexts. A decrypt request names one of the computations of the
+// enclave's Registry, and the enclave attests the result.
+package computations
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// Computation runs on a plaintext. Computations must be safe for concurrent
+// use, batch decryption runs them on several plaintexts at once.
+type Computation interface {
+	// Validate checks the parameters before anything is decrypted.
+	Validate(parameters []byte) error
+
+	// Run returns the result for a plaintext. The parameters were validated.
+	Run(ctx context.Context, plaintext []byte, parameters []byte) (messages.Value, error)
+}
+
+// Registry maps names to computations. WebAssembly modules are compiled with
+// the registry's limits, see SetWasmLimits.
+type Registry struct {
+	mu           sync.Mutex
+	computations map[string]Computation
+	wasmLimits   WasmLimits
+}
+
+// NewRegistry returns a registry with the built-in computations.
+func NewRegistry() *Registry {
+	r := &Registry{computations: map[string]Computation{}, wasmLimits: DefaultWasmLimits}
+	r.Register(messages.DefaultComputation, count{})
+	r.Register("length", length{})
+	return r
+}
+
+// Register adds a computation. Names can't be reused, and
+// messages.WasmComputation is reserved for modules sent with requests.
+func (r *Registry) Register(name string, c Computation) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name == "" || name == messages.WasmComputation {
+		return fmt.Errorf("computation name %q is reserved", name)
+	}
+	if _, ok := r.computations[name]; ok {
+		return fmt.Errorf("computation %q is already registered", name)
+	}
+	r.computations[name] = c
+	return nil
+}
+
+// SetWasmLimits sets the limits of the modules compiled from now on.
+func (r *Registry) SetWasmLimits(limits WasmLimits) error {
+	if limits.MemoryPages == 0 || limits.MemoryPages > 65536 || limits.Fuel == 0 || limits.Timeout <= 0 {
+		return fmt.Errorf("invalid WebAssembly limits: %+v", limits)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wasmLimits = limits
+	return nil
+}
+
+// CompileWasm compiles a module sent with a request. The caller closes it once
+// done.
+func (r *Registry) CompileWasm(ctx context.Context, module []byte) (*Wasm, error) {
+	r.mu.Lock()
+	limits := r.wasmLimits
+	r.mu.Unlock()
+	return CompileWasm(ctx, module, limits)
+}
+
+// RegisterWasm compiles a module and registers it under name.
+func (r *Registry) RegisterWasm(ctx context.Context, name string, module []byte) error {
+	w, err := r.CompileWasm(ctx, module)
+	if err != nil {
+		return err
+	}
+	if err := r.Register(name, w); err != nil {
+		w.Close(ctx)
+		return err
+	}
+	return nil
+}
+
+// Get returns the computation with the given name, an empty name stands for
+// messages.DefaultComputation. It fails with an INVALID_REQUEST error if there
+// is none.
+func (r *Registry) Get(name string) (string, Computation, error) {
+	if name == "" {
+		name = messages.DefaultComputation
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.computations[name]
+	if !ok {
+		return "", nil, &messages.Error{Code: messages.ErrorCodeInvalidRequest, Message: fmt.Sprintf("unknown computation %q", name)}
+	}
+	return name, c, nil
+}
+
+// Names returns the names of the registered computations, sorted.
+func (r *Registry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for name := range r.computations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func invalidParameters(format string, a ...any) error {
+	return &messages.Error{Code: messages.ErrorCodeInvalidRequest, Message: "invalid parameters: " + fmt.Sprintf(format, a...)}
+}
@@ -0,0 +1,225 @@
+package computations
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// WebAssembly computations run in wazero's interpreter, a pure Go runtime.
+// Modules can't import anything: they have no access to I/O, clocks or
+// randomness, and their results only depend on the plaintext and the
+// parameters.
+//
+// A module exports its memory and two functions:
+//
+//	alloc(size i32) -> ptr i32
+//	compute(plaintext i32, plaintextLen i32, parameters i32, parametersLen i32) -> i64
+//
+// The enclave allocates room for the plaintext and the parameters with alloc
+// and copies them in, then calls compute. compute returns the address of its
+// output in the upper 32 bits and the length in the lower 32 bits. The output
+// is the result, as bytes.
+
+// WasmLimits bound what a WebAssembly computation can use.
+type WasmLimits struct {
+	// MemoryPages is the maximum memory of a module, in 64 KiB pages.
+	MemoryPages uint32
+
+	// Fuel is a budget of function calls a run can make, including the call
+	// to compute. It isn't an instruction count: wazero doesn't meter
+	// instructions, and loops which don't call functions don't burn any.
+	Fuel uint64
+
+	// Timeout bounds the duration of a run. Unlike Fuel, it stops every
+	// module, including tight loops.
+	Timeout time.Duration
+}
+
+var DefaultWasmLimits = WasmLimits{
+	MemoryPages: 256,
+	Fuel:        10_000_000,
+	Timeout:     5 * time.Second,
+}
+
+// The enclave rejects larger outputs.
+const maxWasmOutputSize = 1 << 20
+
+// Module is implemented by computations which run a WebAssembly module. The
+// module's SHA-256 is attested with the results.
+type Module interface {
+	ModuleHash() []byte
+}
+
+// Wasm is a compiled WebAssembly module. Close releases it.
+type Wasm struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	hash     []byte
+	limits   WasmLimits
+}
+
+// fuel is the remaining fuel of a run. A run makes its calls from a single
+// goroutine.
+type fuel struct {
+	remaining uint64
+	exhausted bool
+	cancel    context.CancelFunc
+}
+
+type fuelKey struct{}
+
+// fuelListener burns fuel on every function call. Once there is none left, it
+// cancels the run's context, which stops the module.
+var fuelListener = experimental.FunctionListenerFactoryFunc(func(api.FunctionDefinition) experimental.FunctionListener {
+	return experimental.FunctionListenerFunc(func(ctx context.Context, _ api.Module, _ api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+		f, ok := ctx.Value(fuelKey{}).(*fuel)
+		if !ok {
+			return
+		}
+		if f.remaining == 0 {
+			f.exhausted = true
+			f.cancel()
+			return
+		}
+		f.remaining--
+	})
+})
+
+// CompileWasm validates and compiles a module. Invalid modules, or modules
+// which import anything or don't export the interface, are INVALID_REQUEST
+// errors.
+func CompileWasm(ctx context.Context, module []byte, limits WasmLimits) (*Wasm, error) {
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter().
+		WithMemoryLimitPages(limits.MemoryPages).
+		WithCloseOnContextDone(true))
+	compiled, err := runtime.CompileModule(experimental.WithFunctionListenerFactory(ctx, fuelListener), module)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, invalidModule("%s", err)
+	}
+	w := &Wasm{runtime: runtime, compiled: compiled, hash: messages.ModuleHash(module), limits: limits}
+	if err := w.check(); err != nil {
+		w.Close(ctx)
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Wasm) check() error {
+	if len(w.compiled.ImportedFunctions()) != 0 || len(w.compiled.ImportedMemories()) != 0 {
+		return invalidModule("modules can't import anything")
+	}
+	if _, ok := w.compiled.ExportedMemories()["memory"]; !ok {
+		return invalidModule("memory isn't exported")
+	}
+	functions := w.compiled.ExportedFunctions()
+	for name, signature := range map[string]struct{ params, results []api.ValueType }{
+		"alloc":   {[]api.ValueType{api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}},
+		"compute": {[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI64}},
+	} {
+		f, ok := functions[name]
+		if !ok {
+			return invalidModule("%s isn't exported", name)
+		}
+		if !bytes.Equal(f.ParamTypes(), signature.params) || !bytes.Equal(f.ResultTypes(), signature.results) {
+			return invalidModule("%s has the wrong signature", name)
+		}
+	}
+	return nil
+}
+
+func (w *Wasm) Close(ctx context.Context) error {
+	return w.runtime.Close(ctx)
+}
+
+func (w *Wasm) ModuleHash() []byte {
+	return w.hash
+}
+
+// Modules get their parameters as is.
+func (w *Wasm) Validate(parameters []byte) error {
+	return nil
+}
+
+// Run instantiates the module, so that runs don't share any state, and calls
+// compute.
+func (w *Wasm) Run(ctx context.Context, plaintext []byte, parameters []byte) (messages.Value, error) {
+	runCtx, cancel := context.WithTimeout(ctx, w.limits.Timeout)
+	defer cancel()
+	f := &fuel{remaining: w.limits.Fuel, cancel: cancel}
+	runCtx = context.WithValue(runCtx, fuelKey{}, f)
+
+	output, err := w.run(runCtx, plaintext, parameters)
+	if err != nil {
+		switch {
+		case f.exhausted:
+			return messages.Value{}, computationFailed("out of fuel after %d calls", w.limits.Fuel)
+		case ctx.Err() != nil:
+			return messages.Value{}, ctx.Err()
+		case runCtx.Err() != nil:
+			return messages.Value{}, computationFailed("ran for more than %s", w.limits.Timeout)
+		}
+		return messages.Value{}, err
+	}
+	return messages.BytesValue(output), nil
+}
+
+func (w *Wasm) run(ctx context.Context, plaintext []byte, parameters []byte) ([]byte, error) {
+	mod, err := w.runtime.InstantiateModule(ctx, w.compiled, wazero.NewModuleConfig().WithName(""))
+	if err != nil {
+		return nil, computationFailed("instantiation failed: %s", err)
+	}
+	defer mod.Close(context.Background())
+
+	memory := mod.Memory()
+	write := func(data []byte) (uint64, error) {
+		results, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(data)))
+		if err != nil {
+			return 0, computationFailed("alloc failed: %s", err)
+		}
+		ptr := uint32(results[0])
+		if !memory.Write(ptr, data) {
+			return 0, computationFailed("alloc returned %d bytes out of memory", len(data))
+		}
+		return uint64(ptr), nil
+	}
+	plaintextPtr, err := write(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	parametersPtr, err := write(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := mod.ExportedFunction("compute").Call(ctx, plaintextPtr, uint64(len(plaintext)), parametersPtr, uint64(len(parameters)))
+	if err != nil {
+		return nil, computationFailed("compute failed: %s", err)
+	}
+	ptr, n := uint32(results[0]>>32), uint32(results[0])
+	if n > maxWasmOutputSize {
+		return nil, computationFailed("output is %d bytes, at most %d are allowed", n, maxWasmOutputSize)
+	}
+	output, ok := memory.Read(ptr, n)
+	if !ok {
+		return nil, computationFailed("output is out of memory")
+	}
+	// The memory goes away with the module.
+	return bytes.Clone(output), nil
+}
+
+func invalidModule(format string, a ...any) error {
+	return &messages.Error{Code: messages.ErrorCodeInvalidRequest, Message: "invalid WebAssembly module: " + fmt.Sprintf(format, a...)}
+}
+
+func computationFailed(format string, a ...any) error {
+	return &messages.Error{Code: messages.ErrorCodeComputationFailed, Message: fmt.Sprintf(format, a...)}
+}
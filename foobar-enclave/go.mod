@@ -8,9 +8,15 @@ require (
 	github.com/aws/aws-sdk-go-v2/credentials v1.17.32
 	github.com/aws/aws-sdk-go-v2/service/kms v1.35.7
 	github.com/edgebitio/nitro-enclaves-sdk-go v1.0.0
+	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/hf/nsm v0.0.0-20220930140112-cd181bd646b9
 	github.com/mdlayher/vsock v1.2.1
+	github.com/tetratelabs/wazero v1.8.2
 	github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared v0.0.0
+	golang.org/x/crypto v0.27.0
+	golang.org/x/sync v0.8.0
+	google.golang.org/grpc v1.65.0
+	google.golang.org/protobuf v1.34.2
 )
 
 replace github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared => ../foobar-shared
@@ -26,11 +32,10 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/ssooidc v1.26.7 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sts v1.30.7 // indirect
 	github.com/aws/smithy-go v1.20.4 // indirect
-	github.com/fxamacker/cbor/v2 v2.4.0 // indirect
 	github.com/mdlayher/socket v0.4.1 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
-	golang.org/x/crypto v0.27.0 // indirect
-	golang.org/x/net v0.21.0 // indirect
-	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/sys v0.25.0 // indirect
+	golang.org/x/text v0.18.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240528184218-531527333157 // indirect
 )
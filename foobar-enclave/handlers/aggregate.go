@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hf/nsm/request"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/nsm"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/signing"
+)
+
+// Only the aggregates are attested, the individual plaintexts never leave the
+// enclave. Only ciphertexts bound to messages.PurposeAggregate decrypt here,
+// and nowhere else. Items which fail to decrypt or aren't numbers are counted as
+// rejected, the others are aggregated. With noise, nothing depends on the exact
+// count: the cohort threshold applies to the noisy one, and the number of
+// rejected items isn't returned.
+func AggregateHandler(ctx context.Context, sess nsm.NSM, rsaKeys *RsaKeys, sessions *Sessions, keys *KeyRegistry, replayCache *ReplayCache, signingKey *SigningKey, req messages.AggregateRequest, reqBytes []byte) (*messages.AggregateResponse, error) {
+	p := req.Parameters
+
+	decrypters, release, err := sessionDecrypters(rsaKeys, sessions, req.SessionId)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var mu sync.Mutex
+	var values []float64
+	rejected := 0
+	binding := func(int) messages.Binding { return messages.Binding{Purpose: messages.PurposeAggregate} }
+	err = decryptAll(ctx, keys, replayCache, decrypters, req.Items, binding, func(i int, plaintext []byte, err error) {
+		var v float64
+		if err == nil {
+			v, err = parseValue(plaintext)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			rejected++
+			return
+		}
+		values = append(values, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := aggregate(values, p)
+	if err != nil {
+		return nil, err
+	}
+	if result.Count < float64(p.MinCohort) {
+		return nil, &messages.Error{
+			Code:    messages.ErrorCodeCohortTooSmall,
+			Message: fmt.Sprintf("got %g values, at least %d are required", result.Count, p.MinCohort),
+		}
+	}
+	if p.Epsilon == 0 {
+		result.Rejected = &rejected
+	}
+
+	// Hash the inputs to defend against input swapping
+	h := sha256.New()
+	h.Write(reqBytes)
+
+	userData := messages.AggregateResponseAttestationUserData{
+		InitialRequest: h.Sum(nil),
+		InputDigest:    messages.InputSetDigest(req.Items),
+		ParametersHash: p.Hash(),
+		ResultHash:     result.Hash(),
+	}
+	userDataBytes, err := json.Marshal(userData)
+	if err != nil {
+		return nil, err
+	}
+
+	attestation, err := sess.Attestation(request.Attestation{
+		Nonce:     attestationNonce(req.AttestationNonce),
+		UserData:  userDataBytes,
+		PublicKey: []byte{},
+	})
+	if err != nil {
+		return nil, nsmFailure(err)
+	}
+
+	signedResult, err := signingKey.sign(signing.Payload{Request: userData.InitialRequest, Aggregate: &userData, AggregateResult: &result})
+	if err != nil {
+		return nil, err
+	}
+	return &messages.AggregateResponse{Attestation: attestation, Result: result, SignedResult: signedResult}, nil
+}
+
+func parseValue(plaintext []byte) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(plaintext)), 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("not a finite number: %g", v)
+	}
+	return v, nil
+}
+
+// aggregate computes the statistics of the values, adding noise when epsilon
+// is set. The values are sorted so that the floating point sum doesn't depend
+// on the order in which the items were decrypted.
+func aggregate(values []float64, p messages.AggregateParameters) (messages.AggregateResult, error) {
+	if p.Bounds != nil {
+		for i, v := range values {
+			values[i] = math.Max(p.Bounds.Lower, math.Min(p.Bounds.Upper, v))
+		}
+	}
+	sort.Float64s(values)
+
+	var r messages.AggregateResult
+	r.Count = float64(len(values))
+	for _, v := range values {
+		r.Sum += v
+	}
+	if p.Buckets != nil {
+		r.Histogram = make([]float64, len(p.Buckets)+1)
+		for _, v := range values {
+			r.Histogram[sort.Search(len(p.Buckets), func(i int) bool { return v < p.Buckets[i] })]++
+		}
+	}
+
+	if p.Epsilon == 0 {
+		if r.Count > 0 {
+			r.Mean = r.Sum / r.Count
+		}
+		return r, nil
+	}
+
+	// Sequential composition: each released statistic gets an equal share of
+	// epsilon. Adding or removing a value changes the count and a single
+	// histogram bucket by 1, and the sum by at most the largest bound.
+	queries := 2.0
+	if r.Histogram != nil {
+		queries++
+	}
+	epsilon := p.Epsilon / queries
+	var err error
+	if r.Count, err = addLaplaceNoise(r.Count, 1/epsilon); err != nil {
+		return r, err
+	}
+	sensitivity := math.Max(math.Abs(p.Bounds.Lower), math.Abs(p.Bounds.Upper))
+	if r.Sum, err = addLaplaceNoise(r.Sum, sensitivity/epsilon); err != nil {
+		return r, err
+	}
+	for i := range r.Histogram {
+		if r.Histogram[i], err = addLaplaceNoise(r.Histogram[i], 1/epsilon); err != nil {
+			return r, err
+		}
+	}
+	r.Mean = math.Max(p.Bounds.Lower, math.Min(p.Bounds.Upper, r.Sum/math.Max(r.Count, 1)))
+	return r, nil
+}
+
+// addLaplaceNoise adds noise drawn from a Laplace distribution with the given
+// scale, using the inverse of its cumulative distribution function.
+func addLaplaceNoise(v, scale float64) (float64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	// Uniform in (-0.5, 0.5), excluding -0.5 for which the logarithm diverges.
+	u := (float64(binary.BigEndian.Uint64(b[:])>>11)+0.5)/(1<<53) - 0.5
+	if u < 0 {
+		return v + scale*math.Log(1+2*u), nil
+	}
+	return v - scale*math.Log(1-2*u), nil
+}
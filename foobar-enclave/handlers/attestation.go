@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"bytes"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/nsm"
+)
+
+// The NSM rejects attestations with more user data.
+const maxUserDataSize = 512
+
+// attestationNonce returns the nonce to place in an attestation. Requests
+// without a nonce keep getting attestations with an empty one.
+func attestationNonce(nonce []byte) []byte {
+	if nonce == nil {
+		return []byte{}
+	}
+	return nonce
+}
+
+// verifyOwnAttestation checks that attestation was produced by an enclave
+// running the same image as this one: it must chain to the NSM's root and have
+// the same PCR0.
+func verifyOwnAttestation(sess nsm.NSM, attestation []byte) (*nsm.Document, error) {
+	doc, err := nsm.Verify(attestation, sess.Root())
+	if err != nil {
+		return nil, attestationRejected("%s", err)
+	}
+	pcr0, err := sess.DescribePCR(0)
+	if err != nil {
+		return nil, nsmFailure(err)
+	}
+	if !bytes.Equal(doc.PCRs[0], pcr0) {
+		return nil, attestationRejected("the attestation's PCR0 is %02x, this enclave's is %02x", doc.PCRs[0], pcr0)
+	}
+	return doc, nil
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+
+	"github.com/hf/nsm/request"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/computations"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/nsm"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/merkle"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/signing"
+)
+
+// Number of items decrypted concurrently.
+const batchDecryptWorkers = 8
+
+// decryptAll decrypts the items concurrently, and calls f with each plaintext
+// or error, from several goroutines. It gives up once ctx is done, and returns
+// its error then. Panics, including f's, are re-raised in the caller's
+// goroutine, where the server recovers them. binding gives each item's
+// Binding, nil means none.
+func decryptAll(ctx context.Context, keys *KeyRegistry, replayCache *ReplayCache, decrypters []*RsaKey, items []messages.BatchDecryptItem, binding func(i int) messages.Binding, f func(i int, plaintext []byte, err error)) error {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	var panicOnce sync.Once
+	var panicValue any
+	decrypt := func(i int) {
+		// The worker moves on, so that the batch isn't stuck.
+		defer func() {
+			if p := recover(); p != nil {
+				panicOnce.Do(func() { panicValue = p })
+			}
+		}()
+		var b messages.Binding
+		if binding != nil {
+			b = binding(i)
+		}
+		plaintext, err := decryptItem(keys, replayCache, decrypters, items[i], b)
+		f(i, plaintext, err)
+	}
+	for w := 0; w < batchDecryptWorkers && w < len(items); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				decrypt(i)
+			}
+		}()
+	}
+	func() {
+		defer close(indexes)
+		for i := range items {
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	if panicValue != nil {
+		panic(panicValue)
+	}
+	return ctx.Err()
+}
+
+// A failed item doesn't fail the batch, its result carries the error. Each
+// result is a leaf of a Merkle tree whose root is attested once, with an
+// inclusion proof per result, so a single result can be shown to a third party
+// without the others.
+func BatchDecryptHandler(ctx context.Context, sess nsm.NSM, rsaKeys *RsaKeys, sessions *Sessions, keys *KeyRegistry, replayCache *ReplayCache, computations *computations.Registry, signingKey *SigningKey, req messages.BatchDecryptRequest, reqBytes []byte) (*messages.BatchDecryptResponse, error) {
+	r := &messages.BatchDecryptResponse{
+		Results: make([]messages.BatchDecryptResult, len(req.Items)),
+	}
+
+	computation, err := newComputation(ctx, computations, req.Computation, req.Parameters, req.WasmModule)
+	if err != nil {
+		return nil, err
+	}
+	defer computation.close()
+
+	// The session's key is used for the whole batch.
+	decrypters, release, err := sessionDecrypters(rsaKeys, sessions, req.SessionId)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	err = decryptAll(ctx, keys, replayCache, decrypters, req.Items, nil, func(i int, plaintext []byte, err error) {
+		if err != nil {
+			r.Results[i].Error = itemError(err)
+			return
+		}
+		if r.Results[i].Result, err = computation.run(ctx, plaintext); err != nil {
+			r.Results[i].Error = itemError(err)
+			return
+		}
+		r.Results[i].SignedResult, err = signingKey.sign(signing.Payload{Request: req.Items[i].Digest(), KeyId: req.Items[i].KeyId, Result: r.Results[i].Result})
+		if err != nil {
+			r.Results[i].Result, r.Results[i].Error = nil, itemError(err)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	leafHashes := make([][]byte, len(req.Items))
+	for i, item := range req.Items {
+		leafHashes[i] = r.Results[i].LeafHash(item.Digest())
+	}
+	for i, proof := range merkle.Proofs(leafHashes) {
+		r.Results[i].Proof = proof
+	}
+
+	// Hash the inputs to defend against input swapping
+	h := sha256.New()
+	h.Write(reqBytes)
+
+	userData := messages.BatchDecryptResponseAttestationUserData{
+		InitialRequest: h.Sum(nil),
+		MerkleRoot:     merkle.Root(leafHashes),
+		Size:           len(leafHashes),
+	}
+	userDataBytes, err := json.Marshal(userData)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Attestation, err = sess.Attestation(request.Attestation{
+		Nonce:     attestationNonce(req.AttestationNonce),
+		UserData:  userDataBytes,
+		PublicKey: []byte{},
+	})
+	if err != nil {
+		return nil, nsmFailure(err)
+	}
+	return r, nil
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/computations"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// computation is a request's computation, with validated parameters. close
+// releases a module sent with the request.
+type computation struct {
+	name       string
+	c          computations.Computation
+	parameters []byte
+	close      func()
+}
+
+// newComputation looks the computation up in the registry, or compiles the
+// module sent with the request.
+func newComputation(ctx context.Context, registry *computations.Registry, name string, parameters []byte, wasmModule []byte) (*computation, error) {
+	var c computations.Computation
+	close := func() {}
+	if len(wasmModule) > 0 {
+		w, err := registry.CompileWasm(ctx, wasmModule)
+		if err != nil {
+			return nil, err
+		}
+		name, c, close = messages.WasmComputation, w, func() { w.Close(context.Background()) }
+	} else {
+		var err error
+		if name, c, err = registry.Get(name); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Validate(parameters); err != nil {
+		close()
+		return nil, err
+	}
+	return &computation{name: name, c: c, parameters: parameters, close: close}, nil
+}
+
+func (c *computation) run(ctx context.Context, plaintext []byte) (*messages.ComputationResult, error) {
+	value, err := c.c.Run(ctx, plaintext, c.parameters)
+	if err != nil {
+		return nil, err
+	}
+	result := &messages.ComputationResult{
+		Computation:    c.name,
+		ParametersHash: messages.ParametersHash(c.parameters),
+		Value:          value,
+	}
+	if m, ok := c.c.(computations.Module); ok {
+		result.ModuleHash = m.ModuleHash()
+	}
+	return result, nil
+}
@@ -2,39 +2,54 @@ package handlers
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/kms/types"
-	"github.com/hf/nsm"
 	"github.com/hf/nsm/request"
-	"github.com/mdlayher/vsock"
 
-	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/constants"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/nsm"
 	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/transport"
 	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/utils"
 
 	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 )
 
-func CreateKeyHandler(ctx context.Context, req messages.CreateKeyRequest) (*messages.CreateKeyResponse, error) {
+// KmsConnection describes how the enclave reaches AWS KMS.
+type KmsConnection struct {
+	// Proxy forwards connections to KMS (see the instance's create-key command).
+	Proxy transport.Dialer
+
+	// Endpoint overrides the regional KMS endpoint, e.g. to use fake-kms. Empty
+	// means https://kms.<region>.amazonaws.com.
+	Endpoint string
+}
+
+// Timeout of each call to KMS, retries included. It keeps a slow KMS (or
+// proxy) from using up the whole createKey timeout on a single call.
+const kmsTimeout = 20 * time.Second
+
+// The new key is added to keys, which decrypt requests are checked against.
+func CreateKeyHandler(ctx context.Context, sess nsm.NSM, kmsConnection KmsConnection, keys *KeyRegistry, req messages.CreateKeyRequest) (*messages.CreateKeyResponse, error) {
 	r := &messages.CreateKeyResponse{}
 
-	// The AWS SDK must talk to the vsock. Thankfully, the AWS SDK allows setting
-	// custom http clients.
+	// The AWS SDK must talk to the instance's proxy (over vsock, unless running
+	// outside Nitro). Thankfully, the AWS SDK allows setting custom http clients.
 	httpClient := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
-		tr.DialContext = func(_ context.Context, _, _ string) (net.Conn, error) {
-			log.Printf("Connecting to vsock (cid=%d, port=%d)\n", constants.INSTANCE_CID, constants.INSTANCE_LISTENING_PORT)
-			return vsock.Dial(constants.INSTANCE_CID, constants.INSTANCE_LISTENING_PORT, nil)
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			log.Printf("Connecting to %s\n", kmsConnection.Proxy)
+			return kmsConnection.Proxy.Dial(ctx)
 		}
 	})
 
@@ -49,24 +64,19 @@ func CreateKeyHandler(ctx context.Context, req messages.CreateKeyRequest) (*mess
 	if err != nil {
 		return nil, err
 	}
-	kmsClient := kms.NewFromConfig(cfg)
+	kmsClient := kms.NewFromConfig(cfg, func(o *kms.Options) {
+		if kmsConnection.Endpoint != "" {
+			o.BaseEndpoint = aws.String(kmsConnection.Endpoint)
+		}
+	})
 
 	// Grab the enclave's PCR0. We need it for the key policy. In a real world
 	// application, we would grab other PCR measurements.
-	sess, err := nsm.OpenDefaultSession()
-	if err != nil {
-		return nil, err
-	}
-	defer sess.Close()
-
-	res, err := sess.Send(&request.DescribePCR{Index: 0})
+	pcr0Bytes, err := sess.DescribePCR(0)
 	if err != nil {
-		return nil, err
-	}
-	if res.Error != "" {
-		return nil, fmt.Errorf("request.DescribePCR error: %s", res.Error)
+		return nil, nsmFailure(err)
 	}
-	pcr0 := fmt.Sprintf("%02x", res.DescribePCR.Data)
+	pcr0 := fmt.Sprintf("%02x", pcr0Bytes)
 
 	// Build a restrictive key policy.
 	accountId := req.AccountId
@@ -116,7 +126,9 @@ func CreateKeyHandler(ctx context.Context, req messages.CreateKeyRequest) (*mess
 	}
 
 	// Create the key
-	createKeyResult, err := kmsClient.CreateKey(ctx, &kms.CreateKeyInput{
+	kmsCtx, cancel := context.WithTimeout(ctx, kmsTimeout)
+	defer cancel()
+	createKeyResult, err := kmsClient.CreateKey(kmsCtx, &kms.CreateKeyInput{
 		Description:                    aws.String("github.com/zxsdotch/aws-nitro-enclave-foobar-service"),
 		KeySpec:                        types.KeySpecEccNistP256,
 		KeyUsage:                       types.KeyUsageTypeKeyAgreement,
@@ -124,46 +136,50 @@ func CreateKeyHandler(ctx context.Context, req messages.CreateKeyRequest) (*mess
 		BypassPolicyLockoutSafetyCheck: true,
 	})
 	if err != nil {
-		return nil, err
+		return nil, kmsFailure(err)
 	}
 	log.Printf("key id: %s\n", *createKeyResult.KeyMetadata.KeyId)
 
 	// Grab the public key
-	getPublicKeyResult, err := kmsClient.GetPublicKey(ctx, &kms.GetPublicKeyInput{
+	kmsCtx, cancel = context.WithTimeout(ctx, kmsTimeout)
+	defer cancel()
+	getPublicKeyResult, err := kmsClient.GetPublicKey(kmsCtx, &kms.GetPublicKeyInput{
 		KeyId: createKeyResult.KeyMetadata.KeyId,
 	})
 	if err != nil {
-		return nil, err
+		return nil, kmsFailure(err)
 	}
 	log.Printf("public key: %s\n", base64.RawURLEncoding.EncodeToString(getPublicKeyResult.PublicKey))
 
+	policyHash := sha256.Sum256(policyString)
+	keys.Add(messages.Key{
+		KeyId:      *createKeyResult.KeyMetadata.KeyId,
+		Region:     req.Region,
+		PublicKey:  getPublicKeyResult.PublicKey,
+		PolicyHash: policyHash[:],
+		CreatedAt:  time.Now(),
+	})
+
 	// Return the public key in an attestation
 	userData := messages.CreateKeyResponseAttestationUserData{
-		KeyId:     *createKeyResult.KeyMetadata.KeyId,
-		PublicKey: getPublicKeyResult.PublicKey,
-		Region:    req.Region,
+		KeyId:      *createKeyResult.KeyMetadata.KeyId,
+		PublicKey:  getPublicKeyResult.PublicKey,
+		Region:     req.Region,
+		PolicyHash: policyHash[:],
 	}
 	userDataBytes, err := json.Marshal(userData)
 	if err != nil {
 		return nil, err
 	}
 
-	res, err = sess.Send(&request.Attestation{
-		Nonce:     []byte{},
+	r.Attestation, err = sess.Attestation(request.Attestation{
+		Nonce:     attestationNonce(req.AttestationNonce),
 		UserData:  userDataBytes,
 		PublicKey: []byte{},
 	})
 	if err != nil {
-		return nil, err
-	}
-	if res.Error != "" {
-		return nil, fmt.Errorf("request.Attestation error: %s", res.Error)
+		return nil, nsmFailure(err)
 	}
-	if res.Attestation == nil || res.Attestation.Document == nil {
-		return nil, errors.New("NSM did not return an attestation")
-	}
-
-	r.Attestation = res.Attestation.Document
 
 	return r, nil
 }
@@ -7,101 +7,189 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"io"
-	"log"
+	"sync"
+	"time"
 
 	"github.com/edgebitio/nitro-enclaves-sdk-go/crypto/cms"
-	"github.com/hf/nsm"
 	"github.com/hf/nsm/request"
 	"golang.org/x/crypto/hkdf"
 
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/computations"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/nsm"
 	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/signing"
 )
 
-func DecryptHandler(ctx context.Context, ephemeralRsaKey *rsa.PrivateKey, req messages.DecryptRequest, reqBytes []byte) (*messages.DecryptResponse, error) {
+// The key named by the request must be in keys. The enclave can't tell which
+// key KMS derived the shared secret with, but the ciphertext is bound to the
+// key id: the attested key id is the one the ciphertext was encrypted for.
+//
+// The request's computation, from computations, runs on the plaintext.
+func DecryptHandler(ctx context.Context, sess nsm.NSM, rsaKeys *RsaKeys, sessions *Sessions, keys *KeyRegistry, replayCache *ReplayCache, computations *computations.Registry, signingKey *SigningKey, req messages.DecryptRequest, reqBytes []byte) (*messages.DecryptResponse, error) {
 	r := &messages.DecryptResponse{}
 
-	// Decrypt encrypted shared secret
-	cmsMessage, err := cms.Parse(req.EncryptedSharedSecret)
+	// Checked before taking the session, an unknown key or computation doesn't
+	// use it up.
+	if _, ok := keys.Get(req.KeyId); !ok {
+		return nil, unknownKey(req.KeyId)
+	}
+	computation, err := newComputation(ctx, computations, req.Computation, req.Parameters, req.WasmModule)
 	if err != nil {
 		return nil, err
 	}
+	defer computation.close()
 
-	sharedSecret, err := cmsMessage.Decrypt(ephemeralRsaKey)
+	decrypters, release, err := sessionDecrypters(rsaKeys, sessions, req.SessionId)
 	if err != nil {
 		return nil, err
 	}
-
-	// Step 4: Derive the content encryption key (CEK) using the same KDF.
-	hkdf := hkdf.New(sha256.New, sharedSecret, []byte("foobar-service-salt"), nil)
-	cek := make([]byte, 32)
-	if _, err = io.ReadFull(hkdf, cek); err != nil {
+	defer release()
+
+	plaintext, err := decryptItem(keys, replayCache, decrypters, messages.BatchDecryptItem{
+		KeyId:                 req.KeyId,
+		EncryptedSharedSecret: req.EncryptedSharedSecret,
+		Nonce:                 req.Nonce,
+		Ciphertext:            req.Ciphertext,
+		OneShotUntil:          req.OneShotUntil,
+	}, messages.Binding{})
+	if err != nil {
 		return nil, err
 	}
 
-	// AES-GCM decryption
-	block, err := aes.NewCipher(cek)
+	// Compute result
+	result, err := computation.run(ctx, plaintext)
 	if err != nil {
 		return nil, err
 	}
 
-	aesgcm, err := cipher.NewGCM(block)
+	// Hash the inputs to defend against input swapping
+	h := sha256.New()
+	h.Write(reqBytes)
+
+	userData := messages.DecryptResponseAttestationUserData{
+		InitialRequest: h.Sum(nil),
+		KeyId:          req.KeyId,
+		Result:         *result,
+	}
+	userDataBytes, err := json.Marshal(userData)
 	if err != nil {
 		return nil, err
 	}
+	// Large outputs, e.g. of WebAssembly modules, only fit in batch-decrypt's
+	// Merkle tree.
+	if len(userDataBytes) > maxUserDataSize {
+		return nil, resultTooLarge(len(userDataBytes))
+	}
 
-	plaintext, err := aesgcm.Open(nil, req.Nonce, req.Ciphertext, nil)
+	r.Attestation, err = sess.Attestation(request.Attestation{
+		Nonce:     attestationNonce(req.AttestationNonce),
+		UserData:  userDataBytes,
+		PublicKey: []byte{},
+	})
 	if err != nil {
-		return nil, err
+		return nil, nsmFailure(err)
 	}
 
-	log.Printf("plaintext: %02x", plaintext)
-
-	// Compute result
+	r.SignedResult, err = signingKey.sign(signing.Payload{Request: userData.InitialRequest, KeyId: req.KeyId, Result: result})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
-	count := 0
-	for i := 0; i < len(plaintext); i++ {
-		if plaintext[i] == 'a' {
-			count += 1
-		}
+// sessionDecrypters returns the RSA keys the shared secrets may be encrypted
+// to. A session's key is used for one request, whether decryption succeeds or
+// not: the session is gone once taken, and release destroys the key. Without a session, the shared secret may be encrypted to the
+// previous RSA key, if it was rotated in the meantime.
+func sessionDecrypters(rsaKeys *RsaKeys, sessions *Sessions, sessionId string) ([]*RsaKey, func(), error) {
+	if sessionId == "" {
+		return rsaKeys.Decrypters(), func() {}, nil
+	}
+	sessionKey, err := sessions.Take(sessionId)
+	if err != nil {
+		return nil, nil, err
 	}
+	return []*RsaKey{sessionKey}, sessionKey.destroy, nil
+}
 
-	// Hash the inputs to defend against input swapping
-	h := sha256.New()
-	h.Write(reqBytes)
+// decryptItem decrypts a single ciphertext and returns the plaintext. Only
+// ciphertexts bound to binding decrypt, see messages.Binding.
+//
+// Every operation decrypts through here: one-shot ciphertexts are added to
+// replayCache once decrypted, and can't be decrypted again by any of them.
+func decryptItem(keys *KeyRegistry, replayCache *ReplayCache, decrypters []*RsaKey, item messages.BatchDecryptItem, binding messages.Binding) ([]byte, error) {
+	if _, ok := keys.Get(item.KeyId); !ok {
+		return nil, unknownKey(item.KeyId)
+	}
 
-	userData := messages.DecryptResponseAttestationUserData{
-		InitialRequest: h.Sum(nil),
-		Count:          count,
+	// Decrypt encrypted shared secret
+	cmsMessage, err := parseCms(item.EncryptedSharedSecret)
+	if err != nil {
+		return nil, decryptionFailed(err)
+	}
+	var sharedSecret []byte
+	for _, rsaKey := range decrypters {
+		err = rsaKey.withPrivateKey(func(privateKey *rsa.PrivateKey) (err error) {
+			sharedSecret, err = cmsMessage.Decrypt(privateKey)
+			return err
+		})
+		if err == nil {
+			break
+		}
 	}
-	userDataBytes, err := json.Marshal(userData)
 	if err != nil {
+		return nil, decryptionFailed(err)
+	}
+
+	// Step 4: Derive the content encryption key (CEK) using the same KDF.
+	hkdf := hkdf.New(sha256.New, sharedSecret, []byte("foobar-service-salt"), nil)
+	cek := make([]byte, 32)
+	if _, err = io.ReadFull(hkdf, cek); err != nil {
 		return nil, err
 	}
 
-	sess, err := nsm.OpenDefaultSession()
+	// AES-GCM decryption
+	block, err := aes.NewCipher(cek)
 	if err != nil {
 		return nil, err
 	}
-	defer sess.Close()
 
-	res, err := sess.Send(&request.Attestation{
-		Nonce:     []byte{},
-		UserData:  userDataBytes,
-		PublicKey: []byte{},
-	})
+	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
 		return nil, err
 	}
-	if res.Error != "" {
-		return nil, fmt.Errorf("request.Attestation error: %s", res.Error)
+
+	// Open panics on invalid nonces.
+	if len(item.Nonce) != aesgcm.NonceSize() {
+		return nil, invalidRequest("invalid nonce length: %d", len(item.Nonce))
 	}
-	if res.Attestation == nil || res.Attestation.Document == nil {
-		return nil, errors.New("NSM did not return an attestation")
+	plaintext, err := aesgcm.Open(nil, item.Nonce, item.Ciphertext, messages.AdditionalData(item.KeyId, item.OneShotUntil, binding))
+	if err != nil {
+		return nil, decryptionFailed(err)
 	}
 
-	r.Attestation = res.Attestation.Document
-	return r, nil
+	// Only authenticated ciphertexts are recorded, garbage can't fill the
+	// cache. The nonce is part of the digest, the ciphertext alone doesn't
+	// identify the message.
+	if item.OneShotUntil != 0 {
+		digest := sha256.New()
+		digest.Write(item.Nonce)
+		digest.Write(item.Ciphertext)
+		if err := replayCache.Add([32]byte(digest.Sum(nil)), time.Unix(item.OneShotUntil, 0)); err != nil {
+			return nil, err
+		}
+	}
+
+	return plaintext, nil
+}
+
+// cms.Parse updates a package-level variable, it isn't safe for concurrent
+// use. Parsing is cheap, the RSA decryption which follows runs concurrently.
+var cmsParseMu sync.Mutex
+
+func parseCms(der []byte) (*cms.EncryptedKey, error) {
+	cmsParseMu.Lock()
+	defer cmsParseMu.Unlock()
+	return cms.Parse(der)
 }
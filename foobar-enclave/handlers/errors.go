@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// Handlers return these errors so that the client can tell failures apart.
+// Other errors are reported as messages.ErrorCodeInternal.
+
+func invalidRequest(format string, a ...any) error {
+	return &messages.Error{Code: messages.ErrorCodeInvalidRequest, Message: fmt.Sprintf(format, a...)}
+}
+
+// The NSM only fails on transient conditions or bugs, retrying is worth a try.
+// Inputs which are too large fail again, handlers check their size beforehand
+// to return a better error.
+func nsmFailure(err error) error {
+	retryable := !strings.Contains(err.Error(), "InputTooLarge")
+	return &messages.Error{Code: messages.ErrorCodeNsmFailure, Message: err.Error(), Retryable: retryable}
+}
+
+func resultTooLarge(userDataSize int) error {
+	return &messages.Error{Code: messages.ErrorCodeResultTooLarge, Message: fmt.Sprintf("the attested result is %d bytes, at most %d are allowed", userDataSize, maxUserDataSize)}
+}
+
+// Uses the AWS SDK's classification, which treats throttling and connection
+// errors as retryable. Timeouts are left to the server, which reports them as
+// such.
+func kmsFailure(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return err
+	}
+	retryable := retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+	return &messages.Error{Code: messages.ErrorCodeKmsFailure, Message: err.Error(), Retryable: retryable}
+}
+
+func decryptionFailed(err error) error {
+	return &messages.Error{Code: messages.ErrorCodeDecryptionFailed, Message: err.Error()}
+}
+
+func attestationRejected(format string, a ...any) error {
+	return &messages.Error{Code: messages.ErrorCodeAttestationRejected, Message: fmt.Sprintf(format, a...)}
+}
+
+func unknownKey(keyId string) error {
+	return &messages.Error{Code: messages.ErrorCodeUnknownKey, Message: fmt.Sprintf("key %q was not created by this enclave, or needs to be registered again", keyId)}
+}
+
+func sessionNotFound() error {
+	return &messages.Error{Code: messages.ErrorCodeSessionNotFound, Message: "decrypt session not found, expired or already used"}
+}
+
+// itemError converts the error of a batch item, whose result carries the error
+// instead of failing the whole request.
+func itemError(err error) *messages.Error {
+	var e *messages.Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &messages.Error{Code: messages.ErrorCodeInternal, Message: err.Error()}
+}
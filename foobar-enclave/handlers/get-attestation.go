@@ -2,47 +2,50 @@ package handlers
 
 import (
 	"context"
-	"crypto/rsa"
-	"crypto/x509"
-	"errors"
-	"fmt"
+	"encoding/json"
 
-	"github.com/hf/nsm"
 	"github.com/hf/nsm/request"
 
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/nsm"
 	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
 )
 
-func GetAttestationHandler(ctx context.Context, ephemeralRsaKey *rsa.PrivateKey, req messages.GetAttestationRequest) (*messages.GetAttestationResponse, error) {
+// The attestation carries the RSA key KMS encrypts to: the key of a new or
+// refreshed session if requested, the current RSA key otherwise.
+func GetAttestationHandler(ctx context.Context, sess nsm.NSM, rsaKeys *RsaKeys, sessions *Sessions, health messages.Health, req messages.GetAttestationRequest) (*messages.GetAttestationResponse, error) {
 	r := &messages.GetAttestationResponse{}
 
-	sess, err := nsm.OpenDefaultSession()
+	rsaKey := rsaKeys.Current()
+	var err error
+	switch {
+	case req.OpenSession:
+		r.SessionId, rsaKey, err = sessions.Open()
+	case req.SessionId != "":
+		r.SessionId = req.SessionId
+		rsaKey, err = sessions.Refresh(req.SessionId)
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer sess.Close()
 
-	ephemeralRsaPublicKey, err := x509.MarshalPKIXPublicKey(&ephemeralRsaKey.PublicKey)
+	// The health counters are attested, the instance can't make them up.
+	userDataBytes, err := json.Marshal(messages.GetAttestationResponseAttestationUserData{
+		RsaKey:    rsaKey.Info(),
+		SessionId: r.SessionId,
+		Health:    health,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := sess.Send(&request.Attestation{
-		Nonce:     []byte{},
-		UserData:  []byte{},
-		PublicKey: ephemeralRsaPublicKey,
+	r.Attestation, err = sess.Attestation(request.Attestation{
+		Nonce:     attestationNonce(req.AttestationNonce),
+		UserData:  userDataBytes,
+		PublicKey: rsaKey.PublicKeyDer,
 	})
 	if err != nil {
-		return nil, err
+		return nil, nsmFailure(err)
 	}
-	if res.Error != "" {
-		return nil, fmt.Errorf("request.Attestation error: %s", res.Error)
-	}
-	if res.Attestation == nil || res.Attestation.Document == nil {
-		return nil, errors.New("NSM did not return an attestation")
-	}
-
-	r.Attestation = res.Attestation.Document
 
 	return r, nil
 }
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// Both sides check the version: the client refuses an enclave which speaks
+// another one, and the enclave a client which does.
+func HelloHandler(ctx context.Context, buildVersion string, operations []string, req messages.HelloRequest) (*messages.HelloResponse, error) {
+	if req.ProtocolVersion != messages.ProtocolVersion {
+		return nil, &messages.Error{
+			Code:    messages.ErrorCodeIncompatibleProtocol,
+			Message: fmt.Sprintf("the client speaks protocol version %d, the enclave (build %s) speaks protocol version %d", req.ProtocolVersion, buildVersion, messages.ProtocolVersion),
+		}
+	}
+	return &messages.HelloResponse{
+		ProtocolVersion: messages.ProtocolVersion,
+		BuildVersion:    buildVersion,
+		Operations:      operations,
+	}, nil
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/hf/nsm/request"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/nsm"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/ecies"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/signing"
+)
+
+// Only the size of the intersection is attested, the plaintexts themselves
+// only leave the enclave sealed to the request's recipient. Items which fail
+// to decrypt, including those bound to another party or recipient, are
+// counted as rejected.
+//
+// Each set must hold at least minSetSize distinct values which decrypt, or the
+// request fails with COHORT_TOO_SMALL: otherwise a caller who can encrypt for
+// one party could test whether a value is in the other set with a set of one.
+func IntersectHandler(ctx context.Context, sess nsm.NSM, rsaKeys *RsaKeys, sessions *Sessions, keys *KeyRegistry, replayCache *ReplayCache, signingKey *SigningKey, minSetSize int, req messages.IntersectRequest, reqBytes []byte) (*messages.IntersectResponse, error) {
+	r := &messages.IntersectResponse{}
+
+	var recipient *ecdh.PublicKey
+	var recipientHash []byte
+	if req.Recipient != nil {
+		key, err := ecies.ParsePublicKey(req.Recipient)
+		if err != nil {
+			return nil, invalidRequest("invalid recipient: %s", err)
+		}
+		recipient = key
+		h := sha256.Sum256(req.Recipient)
+		recipientHash = h[:]
+	}
+
+	decrypters, release, err := sessionDecrypters(rsaKeys, sessions, req.SessionId)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Both sets are decrypted in a single pass, the left one first.
+	var mu sync.Mutex
+	left, right := map[string]bool{}, map[string]bool{}
+	leftRejected, rightRejected := 0, 0
+	items := append(append([]messages.BatchDecryptItem{}, req.Left...), req.Right...)
+	binding := func(i int) messages.Binding {
+		if i < len(req.Left) {
+			return messages.Binding{RecipientHash: recipientHash, Party: req.LeftParty}
+		}
+		return messages.Binding{RecipientHash: recipientHash, Party: req.RightParty}
+	}
+	err = decryptAll(ctx, keys, replayCache, decrypters, items, binding, func(i int, plaintext []byte, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case err != nil && i < len(req.Left):
+			leftRejected++
+		case err != nil:
+			rightRejected++
+		case i < len(req.Left):
+			left[string(plaintext)] = true
+		default:
+			right[string(plaintext)] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(left) < minSetSize || len(right) < minSetSize {
+		return nil, &messages.Error{
+			Code:    messages.ErrorCodeCohortTooSmall,
+			Message: fmt.Sprintf("got %d and %d distinct values, at least %d per set are required", len(left), len(right), minSetSize),
+		}
+	}
+
+	var intersection [][]byte
+	for plaintext := range left {
+		if right[plaintext] {
+			intersection = append(intersection, []byte(plaintext))
+		}
+	}
+
+	// Hash the inputs to defend against input swapping
+	h := sha256.New()
+	h.Write(reqBytes)
+
+	userData := messages.IntersectResponseAttestationUserData{
+		InitialRequest: h.Sum(nil),
+		LeftDigest:     messages.InputSetDigest(req.Left),
+		RightDigest:    messages.InputSetDigest(req.Right),
+		LeftParty:      req.LeftParty,
+		RightParty:     req.RightParty,
+		Size:           len(intersection),
+		LeftRejected:   leftRejected,
+		RightRejected:  rightRejected,
+		MinSetSize:     minSetSize,
+	}
+
+	if recipient != nil {
+		// Sorted, so that the order doesn't depend on the map's.
+		sort.Slice(intersection, func(i, j int) bool { return bytes.Compare(intersection[i], intersection[j]) < 0 })
+		for _, plaintext := range intersection {
+			element, err := ecies.Seal(recipient, plaintext, nil)
+			if err != nil {
+				return nil, err
+			}
+			r.Elements = append(r.Elements, *element)
+		}
+		userData.RecipientHash = recipientHash
+		userData.ElementsHash = messages.ElementsHash(r.Elements)
+	}
+
+	userDataBytes, err := json.Marshal(userData)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Attestation, err = sess.Attestation(request.Attestation{
+		Nonce:     attestationNonce(req.AttestationNonce),
+		UserData:  userDataBytes,
+		PublicKey: []byte{},
+	})
+	if err != nil {
+		return nil, nsmFailure(err)
+	}
+
+	r.SignedResult, err = signingKey.sign(signing.Payload{Request: userData.InitialRequest, Intersect: &userData})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"sync"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// KeyRegistry remembers the KMS keys created by the enclave. It only lives in
+// memory: after a restart, keys created earlier are unknown to the enclave
+// until they are registered again, see RegisterKeyHandler.
+type KeyRegistry struct {
+	mu   sync.Mutex
+	keys []messages.Key
+}
+
+func NewKeyRegistry() *KeyRegistry {
+	return &KeyRegistry{}
+}
+
+func (r *KeyRegistry) Add(key messages.Key) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = append(r.keys, key)
+}
+
+// Register adds key unless a key with the same id is known. It returns false
+// if the key was known.
+func (r *KeyRegistry) Register(key messages.Key) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range r.keys {
+		if k.KeyId == key.KeyId {
+			return false
+		}
+	}
+	r.keys = append(r.keys, key)
+	return true
+}
+
+func (r *KeyRegistry) Get(keyId string) (messages.Key, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range r.keys {
+		if key.KeyId == keyId {
+			return key, true
+		}
+	}
+	return messages.Key{}, false
+}
+
+// List returns the keys in the order they were created.
+func (r *KeyRegistry) List() []messages.Key {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]messages.Key{}, r.keys...)
+}
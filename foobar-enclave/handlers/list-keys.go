@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/hf/nsm/request"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/nsm"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// ListKeysHandler returns the keys in the registry, and attests their hash.
+func ListKeysHandler(ctx context.Context, sess nsm.NSM, keys *KeyRegistry, req messages.ListKeysRequest) (*messages.ListKeysResponse, error) {
+	r := &messages.ListKeysResponse{Keys: keys.List()}
+
+	userDataBytes, err := json.Marshal(messages.ListKeysResponseAttestationUserData{
+		Count:    len(r.Keys),
+		KeysHash: messages.KeysHash(r.Keys),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r.Attestation, err = sess.Attestation(request.Attestation{
+		Nonce:     []byte{},
+		UserData:  userDataBytes,
+		PublicKey: []byte{},
+	})
+	if err != nil {
+		return nil, nsmFailure(err)
+	}
+	return r, nil
+}
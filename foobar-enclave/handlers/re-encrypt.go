@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+
+	"github.com/hf/nsm/request"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/nsm"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/ecies"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/signing"
+)
+
+// The plaintext is sealed to the recipient inside the enclave, the parent
+// instance only sees the new ciphertext. Otherwise the parent instance could
+// re-encrypt any ciphertext to a key it holds: plain recipients must be bound
+// to the ciphertext by its owner, foobar recipients must come from the same
+// enclave image. The new ciphertext of a foobar recipient is neither one-shot
+// nor bound, which is why the request can't be one-shot and the ciphertext is
+// decrypted without a binding.
+func ReEncryptHandler(ctx context.Context, sess nsm.NSM, rsaKeys *RsaKeys, sessions *Sessions, keys *KeyRegistry, replayCache *ReplayCache, signingKey *SigningKey, req messages.ReEncryptRequest, reqBytes []byte) (*messages.ReEncryptResponse, error) {
+	// Checked before taking the session, an unknown key or recipient doesn't
+	// use it up.
+	if _, ok := keys.Get(req.KeyId); !ok {
+		return nil, unknownKey(req.KeyId)
+	}
+	recipientBytes, recipientKeyId, binding := req.Recipient, "", messages.Binding{}
+	if req.RecipientAttestation != nil {
+		doc, err := verifyOwnAttestation(sess, req.RecipientAttestation)
+		if err != nil {
+			return nil, err
+		}
+		userData, err := createKeyUserData(doc)
+		if err != nil {
+			return nil, err
+		}
+		recipientBytes, recipientKeyId = userData.PublicKey, userData.KeyId
+	} else {
+		recipientHash := sha256.Sum256(req.Recipient)
+		binding.RecipientHash = recipientHash[:]
+	}
+	recipient, err := ecies.ParsePublicKey(recipientBytes)
+	if err != nil {
+		return nil, invalidRequest("invalid recipient: %s", err)
+	}
+
+	decrypters, release, err := sessionDecrypters(rsaKeys, sessions, req.SessionId)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	plaintext, err := decryptItem(keys, replayCache, decrypters, messages.BatchDecryptItem{
+		KeyId:                 req.KeyId,
+		EncryptedSharedSecret: req.EncryptedSharedSecret,
+		Nonce:                 req.Nonce,
+		Ciphertext:            req.Ciphertext,
+		OneShotUntil:          req.OneShotUntil,
+	}, binding)
+	if err != nil {
+		return nil, err
+	}
+
+	// A foobar recipient decrypts the new ciphertext like any other, which is
+	// bound to its key id.
+	var additionalData []byte
+	if recipientKeyId != "" {
+		additionalData = messages.AdditionalData(recipientKeyId, 0, messages.Binding{})
+	}
+	ciphertext, err := ecies.Seal(recipient, plaintext, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hash the inputs to defend against input swapping
+	h := sha256.New()
+	h.Write(reqBytes)
+
+	recipientHash := sha256.Sum256(recipientBytes)
+	userData := messages.ReEncryptResponseAttestationUserData{
+		InitialRequest: h.Sum(nil),
+		KeyId:          req.KeyId,
+		RecipientHash:  recipientHash[:],
+		RecipientKeyId: recipientKeyId,
+		CiphertextHash: messages.CiphertextHash(*ciphertext),
+	}
+	userDataBytes, err := json.Marshal(userData)
+	if err != nil {
+		return nil, err
+	}
+
+	attestation, err := sess.Attestation(request.Attestation{
+		Nonce:     attestationNonce(req.AttestationNonce),
+		UserData:  userDataBytes,
+		PublicKey: []byte{},
+	})
+	if err != nil {
+		return nil, nsmFailure(err)
+	}
+
+	signedResult, err := signingKey.sign(signing.Payload{Request: userData.InitialRequest, KeyId: req.KeyId, ReEncrypt: &userData})
+	if err != nil {
+		return nil, err
+	}
+	return &messages.ReEncryptResponse{Attestation: attestation, Ciphertext: *ciphertext, SignedResult: signedResult}, nil
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/nsm"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// RegisterKeyHandler adds a key created by an earlier run of the same enclave
+// image to keys. The key's policy only lets enclaves with this PCR0 derive
+// shared secrets, the attestation proves such an enclave created it.
+func RegisterKeyHandler(ctx context.Context, sess nsm.NSM, keys *KeyRegistry, req messages.RegisterKeyRequest) (*messages.RegisterKeyResponse, error) {
+	doc, err := verifyOwnAttestation(sess, req.Attestation)
+	if err != nil {
+		return nil, err
+	}
+	userData, err := createKeyUserData(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	registered := keys.Register(messages.Key{
+		KeyId:      userData.KeyId,
+		Region:     userData.Region,
+		PublicKey:  userData.PublicKey,
+		PolicyHash: userData.PolicyHash,
+		CreatedAt:  doc.Timestamp,
+	})
+	return &messages.RegisterKeyResponse{KeyId: userData.KeyId, Registered: registered}, nil
+}
+
+// createKeyUserData decodes the user data of a createKey attestation. Unknown
+// fields are rejected, so that other attestations can't pass for one.
+func createKeyUserData(doc *nsm.Document) (messages.CreateKeyResponseAttestationUserData, error) {
+	var userData messages.CreateKeyResponseAttestationUserData
+	d := json.NewDecoder(bytes.NewReader(doc.UserData))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&userData); err != nil || userData.KeyId == "" || len(userData.PublicKey) == 0 {
+		return userData, invalidRequest("not a createKey attestation")
+	}
+	return userData, nil
+}
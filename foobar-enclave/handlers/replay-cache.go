@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// ReplayCache remembers the one-shot ciphertexts which were decrypted, until
+// they expire. Ciphertexts may not expire more than window in the future, and
+// at most size of them are remembered. The cache only lives in memory, it is
+// lost when the enclave restarts.
+type ReplayCache struct {
+	window time.Duration
+	size   int
+
+	mu      sync.Mutex
+	entries map[[32]byte]time.Time
+}
+
+func NewReplayCache(window time.Duration, size int) *ReplayCache {
+	return &ReplayCache{window: window, size: size, entries: map[[32]byte]time.Time{}}
+}
+
+// Add records the digest of a one-shot ciphertext which expires at until. It
+// fails if the ciphertext was already recorded.
+func (c *ReplayCache) Add(digest [32]byte, until time.Time) error {
+	now := time.Now()
+	if !now.Before(until) {
+		return invalidRequest("one-shot ciphertext expired at %s", until.UTC().Format(time.RFC3339))
+	}
+	if until.After(now.Add(c.window)) {
+		return invalidRequest("one-shot ciphertext expires at %s, more than %s from now", until.UTC().Format(time.RFC3339), c.window)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[digest]; ok {
+		return &messages.Error{Code: messages.ErrorCodeReplay, Message: "one-shot ciphertext was already decrypted"}
+	}
+	if len(c.entries) >= c.size {
+		for d, expiresAt := range c.entries {
+			if !now.Before(expiresAt) {
+				delete(c.entries, d)
+			}
+		}
+	}
+	// Forgetting a ciphertext before it expires would allow replaying it.
+	if len(c.entries) >= c.size {
+		return &messages.Error{Code: messages.ErrorCodeUnavailable, Message: fmt.Sprintf("replay cache is full (%d ciphertexts)", c.size), Retryable: true}
+	}
+	c.entries[digest] = until
+	return nil
+}
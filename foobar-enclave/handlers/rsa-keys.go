@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// RsaKey is an ephemeral RSA key, which KMS encrypts shared secrets to. It is
+// never persisted.
+type RsaKey struct {
+	PublicKeyDer []byte
+	GeneratedAt  time.Time
+	bits         int
+
+	// Nil once destroyed.
+	mu         sync.RWMutex
+	privateKey *rsa.PrivateKey
+}
+
+var errRsaKeyDestroyed = errors.New("RSA key destroyed")
+
+func generateRsaKey(bits int) (*RsaKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, err
+	}
+	publicKeyDer, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("rsaKey: %s\n", base64.RawURLEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(&key.PublicKey)))
+	return &RsaKey{PublicKeyDer: publicKeyDer, GeneratedAt: time.Now(), bits: bits, privateKey: key}, nil
+}
+
+// withPrivateKey calls f with the private key. It fails with
+// errRsaKeyDestroyed once the key was destroyed.
+func (k *RsaKey) withPrivateKey(f func(*rsa.PrivateKey) error) error {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.privateKey == nil {
+		return errRsaKeyDestroyed
+	}
+	return f(k.privateKey)
+}
+
+// destroy drops the private key, the key can't decrypt anymore. Its memory,
+// including the values crypto/rsa precomputes, is only reclaimed by the
+// garbage collector: overwriting it in place wouldn't reach every copy.
+func (k *RsaKey) destroy() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.privateKey = nil
+}
+
+// Info describes the key in attestations.
+func (k *RsaKey) Info() messages.RsaKey {
+	fingerprint := sha256.Sum256(k.PublicKeyDer)
+	return messages.RsaKey{
+		Bits:        k.bits,
+		Fingerprint: fingerprint[:],
+		GeneratedAt: k.GeneratedAt,
+	}
+}
+
+// RsaKeys holds the current RSA key, which attestations carry, and the previous
+// one. Clients may have had KMS encrypt a shared secret to the previous key
+// right before a rotation, it therefore keeps decrypting for overlap.
+type RsaKeys struct {
+	bits    int
+	overlap time.Duration
+
+	mu        sync.Mutex
+	current   *RsaKey
+	previous  *RsaKey
+	rotatedAt time.Time
+}
+
+// NewRsaKeys generates the first key. bits must be 2048, 3072 or 4096.
+func NewRsaKeys(bits int, overlap time.Duration) (*RsaKeys, error) {
+	if bits != 2048 && bits != 3072 && bits != 4096 {
+		return nil, fmt.Errorf("invalid RSA key size: %d", bits)
+	}
+	if overlap < 0 {
+		return nil, fmt.Errorf("invalid RSA key overlap: %s", overlap)
+	}
+	key, err := generateRsaKey(bits)
+	if err != nil {
+		return nil, err
+	}
+	return &RsaKeys{bits: bits, overlap: overlap, current: key}, nil
+}
+
+// Rotate replaces the current key. Keys older than the previous one are
+// dropped, even if they are within the overlap.
+func (k *RsaKeys) Rotate() error {
+	key, err := generateRsaKey(k.bits)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.previous = k.current
+	k.current = key
+	k.rotatedAt = time.Now()
+	return nil
+}
+
+func (k *RsaKeys) Current() *RsaKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.current
+}
+
+// Decrypters returns the keys which may decrypt: the current key, followed by
+// the previous one during the overlap.
+func (k *RsaKeys) Decrypters() []*RsaKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keys := []*RsaKey{k.current}
+	if k.previous != nil && time.Since(k.rotatedAt) < k.overlap {
+		keys = append(keys, k.previous)
+	}
+	return keys
+}
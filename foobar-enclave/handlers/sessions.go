@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// Sessions holds the single-use RSA keys of decrypt sessions. A session ends
+// once its key was taken, or as soon as it expires, whether there is traffic
+// or not. Its key is then destroyed. At most max sessions are open at a time: each one
+// costs an RSA key generation and memory until it expires.
+type Sessions struct {
+	bits int
+	ttl  time.Duration
+	max  int
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	// Sessions whose key is being generated, they count towards max.
+	opening int
+}
+
+type session struct {
+	key   *RsaKey
+	timer *time.Timer
+}
+
+func NewSessions(bits int, ttl time.Duration, max int) *Sessions {
+	return &Sessions{bits: bits, ttl: ttl, max: max, sessions: map[string]*session{}}
+}
+
+// Open generates the key of a new session. It fails with a retryable
+// UNAVAILABLE error if max sessions are already open.
+func (s *Sessions) Open() (string, *RsaKey, error) {
+	s.mu.Lock()
+	if len(s.sessions)+s.opening >= s.max {
+		s.mu.Unlock()
+		return "", nil, &messages.Error{Code: messages.ErrorCodeUnavailable, Message: fmt.Sprintf("%d decrypt sessions are open, retry once some are used or expired", s.max), Retryable: true}
+	}
+	s.opening++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.opening--
+		s.mu.Unlock()
+	}()
+
+	key, err := generateRsaKey(s.bits)
+	if err != nil {
+		return "", nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	sessionId := hex.EncodeToString(id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session := &session{key: key}
+	session.timer = time.AfterFunc(s.ttl, func() { s.expire(sessionId, session) })
+	s.sessions[sessionId] = session
+	return sessionId, key, nil
+}
+
+// Refresh restarts the expiry of an open session and returns its key, for
+// another attestation.
+func (s *Sessions) Refresh(sessionId string) (*RsaKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionId]
+	// The timer may have fired already, the session is then about to expire.
+	if !ok || !session.timer.Stop() {
+		return nil, sessionNotFound()
+	}
+	session.timer.Reset(s.ttl)
+	return session.key, nil
+}
+
+// Take ends the session and returns its key. The caller must destroy the key
+// after using it.
+func (s *Sessions) Take(sessionId string) (*RsaKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionId]
+	if !ok {
+		return nil, sessionNotFound()
+	}
+	session.timer.Stop()
+	delete(s.sessions, sessionId)
+	return session.key, nil
+}
+
+// Len returns the number of open sessions.
+func (s *Sessions) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// expire destroys the key of an expired session, unless it was taken in the
+// meantime.
+func (s *Sessions) expire(sessionId string, expired *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[sessionId] != expired {
+		return
+	}
+	expired.key.destroy()
+	delete(s.sessions, sessionId)
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// decryptWith decrypts an OAEP ciphertext the way KMS encrypts shared secrets.
+func decryptWith(key *RsaKey, ciphertext []byte) ([]byte, error) {
+	var plaintext []byte
+	err := key.withPrivateKey(func(privateKey *rsa.PrivateKey) (err error) {
+		plaintext, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, ciphertext, nil)
+		return err
+	})
+	return plaintext, err
+}
+
+func encryptTo(t *testing.T, key *RsaKey, plaintext string) []byte {
+	t.Helper()
+	var ciphertext []byte
+	if err := key.withPrivateKey(func(privateKey *rsa.PrivateKey) (err error) {
+		ciphertext, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, &privateKey.PublicKey, []byte(plaintext), nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+// A session's key serves one request: the session is gone once taken, and the
+// destroyed key doesn't decrypt anymore, even through a reference kept from
+// Open.
+func TestSessionSingleUse(t *testing.T) {
+	sessions := NewSessions(2048, time.Minute, 1)
+	sessionId, opened, err := sessions.Open()
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	ciphertext := encryptTo(t, opened, "shared secret")
+
+	key, err := sessions.Take(sessionId)
+	if err != nil {
+		t.Fatalf("Take failed: %s", err)
+	}
+	if got, err := decryptWith(key, ciphertext); err != nil || string(got) != "shared secret" {
+		t.Fatalf("got %q, %v, want the shared secret", got, err)
+	}
+	key.destroy()
+
+	var e *messages.Error
+	if _, err := sessions.Take(sessionId); !errors.As(err, &e) || e.Code != messages.ErrorCodeSessionNotFound {
+		t.Errorf("second Take: got %v, want %s", err, messages.ErrorCodeSessionNotFound)
+	}
+	if _, err := decryptWith(opened, ciphertext); err != errRsaKeyDestroyed {
+		t.Errorf("got %v after destroy, want %v", err, errRsaKeyDestroyed)
+	}
+	if sessions.Len() != 0 {
+		t.Errorf("got %d open sessions, want 0", sessions.Len())
+	}
+}
+
+// The key of an expired session is destroyed without being taken.
+func TestSessionExpiry(t *testing.T) {
+	sessions := NewSessions(2048, 10*time.Millisecond, 1)
+	sessionId, key, err := sessions.Open()
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	ciphertext := encryptTo(t, key, "shared secret")
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := sessions.Take(sessionId); err == nil {
+		t.Error("took an expired session")
+	}
+	if _, err := decryptWith(key, ciphertext); err != errRsaKeyDestroyed {
+		t.Errorf("got %v after expiry, want %v", err, errRsaKeyDestroyed)
+	}
+}
+
+// Refreshing a session restarts its expiry.
+func TestSessionRefresh(t *testing.T) {
+	sessions := NewSessions(2048, 200*time.Millisecond, 1)
+	sessionId, opened, err := sessions.Open()
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	time.Sleep(120 * time.Millisecond)
+	if key, err := sessions.Refresh(sessionId); err != nil || key != opened {
+		t.Fatalf("got %v, %v, want the session's key", key, err)
+	}
+	time.Sleep(120 * time.Millisecond)
+	if _, err := sessions.Take(sessionId); err != nil {
+		t.Errorf("Take failed after a refresh: %s", err)
+	}
+	if _, err := sessions.Refresh(sessionId); err == nil {
+		t.Error("refreshed a session which was taken")
+	}
+}
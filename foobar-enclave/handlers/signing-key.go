@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"time"
+
+	"github.com/hf/nsm/request"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/nsm"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/signing"
+)
+
+// SigningKey signs the results of requests, so that they can be verified without
+// the Nitro PKI. It lives as long as the enclave, GetSigningKeyHandler attests
+// its public key.
+type SigningKey struct {
+	privateKey   ed25519.PrivateKey
+	PublicKeyDer []byte
+	Thumbprint   string
+}
+
+func NewSigningKey() (*SigningKey, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	publicKeyDer, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{privateKey: privateKey, PublicKeyDer: publicKeyDer, Thumbprint: signing.Thumbprint(publicKey)}, nil
+}
+
+// sign returns the signed result, see signing.Payload. It sets IssuedAt.
+func (k *SigningKey) sign(payload signing.Payload) (string, error) {
+	payload.IssuedAt = time.Now().Unix()
+	return signing.Sign(k.privateKey, payload)
+}
+
+func GetSigningKeyHandler(ctx context.Context, sess nsm.NSM, signingKey *SigningKey, req messages.GetSigningKeyRequest) (*messages.GetSigningKeyResponse, error) {
+	r := &messages.GetSigningKeyResponse{}
+
+	userDataBytes, err := json.Marshal(messages.GetSigningKeyResponseAttestationUserData{
+		PublicKey:  signingKey.PublicKeyDer,
+		Thumbprint: signingKey.Thumbprint,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r.Attestation, err = sess.Attestation(request.Attestation{
+		Nonce:     attestationNonce(req.AttestationNonce),
+		UserData:  userDataBytes,
+		PublicKey: []byte{},
+	})
+	if err != nil {
+		return nil, nsmFailure(err)
+	}
+	return r, nil
+}
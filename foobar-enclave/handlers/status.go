@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/hf/nsm/request"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/nsm"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// StatusHandler returns the status collected by the server, and attests its
+// hash.
+func StatusHandler(ctx context.Context, sess nsm.NSM, status messages.EnclaveStatus, req messages.StatusRequest) (*messages.StatusResponse, error) {
+	r := &messages.StatusResponse{Status: status}
+
+	userDataBytes, err := json.Marshal(messages.StatusResponseAttestationUserData{StatusHash: status.Hash()})
+	if err != nil {
+		return nil, err
+	}
+
+	r.Attestation, err = sess.Attestation(request.Attestation{
+		Nonce:     []byte{},
+		UserData:  userDataBytes,
+		PublicKey: []byte{},
+	})
+	if err != nil {
+		return nil, nsmFailure(err)
+	}
+	return r, nil
+}
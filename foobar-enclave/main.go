@@ -1,92 +1,209 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/base64"
-	"encoding/json"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/mdlayher/vsock"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/computations"
 	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/handlers"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/nsm"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/server"
 	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/constants"
 	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/transport"
 	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/utils"
 )
 
 var (
-	ephemeralRsaKey *rsa.PrivateKey
+	enclaveAddress = flag.String("enclave-addr",
+		utils.Getenv(constants.ENCLAVE_ADDRESS_ENV, transport.Vsock{Port: constants.ENCLAVE_LISTENING_PORT}.String()),
+		"Address to listen on for commands")
+	kmsProxyAddress = flag.String("kms-proxy-addr",
+		utils.Getenv(constants.KMS_PROXY_ADDRESS_ENV, transport.Vsock{ContextID: constants.INSTANCE_CID, Port: constants.INSTANCE_LISTENING_PORT}.String()),
+		"Address of the instance's KMS proxy")
+	kmsEndpoint = flag.String("kms-endpoint",
+		utils.Getenv(constants.KMS_ENDPOINT_ENV, ""),
+		"Override the AWS KMS endpoint, e.g. to use fake-kms")
+	allowedCids = flag.String("allow-cid",
+		utils.Getenv("FOOBAR_ALLOW_CID", ""),
+		"Comma separated vsock CIDs allowed to send requests, e.g. 3 for the parent instance. Empty allows everyone")
+	maxConcurrentRequests = flag.Int("max-concurrent-requests",
+		64,
+		"Maximum number of requests handled at the same time")
+	maxConnections = flag.Int("max-connections",
+		256,
+		"Maximum number of open connections")
+	maxBufferedBytes = flag.Int64("max-buffered-bytes",
+		256<<20,
+		"Maximum total size of the requests held in memory, at least the 64 MiB frame limit")
+	rsaKeySize = flag.Int("rsa-key-size",
+		2048,
+		"Size of the ephemeral RSA keys: 2048, 3072 or 4096 bits")
+	rsaKeyRotation = flag.Duration("rsa-key-rotation",
+		0,
+		"How often to replace the ephemeral RSA key, e.g. 1h. 0 keeps the same key for the life of the enclave")
+	rsaKeyOverlap = flag.Duration("rsa-key-overlap",
+		10*time.Minute,
+		"How long the previous RSA key keeps decrypting after a rotation")
+	decryptSessionTTL = flag.Duration("decrypt-session-ttl",
+		5*time.Minute,
+		"How long the single-use RSA key of an unused decrypt session lives")
+	maxDecryptSessions = flag.Int("max-decrypt-sessions",
+		256,
+		"Maximum number of decrypt sessions open at the same time")
+	replayWindow = flag.Duration("replay-window",
+		24*time.Hour,
+		"How far in the future one-shot ciphertexts may expire")
+	replayCacheSize = flag.Int("replay-cache-size",
+		100000,
+		"Maximum number of unexpired one-shot ciphertexts the enclave remembers")
+	minIntersectSetSize = flag.Int("min-intersect-set-size",
+		10,
+		"Minimum number of distinct values each set of an intersection must hold")
+	wasmMemoryPages = flag.Uint("wasm-memory-pages",
+		uint(computations.DefaultWasmLimits.MemoryPages),
+		"Maximum memory of a WebAssembly computation, in 64 KiB pages")
+	wasmFuel = flag.Uint64("wasm-fuel",
+		computations.DefaultWasmLimits.Fuel,
+		"Maximum number of function calls of a WebAssembly computation. Loops without calls are only bounded by --wasm-timeout")
+	wasmTimeout = flag.Duration("wasm-timeout",
+		computations.DefaultWasmLimits.Timeout,
+		"Maximum duration of a WebAssembly computation")
+	wasmModules = flag.String("wasm-modules",
+		utils.Getenv("FOOBAR_WASM_MODULES", ""),
+		"Comma separated WebAssembly computations to register, as name=path to the module")
+	shutdownTimeout = flag.Duration("shutdown-timeout",
+		30*time.Second,
+		"How long in-flight requests get to complete on SIGTERM or SIGINT")
+
+	// The simulator is only meant for development and tests. Its attestations
+	// are not signed by the AWS Nitro root, so the real KMS rejects them.
+	nsmMode = flag.String("nsm",
+		utils.Getenv("FOOBAR_NSM", "nitro"),
+		"NSM implementation: nitro or simulator")
+	simulatorPcr0 = flag.String("simulator-pcr0",
+		utils.Getenv("FOOBAR_SIMULATOR_PCR0", ""),
+		"PCR0 reported by the NSM simulator (hex, 48 bytes)")
+	simulatorRootPath = flag.String("simulator-root-path",
+		utils.Getenv("FOOBAR_SIMULATOR_ROOT_PATH", "./root.pem"),
+		"Path where the NSM simulator writes its root certificate")
 )
 
 func main() {
 	log.Println("foobar-enclave is starting")
+	flag.Parse()
 
-	// Generate an ephemeral RSA key, which will be used by AWS KMS to encrypt
-	// responses. The choice of RSA is currently not configurable. In addition,
-	// this is the only way to create policies which bind to specific PCR0 hashes.
-	var err error
-	ephemeralRsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	listenEndpoint, err := transport.Parse(*enclaveAddress)
 	utils.PanicOnErr(err)
+	kmsProxy, err := transport.Parse(*kmsProxyAddress)
+	utils.PanicOnErr(err)
+	kmsConnection := handlers.KmsConnection{Proxy: kmsProxy, Endpoint: *kmsEndpoint}
 
-	log.Printf("rsaKey: %s\n", base64.RawURLEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(&ephemeralRsaKey.PublicKey)))
-
-	fmt.Printf("listening on vsock (port=%d)\n", constants.ENCLAVE_LISTENING_PORT)
-	listener, err := vsock.Listen(constants.ENCLAVE_LISTENING_PORT, nil)
+	nsmSession, err := openNsm()
 	utils.PanicOnErr(err)
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Println("listener.Accept() failed: ", err)
-			continue
+	s, err := server.New(nsmSession, kmsConnection)
+	utils.PanicOnErr(err)
+	if *allowedCids != "" {
+		var cids []uint32
+		for _, cid := range strings.Split(*allowedCids, ",") {
+			n, err := strconv.ParseUint(strings.TrimSpace(cid), 10, 32)
+			utils.PanicOnErr(err)
+			cids = append(cids, uint32(n))
 		}
-
-		// handle connection in a goroutine
-		go handleConnection(conn)
+		s.Use(server.Authorization(cids))
 	}
-}
 
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		ctx := context.TODO()
+	s.MaxConcurrentRequests = *maxConcurrentRequests
+	s.MaxConnections = *maxConnections
+	s.MaxBufferedBytes = *maxBufferedBytes
+	s.RsaKeySize = *rsaKeySize
+	s.RsaKeyRotation = *rsaKeyRotation
+	s.RsaKeyOverlap = *rsaKeyOverlap
+	s.DecryptSessionTTL = *decryptSessionTTL
+	s.MaxDecryptSessions = *maxDecryptSessions
+	s.ReplayWindow = *replayWindow
+	s.ReplayCacheSize = *replayCacheSize
+	s.MinIntersectSetSize = *minIntersectSetSize
 
-		log.Printf("recv: %+v", scanner.Text())
-		reqBytes := scanner.Bytes()
-		var req messages.FoobarRequest
-		var res messages.FoobarResponse
-		var err error
-		err = json.Unmarshal(reqBytes, &req)
-		if err != nil {
-			err = fmt.Errorf("json.Unmarshal failed: %w", err)
-		} else {
-			if req.CreateKey != nil {
-				res.CreateKey, err = handlers.CreateKeyHandler(ctx, *req.CreateKey)
-			} else if req.GetAttestation != nil {
-				res.GetAttestation, err = handlers.GetAttestationHandler(ctx, ephemeralRsaKey, *req.GetAttestation)
-			} else if req.Decrypt != nil {
-				res.Decrypt, err = handlers.DecryptHandler(ctx, ephemeralRsaKey, *req.Decrypt, reqBytes)
-			} else {
-				err = fmt.Errorf("unexpected command")
+	err = s.Computations.SetWasmLimits(computations.WasmLimits{
+		MemoryPages: uint32(*wasmMemoryPages),
+		Fuel:        *wasmFuel,
+		Timeout:     *wasmTimeout,
+	})
+	utils.PanicOnErr(err)
+	if *wasmModules != "" {
+		for _, module := range strings.Split(*wasmModules, ",") {
+			name, path, ok := strings.Cut(strings.TrimSpace(module), "=")
+			if !ok {
+				utils.PanicOnErr(fmt.Errorf("invalid WebAssembly module %q, expected name=path", module))
 			}
+			wasm, err := os.ReadFile(path)
+			utils.PanicOnErr(err)
+			err = s.Computations.RegisterWasm(context.Background(), name, wasm)
+			utils.PanicOnErr(err)
+			log.Printf("registered WebAssembly computation %s (SHA-256 %02x)\n", name, messages.ModuleHash(wasm))
 		}
+	}
 
-		if err != nil {
-			res.Error = utils.Ref(err.Error())
+	fmt.Printf("listening on %s\n", listenEndpoint)
+	listener, err := listenEndpoint.Listen()
+	utils.PanicOnErr(err)
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-signals
+		log.Printf("received %s, shutting down\n", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("s.Shutdown() failed: %s\n", err)
 		}
-		log.Printf("send: %+v", res)
-		resBytes, err := json.Marshal(res)
+		close(shutdownDone)
+	}()
+
+	err = s.Serve(listener)
+	if !errors.Is(err, server.ErrServerClosed) {
 		utils.PanicOnErr(err)
-		conn.Write(resBytes)
-		conn.Write([]byte{'\n'})
 	}
-	if err := scanner.Err(); err != nil {
-		log.Printf("scanner.Scan() failed: %s\n", err)
+	<-shutdownDone
+}
+
+func openNsm() (nsm.NSM, error) {
+	switch *nsmMode {
+	case "nitro":
+		return nsm.OpenNitro()
+	case "simulator":
+		pcrs := map[uint16][]byte{}
+		if *simulatorPcr0 != "" {
+			pcr0, err := hex.DecodeString(*simulatorPcr0)
+			if err != nil {
+				return nil, fmt.Errorf("invalid simulator PCR0: %w", err)
+			}
+			pcrs[0] = pcr0
+		}
+		simulator, err := nsm.NewSimulator(pcrs)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("WARNING: using the NSM simulator, writing its root certificate to %s\n", *simulatorRootPath)
+		if err := os.WriteFile(*simulatorRootPath, simulator.RootPEM(), 0644); err != nil {
+			return nil, err
+		}
+		return simulator, nil
+	default:
+		return nil, fmt.Errorf("unknown NSM implementation: %s", *nsmMode)
 	}
 }
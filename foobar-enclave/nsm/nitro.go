@@ -0,0 +1,97 @@
+package nsm
+
+import (
+	"crypto/x509"
+	_ "embed"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	hfnsm "github.com/hf/nsm"
+	"github.com/hf/nsm/request"
+)
+
+// Nitro talks to the NSM device which is only available inside an enclave.
+// The session is safe for concurrent use.
+type Nitro struct {
+	sess *hfnsm.Session
+}
+
+// The AWS Nitro Enclaves root certificate, from
+// https://aws-nitro-enclaves.amazonaws.com/AWS_NitroEnclaves_Root-G1.zip
+// (SHA-256 fingerprint 641a0321a3e244efe456463195d606317ed7cdcc3c1756e09893f3c68f79bb5b).
+//
+//go:embed aws_nitro_root.pem
+var awsNitroRootPEM []byte
+
+var awsNitroRoot = mustParseCertificate(awsNitroRootPEM)
+
+func mustParseCertificate(pemBytes []byte) *x509.Certificate {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		panic("invalid PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		panic(err)
+	}
+	return cert
+}
+
+func OpenNitro() (*Nitro, error) {
+	sess, err := hfnsm.OpenDefaultSession()
+	if err != nil {
+		return nil, err
+	}
+	return &Nitro{sess: sess}, nil
+}
+
+func (n *Nitro) Close() error {
+	return n.sess.Close()
+}
+
+func (n *Nitro) DescribePCR(index uint16) ([]byte, error) {
+	res, err := n.sess.Send(&request.DescribePCR{Index: index})
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("request.DescribePCR error: %s", res.Error)
+	}
+	if res.DescribePCR == nil {
+		return nil, errors.New("NSM did not return a PCR")
+	}
+	return res.DescribePCR.Data, nil
+}
+
+func (n *Nitro) Attestation(req request.Attestation) ([]byte, error) {
+	res, err := n.sess.Send(&req)
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("request.Attestation error: %s", res.Error)
+	}
+	if res.Attestation == nil || res.Attestation.Document == nil {
+		return nil, errors.New("NSM did not return an attestation")
+	}
+	return res.Attestation.Document, nil
+}
+
+func (n *Nitro) Root() *x509.Certificate {
+	return awsNitroRoot
+}
+
+func (n *Nitro) GetRandom() ([]byte, error) {
+	res, err := n.sess.Send(&request.GetRandom{})
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("request.GetRandom error: %s", res.Error)
+	}
+	if res.GetRandom == nil {
+		return nil, errors.New("NSM did not return random bytes")
+	}
+	return res.GetRandom.Random, nil
+}
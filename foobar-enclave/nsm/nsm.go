@@ -0,0 +1,27 @@
+package nsm
+
+import (
+	"crypto/x509"
+
+	"github.com/hf/nsm/request"
+)
+
+// NSM is the subset of the Nitro Security Module API used by the handlers.
+// On real hardware it is backed by /dev/nsm (see Nitro). Everywhere else, e.g.
+// on a laptop or in tests, Simulator produces attestations signed by a locally
+// generated PKI.
+type NSM interface {
+	// DescribePCR returns the current value of a PCR.
+	DescribePCR(index uint16) ([]byte, error)
+
+	// Attestation returns a COSE_Sign1 attestation document, without the
+	// leading CBOR tag (i.e. in the same format /dev/nsm returns).
+	Attestation(req request.Attestation) ([]byte, error)
+
+	// GetRandom returns entropy from the NSM.
+	GetRandom() ([]byte, error)
+
+	// Root returns the certificate the NSM's attestations chain to, see
+	// Verify.
+	Root() *x509.Certificate
+}
@@ -0,0 +1,287 @@
+package nsm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hf/nsm/request"
+)
+
+// Number of PCRs reported in an attestation and the size of each PCR
+// (SHA-384).
+const (
+	simulatorPCRCount = 16
+	simulatorPCRSize  = 48
+)
+
+// Simulator mimics the NSM well enough for the instance-side verification
+// (AuthenticateDocument) and the fake KMS to accept its attestations, provided
+// they trust RootPEM() instead of the AWS Nitro root.
+//
+// The PKI mirrors what AWS does: a root, an intermediate and a leaf, all
+// ECDSA P-384. Attestations are COSE_Sign1 structures using ES384.
+//
+// Never use the simulator for anything real: the private keys live in regular
+// process memory.
+type Simulator struct {
+	mu   sync.Mutex
+	pcrs map[uint16][]byte
+
+	root         *x509.Certificate
+	intermediate *x509.Certificate
+	leaf         *x509.Certificate
+	leafKey      *ecdsa.PrivateKey
+}
+
+// NewSimulator creates a simulator with a freshly generated PKI. PCRs which
+// are not in pcrs are all zeros, like in a debug-mode enclave.
+func NewSimulator(pcrs map[uint16][]byte) (*Simulator, error) {
+	s := &Simulator{pcrs: map[uint16][]byte{}}
+	for i := uint16(0); i < simulatorPCRCount; i++ {
+		s.pcrs[i] = make([]byte, simulatorPCRSize)
+	}
+	for i, v := range pcrs {
+		if i >= simulatorPCRCount {
+			return nil, fmt.Errorf("invalid PCR index: %d", i)
+		}
+		if len(v) != simulatorPCRSize {
+			return nil, fmt.Errorf("invalid PCR%d length: %d", i, len(v))
+		}
+		s.pcrs[i] = append([]byte{}, v...)
+	}
+
+	now := time.Now()
+	rootKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	s.root, err = createCertificate(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "foobar-nsm-simulator-root"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(30 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	s.intermediate, err = createCertificate(&x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "foobar-nsm-simulator-intermediate"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, s.root, &intermediateKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s.leafKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	s.leaf, err = createCertificate(&x509.Certificate{
+		SerialNumber:          big.NewInt(3),
+		Subject:               pkix.Name{CommonName: "foobar-nsm-simulator-leaf"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}, s.intermediate, &s.leafKey.PublicKey, intermediateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func createCertificate(template, parent *x509.Certificate, pub *ecdsa.PublicKey, priv *ecdsa.PrivateKey) (*x509.Certificate, error) {
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, priv)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// Root returns the certificate which verifiers must trust instead of the AWS
+// Nitro root.
+func (s *Simulator) Root() *x509.Certificate {
+	return s.root
+}
+
+// RootPEM returns Root() in the same format as root.pem.
+func (s *Simulator) RootPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.root.Raw})
+}
+
+// SetPCR changes a PCR, e.g. to simulate a different enclave image.
+func (s *Simulator) SetPCR(index uint16, value []byte) error {
+	if index >= simulatorPCRCount {
+		return fmt.Errorf("invalid PCR index: %d", index)
+	}
+	if len(value) != simulatorPCRSize {
+		return fmt.Errorf("invalid PCR%d length: %d", index, len(value))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pcrs[index] = append([]byte{}, value...)
+	return nil
+}
+
+func (s *Simulator) DescribePCR(index uint16) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pcr, ok := s.pcrs[index]
+	if !ok {
+		return nil, fmt.Errorf("request.DescribePCR error: InvalidIndex")
+	}
+	return append([]byte{}, pcr...), nil
+}
+
+func (s *Simulator) GetRandom() ([]byte, error) {
+	r := make([]byte, 256)
+	if _, err := rand.Read(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// attestationDocument uses the same field names as the documents produced by
+// the real NSM.
+type attestationDocument struct {
+	ModuleId    string            `cbor:"module_id"`
+	Digest      string            `cbor:"digest"`
+	Timestamp   uint64            `cbor:"timestamp"`
+	PCRs        map[uint16][]byte `cbor:"pcrs"`
+	Certificate []byte            `cbor:"certificate"`
+	CABundle    [][]byte          `cbor:"cabundle"`
+	PublicKey   []byte            `cbor:"public_key"`
+	UserData    []byte            `cbor:"user_data"`
+	Nonce       []byte            `cbor:"nonce"`
+}
+
+type coseSign1 struct {
+	_           struct{} `cbor:",toarray"`
+	Protected   []byte
+	Unprotected map[int]interface{}
+	Payload     []byte
+	Signature   []byte
+}
+
+type coseSigStructure struct {
+	_           struct{} `cbor:",toarray"`
+	Context     string
+	Protected   []byte
+	ExternalAAD []byte
+	Payload     []byte
+}
+
+// Limits of the attestation request's fields.
+const (
+	maxUserDataSize  = 512
+	maxNonceSize     = 512
+	maxPublicKeySize = 1024
+)
+
+// COSE algorithm identifier for ECDSA w/ SHA-384 and the size of each half
+// of its signatures.
+const (
+	coseAlgorithmES384 = -35
+	es384ScalarSize    = 48
+)
+
+func (s *Simulator) Attestation(req request.Attestation) ([]byte, error) {
+	// The real NSM rejects larger fields.
+	if len(req.UserData) > maxUserDataSize || len(req.Nonce) > maxNonceSize || len(req.PublicKey) > maxPublicKeySize {
+		return nil, fmt.Errorf("request.Attestation error: InputTooLarge")
+	}
+
+	s.mu.Lock()
+	pcrs := map[uint16][]byte{}
+	for i, v := range s.pcrs {
+		pcrs[i] = v
+	}
+	s.mu.Unlock()
+
+	enc, err := cbor.CanonicalEncOptions().EncMode()
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := enc.Marshal(attestationDocument{
+		ModuleId:    "i-00000000000000000-enc0000000000000000",
+		Digest:      "SHA384",
+		Timestamp:   uint64(time.Now().UnixMilli()),
+		PCRs:        pcrs,
+		Certificate: s.leaf.Raw,
+		CABundle:    [][]byte{s.root.Raw, s.intermediate.Raw},
+		PublicKey:   nilIfEmpty(req.PublicKey),
+		UserData:    nilIfEmpty(req.UserData),
+		Nonce:       nilIfEmpty(req.Nonce),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	protected, err := enc.Marshal(map[int]int{1: coseAlgorithmES384})
+	if err != nil {
+		return nil, err
+	}
+
+	toBeSigned, err := enc.Marshal(coseSigStructure{
+		Context:     "Signature1",
+		Protected:   protected,
+		ExternalAAD: []byte{},
+		Payload:     payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// COSE uses the raw r||s encoding rather than ASN.1.
+	digest := sha512.Sum384(toBeSigned)
+	sigR, sigS, err := ecdsa.Sign(rand.Reader, s.leafKey, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 2*es384ScalarSize)
+	sigR.FillBytes(signature[:es384ScalarSize])
+	sigS.FillBytes(signature[es384ScalarSize:])
+
+	return enc.Marshal(coseSign1{
+		Protected:   protected,
+		Unprotected: map[int]interface{}{},
+		Payload:     payload,
+		Signature:   signature,
+	})
+}
+
+// The NSM encodes missing optional fields as null.
+func nilIfEmpty(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,220 @@
+package nsm
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hf/nsm/request"
+)
+
+// verify checks a simulator attestation the way verifiers of real ones do:
+// the leaf certificate must chain to root through the CA bundle, and have
+// signed the COSE_Sign1 structure with ES384.
+func verify(t *testing.T, attestation []byte, root *x509.Certificate) (*attestationDocument, error) {
+	t.Helper()
+	var msg coseSign1
+	if err := cbor.Unmarshal(attestation, &msg); err != nil {
+		t.Fatalf("invalid COSE_Sign1: %s", err)
+	}
+	var protected map[int]int
+	if err := cbor.Unmarshal(msg.Protected, &protected); err != nil || protected[1] != coseAlgorithmES384 {
+		t.Fatalf("got protected header %v, %v, want ES384", protected, err)
+	}
+	var doc attestationDocument
+	if err := cbor.Unmarshal(msg.Payload, &doc); err != nil {
+		t.Fatalf("invalid attestation document: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(doc.Certificate)
+	if err != nil {
+		t.Fatalf("invalid certificate: %s", err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range doc.CABundle {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("invalid CA bundle: %s", err)
+		}
+		intermediates.AddCert(cert)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	if _, err := leaf.Verify(x509.VerifyOptions{Intermediates: intermediates, Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		return nil, err
+	}
+
+	toBeSigned, err := cbor.Marshal(coseSigStructure{Context: "Signature1", Protected: msg.Protected, ExternalAAD: []byte{}, Payload: msg.Payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha512.Sum384(toBeSigned)
+	if len(msg.Signature) != 2*es384ScalarSize {
+		t.Fatalf("got a %d byte signature", len(msg.Signature))
+	}
+	r := new(big.Int).SetBytes(msg.Signature[:es384ScalarSize])
+	s := new(big.Int).SetBytes(msg.Signature[es384ScalarSize:])
+	if !ecdsa.Verify(leaf.PublicKey.(*ecdsa.PublicKey), digest[:], r, s) {
+		return nil, errInvalidSignature
+	}
+	return &doc, nil
+}
+
+var errInvalidSignature = errors.New("invalid signature")
+
+func newSimulator(t *testing.T, pcrs map[uint16][]byte) *Simulator {
+	t.Helper()
+	s, err := NewSimulator(pcrs)
+	if err != nil {
+		t.Fatalf("NewSimulator failed: %s", err)
+	}
+	return s
+}
+
+func TestSimulatorAttestation(t *testing.T) {
+	pcr0 := bytes.Repeat([]byte{0xaa}, simulatorPCRSize)
+	s := newSimulator(t, map[uint16][]byte{0: pcr0})
+	attestation, err := s.Attestation(request.Attestation{
+		UserData:  []byte("user data"),
+		Nonce:     []byte("nonce"),
+		PublicKey: []byte("public key"),
+	})
+	if err != nil {
+		t.Fatalf("Attestation failed: %s", err)
+	}
+	doc, err := verify(t, attestation, s.Root())
+	if err != nil {
+		t.Fatalf("verify failed: %s", err)
+	}
+	if string(doc.UserData) != "user data" || string(doc.Nonce) != "nonce" || string(doc.PublicKey) != "public key" {
+		t.Errorf("got user data %q, nonce %q and public key %q", doc.UserData, doc.Nonce, doc.PublicKey)
+	}
+	if doc.Digest != "SHA384" || len(doc.PCRs) != simulatorPCRCount {
+		t.Errorf("got digest %s and %d PCRs", doc.Digest, len(doc.PCRs))
+	}
+	if !bytes.Equal(doc.PCRs[0], pcr0) || !bytes.Equal(doc.PCRs[1], make([]byte, simulatorPCRSize)) {
+		t.Errorf("got PCR0 %02x and PCR1 %02x", doc.PCRs[0], doc.PCRs[1])
+	}
+
+	// Empty fields are encoded as null, like the NSM does.
+	attestation, err = s.Attestation(request.Attestation{})
+	if err != nil {
+		t.Fatalf("Attestation failed: %s", err)
+	}
+	if doc, err = verify(t, attestation, s.Root()); err != nil || doc.UserData != nil || doc.Nonce != nil || doc.PublicKey != nil {
+		t.Errorf("got %+v, %v, want no user data, nonce or public key", doc, err)
+	}
+}
+
+// The PKI mirrors AWS's: a root, an intermediate and a leaf. Another
+// simulator's root doesn't verify the attestations, and neither does a
+// tampered payload.
+func TestSimulatorCertificateChain(t *testing.T) {
+	s := newSimulator(t, nil)
+	attestation, err := s.Attestation(request.Attestation{UserData: []byte("user data")})
+	if err != nil {
+		t.Fatalf("Attestation failed: %s", err)
+	}
+	var msg coseSign1
+	if err := cbor.Unmarshal(attestation, &msg); err != nil {
+		t.Fatal(err)
+	}
+	var doc attestationDocument
+	if err := cbor.Unmarshal(msg.Payload, &doc); err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(doc.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.CABundle) != 2 || !bytes.Equal(doc.CABundle[0], s.Root().Raw) {
+		t.Fatalf("got a CA bundle of %d certificates, want the root and the intermediate", len(doc.CABundle))
+	}
+	intermediate, err := x509.ParseCertificate(doc.CABundle[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.CheckSignatureFrom(intermediate); err != nil {
+		t.Errorf("leaf not signed by the intermediate: %s", err)
+	}
+	if err := intermediate.CheckSignatureFrom(s.Root()); err != nil {
+		t.Errorf("intermediate not signed by the root: %s", err)
+	}
+	if !s.Root().IsCA || !intermediate.IsCA || leaf.IsCA {
+		t.Errorf("got IsCA %t, %t, %t for the root, the intermediate and the leaf", s.Root().IsCA, intermediate.IsCA, leaf.IsCA)
+	}
+
+	block, _ := pem.Decode(s.RootPEM())
+	if block == nil || block.Type != "CERTIFICATE" || !bytes.Equal(block.Bytes, s.Root().Raw) {
+		t.Errorf("RootPEM doesn't hold the root")
+	}
+
+	if _, err := verify(t, attestation, newSimulator(t, nil).Root()); err == nil {
+		t.Errorf("verified with another simulator's root")
+	}
+
+	msg.Payload = bytes.Replace(msg.Payload, []byte("user data"), []byte("user date"), 1)
+	tampered, err := cbor.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verify(t, tampered, s.Root()); err != errInvalidSignature {
+		t.Errorf("got %v for a tampered payload, want %v", err, errInvalidSignature)
+	}
+}
+
+func TestSimulatorPCRs(t *testing.T) {
+	s := newSimulator(t, nil)
+	pcr0 := bytes.Repeat([]byte{0xbb}, simulatorPCRSize)
+	if err := s.SetPCR(0, pcr0); err != nil {
+		t.Fatalf("SetPCR failed: %s", err)
+	}
+	if got, err := s.DescribePCR(0); err != nil || !bytes.Equal(got, pcr0) {
+		t.Errorf("got %02x, %v, want %02x", got, err, pcr0)
+	}
+
+	tests := []struct {
+		name  string
+		index uint16
+		value []byte
+	}{
+		{"index", simulatorPCRCount, pcr0},
+		{"length", 0, pcr0[1:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.SetPCR(tt.index, tt.value); err == nil {
+				t.Errorf("SetPCR succeeded")
+			}
+			if _, err := NewSimulator(map[uint16][]byte{tt.index: tt.value}); err == nil {
+				t.Errorf("NewSimulator succeeded")
+			}
+		})
+	}
+	if _, err := s.DescribePCR(simulatorPCRCount); err == nil {
+		t.Errorf("DescribePCR succeeded for an invalid index")
+	}
+}
+
+// The simulator rejects the fields the NSM rejects.
+func TestSimulatorInputTooLarge(t *testing.T) {
+	s := newSimulator(t, nil)
+	for name, req := range map[string]request.Attestation{
+		"user data":  {UserData: make([]byte, maxUserDataSize+1)},
+		"nonce":      {Nonce: make([]byte, maxNonceSize+1)},
+		"public key": {PublicKey: make([]byte, maxPublicKeySize+1)},
+	} {
+		if _, err := s.Attestation(req); err == nil {
+			t.Errorf("%s: Attestation succeeded", name)
+		}
+	}
+	if _, err := s.Attestation(request.Attestation{UserData: make([]byte, maxUserDataSize)}); err != nil {
+		t.Errorf("Attestation failed at the user data limit: %s", err)
+	}
+}
@@ -0,0 +1,103 @@
+package nsm
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Document is the part of a verified attestation document the handlers use.
+type Document struct {
+	Timestamp time.Time
+	PCRs      map[uint16][]byte
+	PublicKey []byte
+	UserData  []byte
+	Nonce     []byte
+}
+
+// coseSign1Tag is the optional CBOR tag of COSE_Sign1 structures. The NSM
+// omits it, other tools add it.
+const coseSign1Tag = 0xd2
+
+// Verify checks that attestation is a COSE_Sign1 attestation document signed
+// by a certificate which chains to root, e.g. the Root() of the NSM the
+// enclave runs on, and returns its contents. The chain is checked at the time
+// of the attestation: the NSM's certificates only live for a few hours.
+func Verify(attestation []byte, root *x509.Certificate) (*Document, error) {
+	attestation = bytes.TrimPrefix(attestation, []byte{coseSign1Tag})
+	var msg coseSign1
+	if err := cbor.Unmarshal(attestation, &msg); err != nil {
+		return nil, fmt.Errorf("invalid COSE_Sign1: %w", err)
+	}
+	var protected map[int]int
+	if err := cbor.Unmarshal(msg.Protected, &protected); err != nil {
+		return nil, fmt.Errorf("invalid protected header: %w", err)
+	}
+	if protected[1] != coseAlgorithmES384 {
+		return nil, fmt.Errorf("unsupported algorithm: %d", protected[1])
+	}
+	var doc attestationDocument
+	if err := cbor.Unmarshal(msg.Payload, &doc); err != nil {
+		return nil, fmt.Errorf("invalid attestation document: %w", err)
+	}
+	timestamp := time.UnixMilli(int64(doc.Timestamp))
+
+	leaf, err := x509.ParseCertificate(doc.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range doc.CABundle {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		intermediates.AddCert(cert)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Intermediates: intermediates,
+		Roots:         roots,
+		CurrentTime:   timestamp,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok || len(msg.Signature) != 2*es384ScalarSize {
+		return nil, errors.New("not an ES384 signature")
+	}
+	toBeSigned, err := cbor.Marshal(coseSigStructure{
+		Context:     "Signature1",
+		Protected:   msg.Protected,
+		ExternalAAD: []byte{},
+		Payload:     msg.Payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+	digest := sha512.Sum384(toBeSigned)
+	sigR := new(big.Int).SetBytes(msg.Signature[:es384ScalarSize])
+	sigS := new(big.Int).SetBytes(msg.Signature[es384ScalarSize:])
+	if !ecdsa.Verify(publicKey, digest[:], sigR, sigS) {
+		return nil, errors.New("invalid signature")
+	}
+
+	return &Document{
+		Timestamp: timestamp,
+		PCRs:      doc.PCRs,
+		PublicKey: doc.PublicKey,
+		UserData:  doc.UserData,
+		Nonce:     doc.Nonce,
+	}, nil
+}
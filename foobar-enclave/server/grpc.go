@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/foobarpb"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// grpcService implements the gRPC version of the API. Requests go through the
+// same router, and therefore the same middleware, as the JSON protocol.
+type grpcService struct {
+	foobarpb.UnimplementedFoobarServer
+	s *Server
+}
+
+func (g grpcService) Hello(ctx context.Context, req *foobarpb.HelloRequest) (*foobarpb.HelloResponse, error) {
+	res, err := g.serve(ctx, req, messages.FoobarRequest{Hello: &messages.HelloRequest{ProtocolVersion: int(req.GetProtocolVersion())}})
+	if err != nil {
+		return nil, err
+	}
+	return &foobarpb.HelloResponse{
+		ProtocolVersion: int64(res.Hello.ProtocolVersion),
+		BuildVersion:    res.Hello.BuildVersion,
+		Operations:      res.Hello.Operations,
+	}, nil
+}
+
+func (g grpcService) CreateKey(ctx context.Context, req *foobarpb.CreateKeyRequest) (*foobarpb.CreateKeyResponse, error) {
+	res, err := g.serve(ctx, req, messages.FoobarRequest{CreateKey: &messages.CreateKeyRequest{
+		Region:     req.GetRegion(),
+		AccountId:  req.GetAccountId(),
+		AwsIamRole: req.GetAwsIamRole(),
+		Credentials: messages.Credentials{
+			AccessKeyId:     req.GetCredentials().GetAccessKeyId(),
+			SecretAccessKey: req.GetCredentials().GetSecretAccessKey(),
+			Token:           req.GetCredentials().GetToken(),
+		},
+		AttestationNonce: req.GetAttestationNonce(),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return &foobarpb.CreateKeyResponse{Attestation: res.CreateKey.Attestation}, nil
+}
+
+func (g grpcService) GetAttestation(ctx context.Context, req *foobarpb.GetAttestationRequest) (*foobarpb.GetAttestationResponse, error) {
+	res, err := g.serve(ctx, req, messages.FoobarRequest{GetAttestation: &messages.GetAttestationRequest{
+		OpenSession:      req.GetOpenSession(),
+		SessionId:        req.GetSessionId(),
+		AttestationNonce: req.GetAttestationNonce(),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return &foobarpb.GetAttestationResponse{
+		Attestation: res.GetAttestation.Attestation,
+		SessionId:   res.GetAttestation.SessionId,
+	}, nil
+}
+
+func (g grpcService) Decrypt(ctx context.Context, req *foobarpb.DecryptRequest) (*foobarpb.DecryptResponse, error) {
+	res, err := g.serve(ctx, req, messages.FoobarRequest{Decrypt: &messages.DecryptRequest{
+		KeyId:                 req.GetKeyId(),
+		SessionId:             req.GetSessionId(),
+		EncryptedSharedSecret: req.GetSharedSecret(),
+		Nonce:                 req.GetNonce(),
+		Ciphertext:            req.GetCiphertext(),
+		AttestationNonce:      req.GetAttestationNonce(),
+		OneShotUntil:          req.GetOneShotUntil(),
+		Computation:           req.GetComputation(),
+		Parameters:            req.GetParameters(),
+		WasmModule:            req.GetWasmModule(),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return &foobarpb.DecryptResponse{Attestation: res.Decrypt.Attestation, SignedResult: res.Decrypt.SignedResult}, nil
+}
+
+func (g grpcService) Status(ctx context.Context, req *foobarpb.StatusRequest) (*foobarpb.StatusResponse, error) {
+	res, err := g.serve(ctx, req, messages.FoobarRequest{Status: &messages.StatusRequest{}})
+	if err != nil {
+		return nil, err
+	}
+	return &foobarpb.StatusResponse{Attestation: res.Status.Attestation, Status: foobarpb.StatusFromMessage(res.Status.Status)}, nil
+}
+
+func (g grpcService) ListKeys(ctx context.Context, req *foobarpb.ListKeysRequest) (*foobarpb.ListKeysResponse, error) {
+	res, err := g.serve(ctx, req, messages.FoobarRequest{ListKeys: &messages.ListKeysRequest{}})
+	if err != nil {
+		return nil, err
+	}
+	return &foobarpb.ListKeysResponse{Attestation: res.ListKeys.Attestation, Keys: foobarpb.KeysFromMessages(res.ListKeys.Keys)}, nil
+}
+
+func (g grpcService) BatchDecrypt(ctx context.Context, req *foobarpb.BatchDecryptRequest) (*foobarpb.BatchDecryptResponse, error) {
+	res, err := g.serve(ctx, req, messages.FoobarRequest{BatchDecrypt: &messages.BatchDecryptRequest{
+		SessionId:        req.GetSessionId(),
+		AttestationNonce: req.GetAttestationNonce(),
+		Computation:      req.GetComputation(),
+		Parameters:       req.GetParameters(),
+		WasmModule:       req.GetWasmModule(),
+		Items:            foobarpb.ItemsToMessages(req.GetItems()),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*foobarpb.BatchDecryptResult, len(res.BatchDecrypt.Results))
+	for i, result := range res.BatchDecrypt.Results {
+		results[i] = foobarpb.ResultFromMessage(result)
+	}
+	return &foobarpb.BatchDecryptResponse{Attestation: res.BatchDecrypt.Attestation, Results: results}, nil
+}
+
+func (g grpcService) Aggregate(ctx context.Context, req *foobarpb.AggregateRequest) (*foobarpb.AggregateResponse, error) {
+	res, err := g.serve(ctx, req, messages.FoobarRequest{Aggregate: &messages.AggregateRequest{
+		SessionId:        req.GetSessionId(),
+		AttestationNonce: req.GetAttestationNonce(),
+		Parameters:       foobarpb.AggregateParametersToMessage(req.GetParameters()),
+		Items:            foobarpb.ItemsToMessages(req.GetItems()),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return &foobarpb.AggregateResponse{
+		Attestation:  res.Aggregate.Attestation,
+		Result:       foobarpb.AggregateResultFromMessage(res.Aggregate.Result),
+		SignedResult: res.Aggregate.SignedResult,
+	}, nil
+}
+
+func (g grpcService) Intersect(ctx context.Context, req *foobarpb.IntersectRequest) (*foobarpb.IntersectResponse, error) {
+	res, err := g.serve(ctx, req, messages.FoobarRequest{Intersect: &messages.IntersectRequest{
+		SessionId:        req.GetSessionId(),
+		AttestationNonce: req.GetAttestationNonce(),
+		Left:             foobarpb.ItemsToMessages(req.GetLeft()),
+		Right:            foobarpb.ItemsToMessages(req.GetRight()),
+		LeftParty:        req.GetLeftParty(),
+		RightParty:       req.GetRightParty(),
+		Recipient:        req.GetRecipient(),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return &foobarpb.IntersectResponse{
+		Attestation:  res.Intersect.Attestation,
+		Elements:     foobarpb.SealedFromMessages(res.Intersect.Elements),
+		SignedResult: res.Intersect.SignedResult,
+	}, nil
+}
+
+func (g grpcService) ReEncrypt(ctx context.Context, req *foobarpb.ReEncryptRequest) (*foobarpb.ReEncryptResponse, error) {
+	res, err := g.serve(ctx, req, messages.FoobarRequest{ReEncrypt: &messages.ReEncryptRequest{
+		KeyId:                 req.GetKeyId(),
+		SessionId:             req.GetSessionId(),
+		EncryptedSharedSecret: req.GetSharedSecret(),
+		Nonce:                 req.GetNonce(),
+		Ciphertext:            req.GetCiphertext(),
+		AttestationNonce:      req.GetAttestationNonce(),
+		OneShotUntil:          req.GetOneShotUntil(),
+		Recipient:             req.GetRecipient(),
+		RecipientAttestation:  req.GetRecipientAttestation(),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return &foobarpb.ReEncryptResponse{
+		Attestation:  res.ReEncrypt.Attestation,
+		Ciphertext:   foobarpb.SealedFromMessage(res.ReEncrypt.Ciphertext),
+		SignedResult: res.ReEncrypt.SignedResult,
+	}, nil
+}
+
+func (g grpcService) GetSigningKey(ctx context.Context, req *foobarpb.GetSigningKeyRequest) (*foobarpb.GetSigningKeyResponse, error) {
+	res, err := g.serve(ctx, req, messages.FoobarRequest{GetSigningKey: &messages.GetSigningKeyRequest{
+		AttestationNonce: req.GetAttestationNonce(),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return &foobarpb.GetSigningKeyResponse{Attestation: res.GetSigningKey.Attestation}, nil
+}
+
+func (g grpcService) RegisterKey(ctx context.Context, req *foobarpb.RegisterKeyRequest) (*foobarpb.RegisterKeyResponse, error) {
+	res, err := g.serve(ctx, req, messages.FoobarRequest{RegisterKey: &messages.RegisterKeyRequest{
+		Attestation: req.GetAttestation(),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return &foobarpb.RegisterKeyResponse{KeyId: res.RegisterKey.KeyId, Registered: res.RegisterKey.Registered}, nil
+}
+
+// serve runs the JSON equivalent of a gRPC request through the router. The
+// request bytes are the deterministic encoding of the gRPC request.
+func (g grpcService) serve(ctx context.Context, msg proto.Message, req messages.FoobarRequest) (res messages.FoobarResponse, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			g.s.recovered("gRPC request", r)
+			err = grpcError(&messages.Error{Code: messages.ErrorCodeInternal, Message: fmt.Sprintf("panic: %v", r)})
+		}
+	}()
+
+	reqBytes, err := foobarpb.MarshalDeterministic(msg)
+	if err != nil {
+		return messages.FoobarResponse{}, grpcError(err)
+	}
+	// gRPC deadlines are already part of ctx.
+	if err := g.s.acquire(ctx); err != nil {
+		return messages.FoobarResponse{}, grpcError(err)
+	}
+	defer g.s.release()
+	// gRPC has already read the message, it counts towards the budget while
+	// it is handled.
+	if err := g.s.reserve(ctx, len(reqBytes)); err != nil {
+		return messages.FoobarResponse{}, grpcError(err)
+	}
+	defer g.s.unreserve(len(reqBytes))
+
+	r := &Request{FoobarRequest: req, Bytes: reqBytes}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.Peer = p.Addr
+	}
+	res = g.s.router.Serve(ctx, r)
+	if res.Error != nil {
+		return res, foobarpb.StatusFromError(res.Error).Err()
+	}
+	return res, nil
+}
+
+func grpcError(err error) error {
+	return foobarpb.StatusFromError(toResponseError(err)).Err()
+}
+
+// Every HTTP/2 connection, and therefore every gRPC connection, starts with
+// this preface. Read as a JSON frame length, its first 4 bytes exceed
+// wire.MaxFrameSize, so the two protocols can't be confused.
+const http2Preface = "PRI "
+
+// sniffedConn replays the bytes read while detecting the protocol.
+type sniffedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// limitedConn gives back its MaxConnections slot once closed.
+type limitedConn struct {
+	net.Conn
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(c.release)
+	return err
+}
+
+// connListener is a net.Listener for the gRPC server, fed with the
+// connections Serve identified as gRPC.
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// push hands conn to the gRPC server, or closes it if the listener is closed.
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
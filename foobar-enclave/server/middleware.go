@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdlayher/vsock"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// Logging logs requests and responses.
+func Logging(next Handler) Handler {
+	return func(ctx context.Context, req *Request, res *messages.FoobarResponse) error {
+		log.Printf("recv: %s", req.Bytes)
+		err := next(ctx, req, res)
+		if err != nil {
+			log.Printf("%s (id %d) failed: %s\n", req.Operation(), req.Id, err)
+		}
+		return err
+	}
+}
+
+// Timing logs how long each operation takes.
+func Timing(next Handler) Handler {
+	return func(ctx context.Context, req *Request, res *messages.FoobarResponse) error {
+		start := time.Now()
+		defer func() {
+			log.Printf("%s (id %d) took %s\n", req.Operation(), req.Id, time.Since(start))
+		}()
+		return next(ctx, req, res)
+	}
+}
+
+// Recovery turns panics in handlers into internal errors, instead of crashing
+// the enclave. panics counts them.
+func Recovery(panics *atomic.Uint64) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req *Request, res *messages.FoobarResponse) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					panics.Add(1)
+					log.Printf("panic in %s (id %d): %v\n%s", req.Operation(), req.Id, r, debug.Stack())
+					err = &messages.Error{Code: messages.ErrorCodeInternal, Message: fmt.Sprintf("panic: %v", r)}
+				}
+			}()
+			return next(ctx, req, res)
+		}
+	}
+}
+
+// Validation rejects malformed requests before they reach the handlers.
+func Validation(next Handler) Handler {
+	return func(ctx context.Context, req *Request, res *messages.FoobarResponse) error {
+		if err := req.Validate(); err != nil {
+			return err
+		}
+		return next(ctx, req, res)
+	}
+}
+
+// Authorization only lets the given vsock CIDs through. The attestations are
+// what clients rely on, this merely limits who can use the enclave. Peers
+// connected over other transports are rejected.
+func Authorization(cids []uint32) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req *Request, res *messages.FoobarResponse) error {
+			addr, ok := req.Peer.(*vsock.Addr)
+			if !ok || !slices.Contains(cids, addr.ContextID) {
+				return &messages.Error{Code: messages.ErrorCodeUnauthorized, Message: fmt.Sprintf("peer %s is not allowed", req.Peer)}
+			}
+			return next(ctx, req, res)
+		}
+	}
+}
+
+// Timeout bounds each request by its operation's timeout, and by the client's
+// timeout if it is shorter.
+func Timeout(timeouts map[string]time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req *Request, res *messages.FoobarResponse) error {
+			timeout := timeouts[req.Operation()]
+			if client := time.Duration(req.TimeoutMs) * time.Millisecond; client > 0 && (timeout == 0 || client < timeout) {
+				timeout = client
+			}
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			return next(ctx, req, res)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// Request is what handlers and middleware get to see of a request, regardless
+// of the protocol it arrived with.
+type Request struct {
+	messages.FoobarRequest
+
+	// Bytes is the request as received. Attestations may commit to it.
+	Bytes []byte
+
+	// Peer is the address of the client.
+	Peer net.Addr
+}
+
+// Handler handles a single operation. It sets the matching field of res.
+type Handler func(ctx context.Context, req *Request, res *messages.FoobarResponse) error
+
+// Middleware wraps a handler, e.g. to log or reject requests.
+type Middleware func(next Handler) Handler
+
+// Router dispatches requests to the handler registered for their operation,
+// through the middleware chain.
+type Router struct {
+	handlers   map[string]Handler
+	operations []string
+	middleware []Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{handlers: map[string]Handler{}}
+}
+
+// Handle registers the handler of an operation. Operations are reported in
+// the order they were registered.
+func (r *Router) Handle(operation string, h Handler) {
+	if _, ok := r.handlers[operation]; ok {
+		panic(fmt.Sprintf("operation %q registered twice", operation))
+	}
+	r.handlers[operation] = h
+	r.operations = append(r.operations, operation)
+}
+
+// Use appends middleware to the chain. The first middleware is the outermost
+// one.
+func (r *Router) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Operations returns the registered operations.
+func (r *Router) Operations() []string {
+	return append([]string{}, r.operations...)
+}
+
+// Serve runs req through the middleware chain and its handler. Errors are
+// returned in the response.
+func (r *Router) Serve(ctx context.Context, req *Request) messages.FoobarResponse {
+	h := r.dispatch
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		h = r.middleware[i](h)
+	}
+
+	res := messages.FoobarResponse{Id: req.Id}
+	if err := h(ctx, req, &res); err != nil {
+		res = messages.FoobarResponse{Id: req.Id, Error: toResponseError(err)}
+	}
+	return res
+}
+
+func (r *Router) dispatch(ctx context.Context, req *Request, res *messages.FoobarResponse) error {
+	h, ok := r.handlers[req.Operation()]
+	if !ok {
+		return &messages.Error{Code: messages.ErrorCodeInvalidRequest, Message: "unexpected command"}
+	}
+	return h(ctx, req, res)
+}
@@ -0,0 +1,650 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/grpc"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/computations"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/handlers"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/nsm"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/foobarpb"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/wire"
+)
+
+// BuildVersion is reported to clients during the handshake. It is set at build
+// time, e.g. go build -ldflags "-X .../server.BuildVersion=v1.2.3".
+var BuildVersion = "dev"
+
+// Server is the enclave's request loop. It is kept separate from main so that
+// tests can run the enclave in-process, with a simulated NSM and a fake KMS.
+type Server struct {
+	nsmSession    nsm.NSM
+	kmsConnection handlers.KmsConnection
+	router        *Router
+	keys          *handlers.KeyRegistry
+	stats         *stats
+
+	// Signs computation results. Generated by New, it lives as long as the
+	// enclave.
+	signingKey *handlers.SigningKey
+
+	// Panics recovered from, reported in attestations. A panic must never take
+	// the enclave down: the ephemeral RSA key would be lost with it.
+	panics atomic.Uint64
+
+	// MaxConcurrentRequests bounds the number of requests handled at the same
+	// time, across all connections. Connections stop being read from while the
+	// limit is reached. Set it before calling Serve.
+	MaxConcurrentRequests int
+	requests              chan struct{}
+
+	// MaxConnections bounds the number of open connections, JSON and gRPC.
+	// Serve stops accepting connections while the limit is reached. Set it
+	// before calling Serve.
+	MaxConnections int
+	connections    chan struct{}
+
+	// MaxBufferedBytes bounds the size of the requests held in memory, across
+	// all slots: a frame's payload is only read once its size fits. It must be
+	// at least wire.MaxFrameSize. Set it before calling Serve.
+	MaxBufferedBytes int64
+	buffered         *semaphore.Weighted
+
+	// The ephemeral RSA keys are generated by Serve, with RsaKeySize bits
+	// (2048, 3072 or 4096). Every RsaKeyRotation, if set, a new key replaces
+	// the current one. The previous key keeps decrypting for RsaKeyOverlap,
+	// KMS may have encrypted a shared secret to it right before the rotation.
+	// Set them before calling Serve.
+	RsaKeySize     int
+	RsaKeyRotation time.Duration
+	RsaKeyOverlap  time.Duration
+	rsaKeys        *handlers.RsaKeys
+
+	// DecryptSessionTTL is how long the single-use RSA key of a decrypt session
+	// lives if it isn't used. At most MaxDecryptSessions are open at a time,
+	// opening more fails with a retryable UNAVAILABLE error. Set them before
+	// calling Serve.
+	DecryptSessionTTL  time.Duration
+	MaxDecryptSessions int
+	sessions           *handlers.Sessions
+
+	// One-shot ciphertexts may not expire more than ReplayWindow in the
+	// future. Until they do, the enclave remembers up to ReplayCacheSize of
+	// them. Set them before calling Serve.
+	ReplayWindow    time.Duration
+	ReplayCacheSize int
+	replayCache     *handlers.ReplayCache
+
+	// MinIntersectSetSize is the minimum number of distinct values each set of
+	// an intersection must hold, see handlers.IntersectHandler. Set it before
+	// calling Serve.
+	MinIntersectSetSize int
+
+	// Computations decrypt requests can name. It starts with the built-in
+	// ones, more can be registered, e.g. WebAssembly modules. Its WebAssembly
+	// limits also apply to the modules sent with requests.
+	Computations *computations.Registry
+
+	mu         sync.Mutex
+	listener   net.Listener
+	grpcServer *grpc.Server
+	conns      map[net.Conn]struct{}
+	connsWg    sync.WaitGroup
+	closing    chan struct{}
+}
+
+// How long a client has to send a frame's payload once its header was read.
+const payloadTimeout = 30 * time.Second
+
+// ErrServerClosed is returned by Serve after Shutdown.
+var ErrServerClosed = errors.New("server closed")
+
+// Default timeout of each operation. Clients can ask for shorter ones.
+var operationTimeouts = map[string]time.Duration{
+	messages.OperationHello:          5 * time.Second,
+	messages.OperationCreateKey:      time.Minute,
+	messages.OperationGetAttestation: 10 * time.Second,
+	messages.OperationDecrypt:        30 * time.Second,
+	messages.OperationStatus:         10 * time.Second,
+	messages.OperationListKeys:       10 * time.Second,
+	messages.OperationBatchDecrypt:   2 * time.Minute,
+	messages.OperationAggregate:      2 * time.Minute,
+	messages.OperationIntersect:      2 * time.Minute,
+	messages.OperationReEncrypt:      30 * time.Second,
+	messages.OperationGetSigningKey:  10 * time.Second,
+	messages.OperationRegisterKey:    10 * time.Second,
+}
+
+func New(nsmSession nsm.NSM, kmsConnection handlers.KmsConnection) (*Server, error) {
+	signingKey, err := handlers.NewSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		nsmSession:    nsmSession,
+		kmsConnection: kmsConnection,
+		router:        NewRouter(),
+		keys:          handlers.NewKeyRegistry(),
+		stats:         newStats(),
+		signingKey:    signingKey,
+
+		MaxConcurrentRequests: 64,
+		MaxConnections:        256,
+		MaxBufferedBytes:      256 << 20,
+		RsaKeySize:            2048,
+		RsaKeyOverlap:         10 * time.Minute,
+		DecryptSessionTTL:     5 * time.Minute,
+		MaxDecryptSessions:    256,
+		ReplayWindow:          24 * time.Hour,
+		ReplayCacheSize:       100000,
+		MinIntersectSetSize:   10,
+		Computations:          computations.NewRegistry(),
+		conns:                 map[net.Conn]struct{}{},
+		closing:               make(chan struct{}),
+	}
+	s.router.Use(Logging, s.counting, Timing, Recovery(&s.panics), Validation, Timeout(operationTimeouts))
+	s.registerHandlers()
+	return s, nil
+}
+
+// Use appends middleware to the chain, after the default logging, counting,
+// timing, recovery, validation and timeout middleware.
+func (s *Server) Use(middleware ...Middleware) {
+	s.router.Use(middleware...)
+}
+
+func (s *Server) health() messages.Health {
+	return messages.Health{Panics: s.panics.Load()}
+}
+
+// recovered records a panic which was recovered from.
+func (s *Server) recovered(where string, r interface{}) {
+	s.panics.Add(1)
+	log.Printf("panic in %s: %v\n%s", where, r, debug.Stack())
+}
+
+func (s *Server) registerHandlers() {
+	s.router.Handle(messages.OperationHello, func(ctx context.Context, req *Request, res *messages.FoobarResponse) (err error) {
+		res.Hello, err = handlers.HelloHandler(ctx, BuildVersion, s.router.Operations(), *req.Hello)
+		return err
+	})
+	s.router.Handle(messages.OperationCreateKey, func(ctx context.Context, req *Request, res *messages.FoobarResponse) (err error) {
+		res.CreateKey, err = handlers.CreateKeyHandler(ctx, s.nsmSession, s.kmsConnection, s.keys, *req.CreateKey)
+		return err
+	})
+	s.router.Handle(messages.OperationGetAttestation, func(ctx context.Context, req *Request, res *messages.FoobarResponse) (err error) {
+		res.GetAttestation, err = handlers.GetAttestationHandler(ctx, s.nsmSession, s.rsaKeys, s.sessions, s.health(), *req.GetAttestation)
+		return err
+	})
+	s.router.Handle(messages.OperationDecrypt, func(ctx context.Context, req *Request, res *messages.FoobarResponse) (err error) {
+		res.Decrypt, err = handlers.DecryptHandler(ctx, s.nsmSession, s.rsaKeys, s.sessions, s.keys, s.replayCache, s.Computations, s.signingKey, *req.Decrypt, req.Bytes)
+		return err
+	})
+	s.router.Handle(messages.OperationStatus, func(ctx context.Context, req *Request, res *messages.FoobarResponse) (err error) {
+		res.Status, err = handlers.StatusHandler(ctx, s.nsmSession, s.status(), *req.Status)
+		return err
+	})
+	s.router.Handle(messages.OperationListKeys, func(ctx context.Context, req *Request, res *messages.FoobarResponse) (err error) {
+		res.ListKeys, err = handlers.ListKeysHandler(ctx, s.nsmSession, s.keys, *req.ListKeys)
+		return err
+	})
+	s.router.Handle(messages.OperationBatchDecrypt, func(ctx context.Context, req *Request, res *messages.FoobarResponse) (err error) {
+		res.BatchDecrypt, err = handlers.BatchDecryptHandler(ctx, s.nsmSession, s.rsaKeys, s.sessions, s.keys, s.replayCache, s.Computations, s.signingKey, *req.BatchDecrypt, req.Bytes)
+		return err
+	})
+	s.router.Handle(messages.OperationAggregate, func(ctx context.Context, req *Request, res *messages.FoobarResponse) (err error) {
+		res.Aggregate, err = handlers.AggregateHandler(ctx, s.nsmSession, s.rsaKeys, s.sessions, s.keys, s.replayCache, s.signingKey, *req.Aggregate, req.Bytes)
+		return err
+	})
+	s.router.Handle(messages.OperationIntersect, func(ctx context.Context, req *Request, res *messages.FoobarResponse) (err error) {
+		res.Intersect, err = handlers.IntersectHandler(ctx, s.nsmSession, s.rsaKeys, s.sessions, s.keys, s.replayCache, s.signingKey, s.MinIntersectSetSize, *req.Intersect, req.Bytes)
+		return err
+	})
+	s.router.Handle(messages.OperationReEncrypt, func(ctx context.Context, req *Request, res *messages.FoobarResponse) (err error) {
+		res.ReEncrypt, err = handlers.ReEncryptHandler(ctx, s.nsmSession, s.rsaKeys, s.sessions, s.keys, s.replayCache, s.signingKey, *req.ReEncrypt, req.Bytes)
+		return err
+	})
+	s.router.Handle(messages.OperationGetSigningKey, func(ctx context.Context, req *Request, res *messages.FoobarResponse) (err error) {
+		res.GetSigningKey, err = handlers.GetSigningKeyHandler(ctx, s.nsmSession, s.signingKey, *req.GetSigningKey)
+		return err
+	})
+	s.router.Handle(messages.OperationRegisterKey, func(ctx context.Context, req *Request, res *messages.FoobarResponse) (err error) {
+		res.RegisterKey, err = handlers.RegisterKeyHandler(ctx, s.nsmSession, s.keys, *req.RegisterKey)
+		return err
+	})
+}
+
+// Serve accepts connections until the listener is closed or Shutdown is
+// called. Clients can either speak the JSON protocol or gRPC, the protocol is
+// detected on each connection.
+func (s *Server) Serve(listener net.Listener) error {
+	grpcListener := newConnListener(listener.Addr())
+	// Same limit as the JSON protocol's, rather than gRPC's default of 4 MiB.
+	grpcServer := grpc.NewServer(grpc.MaxRecvMsgSize(wire.MaxFrameSize), grpc.MaxSendMsgSize(wire.MaxFrameSize))
+	foobarpb.RegisterFoobarServer(grpcServer, grpcService{s: s})
+
+	if s.MaxConcurrentRequests <= 0 {
+		return fmt.Errorf("invalid MaxConcurrentRequests: %d", s.MaxConcurrentRequests)
+	}
+	if s.MaxConnections <= 0 {
+		return fmt.Errorf("invalid MaxConnections: %d", s.MaxConnections)
+	}
+	if s.MaxBufferedBytes < wire.MaxFrameSize {
+		return fmt.Errorf("invalid MaxBufferedBytes: %d, at least %d are needed", s.MaxBufferedBytes, wire.MaxFrameSize)
+	}
+	if s.RsaKeyRotation < 0 {
+		return fmt.Errorf("invalid RsaKeyRotation: %s", s.RsaKeyRotation)
+	}
+	if s.DecryptSessionTTL <= 0 {
+		return fmt.Errorf("invalid DecryptSessionTTL: %s", s.DecryptSessionTTL)
+	}
+	if s.MaxDecryptSessions <= 0 {
+		return fmt.Errorf("invalid MaxDecryptSessions: %d", s.MaxDecryptSessions)
+	}
+	if s.ReplayWindow <= 0 {
+		return fmt.Errorf("invalid ReplayWindow: %s", s.ReplayWindow)
+	}
+	if s.ReplayCacheSize <= 0 {
+		return fmt.Errorf("invalid ReplayCacheSize: %d", s.ReplayCacheSize)
+	}
+	if s.MinIntersectSetSize <= 0 {
+		return fmt.Errorf("invalid MinIntersectSetSize: %d", s.MinIntersectSetSize)
+	}
+	// The RSA keys are used by AWS KMS to encrypt responses. RSA is the only
+	// choice: this is the only way to create policies which bind to specific
+	// PCR0 hashes.
+	rsaKeys, err := handlers.NewRsaKeys(s.RsaKeySize, s.RsaKeyOverlap)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.isClosing() {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.grpcServer = grpcServer
+	s.requests = make(chan struct{}, s.MaxConcurrentRequests)
+	s.connections = make(chan struct{}, s.MaxConnections)
+	s.buffered = semaphore.NewWeighted(s.MaxBufferedBytes)
+	s.rsaKeys = rsaKeys
+	s.sessions = handlers.NewSessions(s.RsaKeySize, s.DecryptSessionTTL, s.MaxDecryptSessions)
+	s.replayCache = handlers.NewReplayCache(s.ReplayWindow, s.ReplayCacheSize)
+	s.mu.Unlock()
+
+	go grpcServer.Serve(grpcListener)
+
+	stopRotation := make(chan struct{})
+	defer close(stopRotation)
+	if s.RsaKeyRotation > 0 {
+		go s.rotateRsaKeys(stopRotation)
+	}
+
+	for {
+		// Wait for a connection to close before accepting more.
+		select {
+		case s.connections <- struct{}{}:
+		case <-s.closing:
+			return ErrServerClosed
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			<-s.connections
+		}
+		if errors.Is(err, net.ErrClosed) {
+			if s.isClosing() {
+				// Shutdown takes care of the gRPC server.
+				return ErrServerClosed
+			}
+			grpcServer.Stop()
+			return err
+		}
+		if err != nil {
+			fmt.Println("listener.Accept() failed: ", err)
+			continue
+		}
+
+		// handle connection in a goroutine. The slot is given back when the
+		// connection is closed, by either protocol.
+		go s.dispatchConnection(&limitedConn{Conn: conn, release: func() { <-s.connections }}, grpcListener)
+	}
+}
+
+func (s *Server) rotateRsaKeys(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.RsaKeyRotation)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.RotateRsaKey(); err != nil {
+				log.Printf("RotateRsaKey() failed: %s\n", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// RotateRsaKey replaces the current RSA key right away, without waiting for
+// RsaKeyRotation. It fails if Serve wasn't called.
+func (s *Server) RotateRsaKey() error {
+	s.mu.Lock()
+	rsaKeys := s.rsaKeys
+	s.mu.Unlock()
+	if rsaKeys == nil {
+		return errors.New("no RSA keys before Serve is called")
+	}
+	return rsaKeys.Rotate()
+}
+
+// Shutdown stops accepting connections and requests, and waits for in-flight
+// requests to complete. If ctx expires first, the remaining connections are
+// closed and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.isClosing() {
+		close(s.closing)
+	}
+	listener, grpcServer := s.listener, s.grpcServer
+	for conn := range s.conns {
+		// Unblocks the read loop, in-flight requests can still respond.
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		if grpcServer != nil {
+			grpcServer.GracefulStop()
+		}
+		s.connsWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+		return ctx.Err()
+	}
+}
+
+func (s *Server) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// trackConn registers a JSON connection, so that Shutdown can wait for it. It
+// returns false if the server is shutting down.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosing() {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.connsWg.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	s.connsWg.Done()
+}
+
+// acquire waits for one of the MaxConcurrentRequests slots. The slot must be
+// given back with release.
+func (s *Server) acquire(ctx context.Context) error {
+	select {
+	case s.requests <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.closing:
+		return ErrServerClosed
+	}
+}
+
+func (s *Server) release() {
+	<-s.requests
+}
+
+// reserve waits for size bytes of the MaxBufferedBytes budget. They must be
+// given back with unreserve.
+func (s *Server) reserve(ctx context.Context, size int) error {
+	if s.buffered.TryAcquire(int64(size)) {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := s.buffered.Acquire(ctx, int64(size)); err != nil {
+		if s.isClosing() {
+			return ErrServerClosed
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *Server) unreserve(size int) {
+	s.buffered.Release(int64(size))
+}
+
+func (s *Server) dispatchConnection(conn net.Conn, grpcListener *connListener) {
+	if !s.trackConn(conn) {
+		conn.Close()
+		return
+	}
+	tracked := true
+	defer func() {
+		if tracked {
+			s.untrackConn(conn)
+		}
+	}()
+
+	// Only this connection is lost.
+	defer func() {
+		if r := recover(); r != nil {
+			s.recovered(fmt.Sprintf("connection from %s", conn.RemoteAddr()), r)
+			conn.Close()
+		}
+	}()
+
+	prefix := make([]byte, len(http2Preface))
+	n, err := io.ReadFull(conn, prefix)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		conn.Close()
+		return
+	}
+	// Let the JSON protocol deal with short reads.
+	sniffed := &sniffedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(prefix[:n]), conn)}
+	if string(prefix[:n]) == http2Preface {
+		// The gRPC server drains its own connections.
+		s.untrackConn(conn)
+		tracked = false
+		grpcListener.push(sniffed)
+		return
+	}
+	s.handleConnection(sniffed)
+}
+
+// handleConnection reads requests until the client closes the connection.
+// Each request is handled in its own goroutine, responses are written as soon
+// as they are ready and carry the id of their request.
+//
+// Requests are canceled when the client goes away, but not when the server
+// shuts down: they get to complete.
+func (s *Server) handleConnection(conn net.Conn) {
+	var wg sync.WaitGroup
+	var writeMu sync.Mutex
+	ctx, cancel := context.WithCancel(context.Background())
+	defer conn.Close()
+	defer cancel()
+	// Let in-flight requests finish before closing the connection.
+	defer wg.Wait()
+
+	for {
+		size, err := wire.ReadHeader(conn)
+		if errors.Is(err, io.EOF) {
+			cancel()
+			return
+		}
+		if errors.Is(err, wire.ErrFrameTooLarge) {
+			// The stream is out of sync, report the error and give up on the
+			// connection.
+			log.Printf("wire.ReadFrame() failed: %s\n", err)
+			writeMu.Lock()
+			s.writeResponse(conn, messages.FoobarResponse{Error: &messages.Error{Code: messages.ErrorCodeInvalidRequest, Message: err.Error()}})
+			writeMu.Unlock()
+			return
+		}
+		if err != nil {
+			if !s.isClosing() {
+				log.Printf("wire.ReadFrame() failed: %s\n", err)
+				cancel()
+			}
+			return
+		}
+
+		// Backpressure: stop reading until a slot and enough of the buffer
+		// budget free up, the payload is only buffered once the request can
+		// be handled.
+		if err := s.acquire(ctx); err != nil {
+			return
+		}
+		if err := s.reserve(ctx, size); err != nil {
+			s.release()
+			return
+		}
+		reqBytes, err := s.readPayload(conn, size)
+		if err != nil {
+			s.unreserve(size)
+			s.release()
+			if !s.isClosing() {
+				log.Printf("wire.ReadPayload() failed: %s\n", err)
+				cancel()
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.release()
+			defer s.unreserve(size)
+			res := s.safeHandleRequest(ctx, conn, reqBytes)
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			if !s.writeResponse(conn, res) {
+				// Unblocks the read loop.
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// readPayload reads a frame's payload within payloadTimeout: a client which
+// announces a frame and stalls must not hold on to its request slot.
+func (s *Server) readPayload(conn net.Conn, size int) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(payloadTimeout))
+	payload, err := wire.ReadPayload(conn, size)
+	conn.SetReadDeadline(time.Time{})
+	// Shutdown sets a read deadline to unblock the read loop, which must not
+	// be lost.
+	if s.isClosing() {
+		conn.SetReadDeadline(time.Now())
+	}
+	return payload, err
+}
+
+// safeHandleRequest turns panics which escape the middleware chain into an
+// internal error.
+func (s *Server) safeHandleRequest(ctx context.Context, conn net.Conn, reqBytes []byte) (res messages.FoobarResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.recovered("request", r)
+			var req messages.FoobarRequest
+			json.Unmarshal(reqBytes, &req)
+			res = messages.FoobarResponse{Id: req.Id, Error: &messages.Error{Code: messages.ErrorCodeInternal, Message: fmt.Sprintf("panic: %v", r)}}
+		}
+	}()
+	return s.handleRequest(ctx, conn, reqBytes)
+}
+
+func (s *Server) handleRequest(ctx context.Context, conn net.Conn, reqBytes []byte) messages.FoobarResponse {
+	var req messages.FoobarRequest
+	if err := json.Unmarshal(reqBytes, &req); err != nil {
+		log.Printf("recv: %s", reqBytes)
+		return messages.FoobarResponse{Error: &messages.Error{Code: messages.ErrorCodeInvalidRequest, Message: fmt.Sprintf("json.Unmarshal failed: %s", err)}}
+	}
+	return s.router.Serve(ctx, &Request{FoobarRequest: req, Bytes: reqBytes, Peer: conn.RemoteAddr()})
+}
+
+// toResponseError keeps the errors returned by the handlers, anything else is
+// an internal error.
+func toResponseError(err error) *messages.Error {
+	var e *messages.Error
+	if errors.As(err, &e) {
+		return e
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &messages.Error{Code: messages.ErrorCodeDeadlineExceeded, Message: err.Error(), Retryable: true}
+	}
+	if errors.Is(err, ErrServerClosed) {
+		return &messages.Error{Code: messages.ErrorCodeUnavailable, Message: err.Error(), Retryable: true}
+	}
+	return &messages.Error{Code: messages.ErrorCodeInternal, Message: err.Error()}
+}
+
+// writeResponse returns false if the connection is no longer usable.
+func (s *Server) writeResponse(conn net.Conn, res messages.FoobarResponse) bool {
+	log.Printf("send: %+v", res)
+	resBytes, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("json.Marshal() failed: %s\n", err)
+		resBytes, _ = json.Marshal(messages.FoobarResponse{Id: res.Id, Error: &messages.Error{Code: messages.ErrorCodeInternal, Message: err.Error()}})
+	}
+	if err := wire.WriteFrame(conn, resBytes); err != nil {
+		log.Printf("wire.WriteFrame() failed: %s\n", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// stats are reported by the status operation.
+type stats struct {
+	startedAt time.Time
+
+	mu       sync.Mutex
+	requests map[string]uint64
+	errors   map[string]uint64
+}
+
+func newStats() *stats {
+	return &stats{
+		startedAt: time.Now(),
+		requests:  map[string]uint64{},
+		errors:    map[string]uint64{},
+	}
+}
+
+// counting counts requests per operation and errors per error code.
+func (s *Server) counting(next Handler) Handler {
+	return func(ctx context.Context, req *Request, res *messages.FoobarResponse) error {
+		err := next(ctx, req, res)
+
+		operation := req.Operation()
+		if operation == "" {
+			operation = "unknown"
+		}
+		s.stats.mu.Lock()
+		defer s.stats.mu.Unlock()
+		s.stats.requests[operation]++
+		if err != nil {
+			s.stats.errors[string(toResponseError(err).Code)]++
+		}
+		return err
+	}
+}
+
+func (s *Server) status() messages.EnclaveStatus {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	status := messages.EnclaveStatus{
+		BuildVersion: BuildVersion,
+		UptimeMs:     time.Since(s.stats.startedAt).Milliseconds(),
+		RsaKey:       s.rsaKeys.Current().Info(),
+		KeyIds:       []string{},
+		OpenSessions: s.sessions.Len(),
+		Requests:     map[string]uint64{},
+		Errors:       map[string]uint64{},
+		Health:       s.health(),
+	}
+	for _, key := range s.keys.List() {
+		status.KeyIds = append(status.KeyIds, key.KeyId)
+	}
+	for k, v := range s.stats.requests {
+		status.Requests[k] = v
+	}
+	for k, v := range s.stats.errors {
+		status.Errors[k] = v
+	}
+	return status
+}
@@ -0,0 +1,62 @@
+package cmds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	nitro_eclave_attestation_document "github.com/alokmenghrajani/go-nitro-enclave-attestation-document"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/utils"
+)
+
+// Aggregate computes statistics over the ciphertexts of inputPath, one per
+// line, whose plaintexts are numbers. It verifies that the attestation covers
+// these ciphertexts, parameters and results, and returns the results, and the
+// same signed by the enclave, for VerifyResult.
+func Aggregate(ctx context.Context, cfg Config, attestationPath, rootPath, inputPath string, parameters messages.AggregateParameters) (messages.AggregateResult, string) {
+	batch := openBatch(ctx, cfg, attestationPath, rootPath, readCiphertexts(inputPath))
+	defer batch.enclaveClient.Close()
+
+	req := &messages.AggregateRequest{
+		SessionId:        batch.sessionId,
+		AttestationNonce: newAttestationNonce(),
+		Parameters:       parameters,
+		Items:            batch.items[0],
+	}
+	resp, _ := sendRequest(ctx, batch.enclaveClient, messages.FoobarRequest{Aggregate: req})
+
+	responseAttestation, err := nitro_eclave_attestation_document.AuthenticateDocument(resp.Aggregate.Attestation, *batch.rootPublicKey, true)
+	utils.PanicOnErr(err)
+	checkAttestationNonce(responseAttestation, req.AttestationNonce)
+
+	var response messages.AggregateResponseAttestationUserData
+	err = json.Unmarshal(responseAttestation.UserData, &response)
+	utils.PanicOnErr(err)
+
+	if !bytes.Equal(response.InputDigest, messages.InputSetDigest(req.Items)) {
+		utils.PanicOnErr(fmt.Errorf("attested input digest %02x doesn't match the ciphertexts", response.InputDigest))
+	}
+	if !bytes.Equal(response.ParametersHash, parameters.Hash()) {
+		utils.PanicOnErr(fmt.Errorf("attested parameters hash %02x doesn't match the request's", response.ParametersHash))
+	}
+	result := resp.Aggregate.Result
+	if !bytes.Equal(response.ResultHash, result.Hash()) {
+		utils.PanicOnErr(fmt.Errorf("attested result hash %02x doesn't match the result %+v", response.ResultHash, result))
+	}
+	log.Printf("attestation valid")
+
+	fmt.Printf("Count: %g\n", result.Count)
+	fmt.Printf("Sum: %g\n", result.Sum)
+	fmt.Printf("Mean: %g\n", result.Mean)
+	for i, n := range result.Histogram {
+		fmt.Printf("Bucket %d: %g\n", i, n)
+	}
+	if result.Rejected != nil {
+		fmt.Printf("Rejected: %d\n", *result.Rejected)
+	}
+	fmt.Printf("Signed result: %s\n", resp.Aggregate.SignedResult)
+	return result, resp.Aggregate.SignedResult
+}
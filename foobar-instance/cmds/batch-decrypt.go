@@ -0,0 +1,264 @@
+package cmds
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	nitro_eclave_attestation_document "github.com/alokmenghrajani/go-nitro-enclave-attestation-document"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-instance/enclave"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/merkle"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/utils"
+)
+
+// Receipt proves a single result of a batch decrypt to someone who trusts the
+// enclave's root CA, without revealing the other results.
+type Receipt struct {
+	// Attestation is the batch's attestation, which commits to the Merkle root.
+	Attestation []byte `json:"attestation"`
+	Index       int    `json:"index"`
+	// Request is the digest of the item, see messages.BatchDecryptItem.
+	Request []byte                      `json:"request"`
+	Result  messages.BatchDecryptResult `json:"result"`
+}
+
+// BatchDecrypt decrypts the ciphertexts of inputPath, one per line, with a
+// single decrypt session and a single enclave request. It verifies the
+// attestation and every inclusion proof, writes a receipt per item to
+// receiptsPath and returns the results, in the order of the input. The enclave
+// runs computation on each plaintext.
+func BatchDecrypt(ctx context.Context, cfg Config, attestationPath, rootPath, inputPath, receiptsPath string, computation Computation) []messages.BatchDecryptResult {
+	batch := openBatch(ctx, cfg, attestationPath, rootPath, readCiphertexts(inputPath))
+	defer batch.enclaveClient.Close()
+
+	req := &messages.BatchDecryptRequest{
+		SessionId:        batch.sessionId,
+		AttestationNonce: newAttestationNonce(),
+		Computation:      computation.Name,
+		Parameters:       computation.Parameters,
+		WasmModule:       computation.WasmModule,
+		Items:            batch.items[0],
+	}
+
+	resp2, _ := sendRequest(ctx, batch.enclaveClient, messages.FoobarRequest{BatchDecrypt: req})
+
+	responseAttestation, err := nitro_eclave_attestation_document.AuthenticateDocument(resp2.BatchDecrypt.Attestation, *batch.rootPublicKey, true)
+	utils.PanicOnErr(err)
+	checkAttestationNonce(responseAttestation, req.AttestationNonce)
+
+	var response messages.BatchDecryptResponseAttestationUserData
+	err = json.Unmarshal(responseAttestation.UserData, &response)
+	utils.PanicOnErr(err)
+
+	results := resp2.BatchDecrypt.Results
+	if response.Size != len(req.Items) || len(results) != len(req.Items) {
+		utils.PanicOnErr(fmt.Errorf("got %d results for a tree of %d, expected %d", len(results), response.Size, len(req.Items)))
+	}
+	var receipts []Receipt
+	for i, result := range results {
+		receipt := Receipt{
+			Attestation: resp2.BatchDecrypt.Attestation,
+			Index:       i,
+			Request:     req.Items[i].Digest(),
+			Result:      result,
+		}
+		err := merkle.Verify(response.MerkleRoot, result.LeafHash(receipt.Request), i, response.Size, result.Proof)
+		utils.PanicOnErr(err)
+		receipts = append(receipts, receipt)
+
+		if result.Error != nil {
+			fmt.Printf("%d: %s\n", i, result.Error)
+		} else {
+			checkComputationResult(*result.Result, computation)
+			fmt.Printf("%d: %s: %s\n", i, result.Result.Computation, result.Result.Value)
+		}
+	}
+	log.Printf("attestation and inclusion proofs valid")
+
+	receiptsBytes, err := json.MarshalIndent(receipts, "", "  ")
+	utils.PanicOnErr(err)
+	err = os.WriteFile(receiptsPath, receiptsBytes, 0644)
+	utils.PanicOnErr(err)
+
+	return results
+}
+
+// VerifyReceipt checks receipt index of receiptsPath: the attestation must
+// chain to the root CA and the result must be in the attested Merkle tree. It
+// returns the verified result.
+func VerifyReceipt(rootPath, receiptsPath string, index int) messages.BatchDecryptResult {
+	root, err := os.ReadFile(rootPath)
+	utils.PanicOnErr(err)
+
+	rootPublicKeyBlock, _ := pem.Decode(root)
+	rootPublicKey, err := x509.ParseCertificate(rootPublicKeyBlock.Bytes)
+	utils.PanicOnErr(err)
+
+	receiptsBytes, err := os.ReadFile(receiptsPath)
+	utils.PanicOnErr(err)
+	var receipts []Receipt
+	err = json.Unmarshal(receiptsBytes, &receipts)
+	utils.PanicOnErr(err)
+	if index < 0 || index >= len(receipts) {
+		utils.PanicOnErr(fmt.Errorf("no receipt %d, %s has %d", index, receiptsPath, len(receipts)))
+	}
+	receipt := receipts[index]
+
+	attestation, err := nitro_eclave_attestation_document.AuthenticateDocument(receipt.Attestation, *rootPublicKey, true)
+	utils.PanicOnErr(err)
+	log.Printf("PCR0: %02x", attestation.PCRs[0])
+
+	var userData messages.BatchDecryptResponseAttestationUserData
+	err = json.Unmarshal(attestation.UserData, &userData)
+	utils.PanicOnErr(err)
+
+	err = merkle.Verify(userData.MerkleRoot, receipt.Result.LeafHash(receipt.Request), receipt.Index, userData.Size, receipt.Result.Proof)
+	utils.PanicOnErr(err)
+	log.Printf("receipt valid")
+
+	if receipt.Result.Error != nil {
+		fmt.Printf("Error: %s\n", receipt.Result.Error)
+	} else {
+		fmt.Printf("%s: %s\n", receipt.Result.Result.Computation, receipt.Result.Result.Value)
+		fmt.Printf("Parameters SHA-256: %02x\n", receipt.Result.Result.ParametersHash)
+		if receipt.Result.Result.ModuleHash != nil {
+			fmt.Printf("Module SHA-256: %02x\n", receipt.Result.Result.ModuleHash)
+		}
+	}
+	return receipt.Result
+}
+
+// batch is the input of the batch commands, ready to be sent to the enclave.
+type batch struct {
+	rootPublicKey *x509.Certificate
+	enclaveClient *enclave.Client
+	sessionId     string
+	// items has the items of each input, in order.
+	items [][]messages.BatchDecryptItem
+}
+
+// openBatch opens a decrypt session and has KMS encrypt the shared secret of
+// every ciphertext of the inputs to the session's RSA key. Up to 4096 items can
+// take longer than an attestation stays fresh, or than the session lives: the
+// enclave attests the session again every cfg.AttestationRefresh, which also
+// restarts its expiry. The caller closes the enclave client.
+func openBatch(ctx context.Context, cfg Config, attestationPath, rootPath string, inputs ...[]ciphertextMessage) batch {
+	attestationBytes, err := os.ReadFile(attestationPath)
+	utils.PanicOnErr(err)
+
+	root, err := os.ReadFile(rootPath)
+	utils.PanicOnErr(err)
+
+	rootPublicKeyBlock, _ := pem.Decode(root)
+	rootPublicKey, err := x509.ParseCertificate(rootPublicKeyBlock.Bytes)
+	utils.PanicOnErr(err)
+
+	attestation, err := nitro_eclave_attestation_document.AuthenticateDocument(attestationBytes, *rootPublicKey, true)
+	utils.PanicOnErr(err)
+
+	var userData messages.CreateKeyResponseAttestationUserData
+	err = json.Unmarshal(attestation.UserData, &userData)
+	utils.PanicOnErr(err)
+
+	// All the shared secrets are encrypted to the session's RSA key.
+	enclaveClient := dialEnclave(ctx, cfg)
+	registerKey(ctx, enclaveClient, attestationBytes)
+	resp, _ := sendRequest(ctx, enclaveClient, messages.FoobarRequest{GetAttestation: &messages.GetAttestationRequest{OpenSession: true}})
+	freshAttestation, attestedAt := resp.GetAttestation.Attestation, time.Now()
+	refresh := cfg.AttestationRefresh
+	if refresh == 0 {
+		refresh = 4 * time.Minute
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(userData.Region))
+	utils.PanicOnErr(err)
+	kmsClient := kms.NewFromConfig(awsCfg, cfg.kmsOptions)
+
+	b := batch{
+		rootPublicKey: rootPublicKey,
+		enclaveClient: enclaveClient,
+		sessionId:     resp.GetAttestation.SessionId,
+	}
+	for _, ciphertexts := range inputs {
+		var items []messages.BatchDecryptItem
+		for _, ciphertextMessage := range ciphertexts {
+			if time.Since(attestedAt) >= refresh {
+				freshAttestation, attestedAt = refreshSession(ctx, enclaveClient, rootPublicKey, b.sessionId), time.Now()
+			}
+			deriveSharedSecretOutput, err := kmsClient.DeriveSharedSecret(ctx, &kms.DeriveSharedSecretInput{
+				KeyAgreementAlgorithm: types.KeyAgreementAlgorithmSpecEcdh,
+				KeyId:                 &userData.KeyId,
+				PublicKey:             ciphertextMessage.EphemeralKey,
+				Recipient: &types.RecipientInfo{
+					AttestationDocument:    freshAttestation,
+					KeyEncryptionAlgorithm: types.KeyEncryptionMechanismRsaesOaepSha256,
+				},
+			})
+			utils.PanicOnErr(err)
+			items = append(items, messages.BatchDecryptItem{
+				KeyId:                 userData.KeyId,
+				EncryptedSharedSecret: deriveSharedSecretOutput.CiphertextForRecipient,
+				Nonce:                 ciphertextMessage.Nonce,
+				Ciphertext:            ciphertextMessage.Ciphertext,
+				OneShotUntil:          ciphertextMessage.OneShotUntil,
+			})
+		}
+		b.items = append(b.items, items)
+	}
+	return b
+}
+
+// refreshSession returns a new attestation of an open session's RSA key.
+// Enclaves which don't know how to refresh a session attest their current RSA
+// key instead, which the session id of the user data tells apart.
+func refreshSession(ctx context.Context, enclaveClient *enclave.Client, rootPublicKey *x509.Certificate, sessionId string) []byte {
+	resp, _ := sendRequest(ctx, enclaveClient, messages.FoobarRequest{GetAttestation: &messages.GetAttestationRequest{SessionId: sessionId}})
+	attestation, err := nitro_eclave_attestation_document.AuthenticateDocument(resp.GetAttestation.Attestation, *rootPublicKey, true)
+	utils.PanicOnErr(err)
+	var userData messages.GetAttestationResponseAttestationUserData
+	err = json.Unmarshal(attestation.UserData, &userData)
+	utils.PanicOnErr(err)
+	if userData.SessionId != sessionId {
+		utils.PanicOnErr(fmt.Errorf("the enclave attested session %q instead of %q, it may not support refreshing sessions", userData.SessionId, sessionId))
+	}
+	log.Printf("refreshed the attestation of session %s", sessionId)
+	return resp.GetAttestation.Attestation
+}
+
+// readCiphertexts reads a file of ciphertexts, as printed by the encrypt
+// command, one per line.
+func readCiphertexts(inputPath string) []ciphertextMessage {
+	var ciphertexts []ciphertextMessage
+	input, err := os.Open(inputPath)
+	utils.PanicOnErr(err)
+	defer input.Close()
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		ciphertextMessageBytes, err := base64.RawURLEncoding.DecodeString(line)
+		utils.PanicOnErr(err)
+		var ciphertextMessage ciphertextMessage
+		err = json.Unmarshal(ciphertextMessageBytes, &ciphertextMessage)
+		utils.PanicOnErr(err)
+		ciphertexts = append(ciphertexts, ciphertextMessage)
+	}
+	utils.PanicOnErr(scanner.Err())
+	log.Printf("%d ciphertexts in %s", len(ciphertexts), inputPath)
+	return ciphertexts
+}
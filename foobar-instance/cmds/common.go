@@ -1,37 +1,155 @@
 package cmds
 
 import (
-	"bufio"
-	"encoding/json"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
 	"log"
+	"net"
+	"net/url"
+	"slices"
+	"time"
 
-	"github.com/mdlayher/vsock"
-	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/constants"
+	nitro_eclave_attestation_document "github.com/alokmenghrajani/go-nitro-enclave-attestation-document"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-instance/enclave"
 	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/transport"
 	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/utils"
 )
 
-func sendRequest(req messages.FoobarRequest) (messages.FoobarResponse, []byte) {
-	log.Printf("Connecting to vsock (cid=%d, port=%d)\n", constants.ENCLAVE_CID, constants.ENCLAVE_LISTENING_PORT)
-	conn, err := vsock.Dial(constants.ENCLAVE_CID, constants.ENCLAVE_LISTENING_PORT, nil)
+// Config holds the settings shared by the commands.
+type Config struct {
+	// Enclave is where the enclave listens for commands.
+	Enclave transport.Dialer
+
+	// KmsProxy is where the enclave's connections to KMS arrive.
+	KmsProxy transport.Listener
+
+	// KmsEndpoint overrides the regional KMS endpoint, e.g. to use fake-kms.
+	// Empty means https://kms.<region>.amazonaws.com.
+	KmsEndpoint string
+
+	// Grpc selects gRPC instead of the JSON protocol to talk to the enclave.
+	Grpc bool
+
+	// AttestationRefresh is how old the attestation of a decrypt session may
+	// get before the batch commands have the enclave attest the session again.
+	// Zero means 4 minutes, KMS rejects attestations older than 5.
+	AttestationRefresh time.Duration
+}
+
+// dialEnclave connects to the enclave. The connection can be shared by
+// several requests, including concurrent ones.
+func dialEnclave(ctx context.Context, cfg Config) *enclave.Client {
+	dial := enclave.Dial
+	if cfg.Grpc {
+		dial = enclave.DialGRPC
+	}
+	c, err := dial(ctx, cfg.Enclave)
 	utils.PanicOnErr(err)
-	defer conn.Close()
+	return c
+}
+
+// registerKey makes sure the enclave knows the key of a createKey attestation,
+// e.g. after the enclave restarted. Enclaves which predate registerKey only
+// know the keys they created.
+func registerKey(ctx context.Context, c *enclave.Client, attestationBytes []byte) {
+	if !slices.Contains(c.Hello.Operations, messages.OperationRegisterKey) {
+		return
+	}
+	resp, _ := sendRequest(ctx, c, messages.FoobarRequest{RegisterKey: &messages.RegisterKeyRequest{Attestation: attestationBytes}})
+	if resp.RegisterKey.Registered {
+		log.Printf("registered key %s", resp.RegisterKey.KeyId)
+	}
+}
 
-	log.Printf("Send: %v", req)
-	msgBytes, err := json.Marshal(req)
+// sendRequest sends req and returns the response along with the bytes which
+// were sent. It fails if the enclave doesn't support the operation or returns
+// an error.
+func sendRequest(ctx context.Context, c *enclave.Client, req messages.FoobarRequest) (messages.FoobarResponse, []byte) {
+	resp, msgBytes, err := c.Send(ctx, req)
 	utils.PanicOnErr(err)
+	return resp, msgBytes
+}
 
-	conn.Write(msgBytes)
-	conn.Write([]byte{'\n'})
-	scanner := bufio.NewScanner(conn)
-	scanner.Scan()
-	var resp messages.FoobarResponse
-	json.Unmarshal(scanner.Bytes(), &resp)
-	log.Printf("Recv: %v", resp)
+// newAttestationNonce returns a random nonce, for the enclave to place in the
+// attestation of its response.
+func newAttestationNonce() []byte {
+	nonce := make([]byte, 32)
+	_, err := rand.Read(nonce)
+	utils.PanicOnErr(err)
+	return nonce
+}
 
-	if resp.Error != nil {
-		log.Panicf("enclave error: %s\n", *resp.Error)
+// checkAttestationNonce fails if a verified attestation doesn't carry nonce,
+// e.g. because it was captured earlier and is being replayed.
+func checkAttestationNonce(attestation *nitro_eclave_attestation_document.AttestationDocument, nonce []byte) {
+	if !bytes.Equal(attestation.Nonce, nonce) {
+		utils.PanicOnErr(fmt.Errorf("attestation nonce %02x doesn't match the request's %02x", attestation.Nonce, nonce))
 	}
+}
 
-	return resp, msgBytes
+// Computation is what the enclave computes on the plaintexts: either a
+// computation it knows by name, or a WebAssembly module. An empty Name is
+// messages.DefaultComputation.
+type Computation struct {
+	Name       string
+	Parameters []byte
+	WasmModule []byte
+}
+
+// name returns the name the enclave attests.
+func (c Computation) name() string {
+	switch {
+	case len(c.WasmModule) > 0:
+		return messages.WasmComputation
+	case c.Name == "":
+		return messages.DefaultComputation
+	}
+	return c.Name
+}
+
+// checkComputationResult fails if the enclave didn't run the requested
+// computation with the requested parameters.
+func checkComputationResult(result messages.ComputationResult, computation Computation) {
+	if result.Computation != computation.name() {
+		utils.PanicOnErr(fmt.Errorf("enclave ran computation %q, expected %q", result.Computation, computation.name()))
+	}
+	if !bytes.Equal(result.ParametersHash, messages.ParametersHash(computation.Parameters)) {
+		utils.PanicOnErr(fmt.Errorf("enclave ran %s with other parameters", result.Computation))
+	}
+	if len(computation.WasmModule) > 0 && !bytes.Equal(result.ModuleHash, messages.ModuleHash(computation.WasmModule)) {
+		utils.PanicOnErr(fmt.Errorf("enclave ran module %02x, expected %02x", result.ModuleHash, messages.ModuleHash(computation.WasmModule)))
+	}
+	if result.ModuleHash != nil {
+		log.Printf("module SHA-256: %02x", result.ModuleHash)
+	}
+}
+
+// kmsAddress returns the host:port the KMS proxy forwards connections to.
+func (cfg Config) kmsAddress(region string) (string, error) {
+	if cfg.KmsEndpoint == "" {
+		return fmt.Sprintf("kms.%s.amazonaws.com:443", region), nil
+	}
+	u, err := url.Parse(cfg.KmsEndpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	if u.Scheme == "http" {
+		return net.JoinHostPort(u.Hostname(), "80"), nil
+	}
+	return net.JoinHostPort(u.Hostname(), "443"), nil
+}
+
+// kmsOptions applies KmsEndpoint to a KMS client.
+func (cfg Config) kmsOptions(o *kms.Options) {
+	if cfg.KmsEndpoint != "" {
+		o.BaseEndpoint = aws.String(cfg.KmsEndpoint)
+	}
 }
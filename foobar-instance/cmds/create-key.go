@@ -2,7 +2,10 @@ package cmds
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,12 +14,12 @@ import (
 	"strings"
 	"sync"
 
+	nitro_eclave_attestation_document "github.com/alokmenghrajani/go-nitro-enclave-attestation-document"
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
-	"github.com/mdlayher/vsock"
-	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/constants"
 	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/transport"
 	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/utils"
 )
 
@@ -25,14 +28,14 @@ import (
 // do this complicated proxying, the enclave doesn't know if the key its
 // using is actually backed by KMS or not!
 
-func CreateKey(ctx context.Context, awsIamRole, attestationPath string) {
+func CreateKey(ctx context.Context, cfg Config, awsIamRole, attestationPath, rootPath string) {
 	// Step 1:
 	//   Grab various pieces of information from the Instance Metadata Service
 	//   (imds). This includes our region, account id, IAM credentials, etc.
-	cfg, err := config.LoadDefaultConfig(ctx)
+	awsCfg, err := config.LoadDefaultConfig(ctx)
 	utils.PanicOnErr(err)
 
-	client := imds.NewFromConfig(cfg)
+	client := imds.NewFromConfig(awsCfg)
 	region, err := client.GetRegion(ctx, &imds.GetRegionInput{})
 	utils.PanicOnErr(err)
 	log.Printf("region: %s\n", region.Region)
@@ -64,23 +67,39 @@ func CreateKey(ctx context.Context, awsIamRole, attestationPath string) {
 
 	// Step 2:
 	//   Setup a proxy that fuses the "left" and "right" sockets:
-	//   AWS KMS <==> instance <==> enclave. Given that this is a CLI, we don't
-	//   need to think about tearing down the proxy -- it happens automatically
-	//   when the CLI exits.
-	_ = NewProxy(fmt.Sprintf("kms.%s.amazonaws.com:443", region.Region))
+	//   AWS KMS <==> instance <==> enclave.
+	kmsAddress, err := cfg.kmsAddress(region.Region)
+	utils.PanicOnErr(err)
+	proxy := NewProxy(cfg.KmsProxy, kmsAddress)
+	defer proxy.Close()
 
 	// Step 3:
 	//   Tell enclave to create the key
-	resp, _ := sendRequest(messages.FoobarRequest{
+	enclaveClient := dialEnclave(ctx, cfg)
+	defer enclaveClient.Close()
+	nonce := newAttestationNonce()
+	resp, _ := sendRequest(ctx, enclaveClient, messages.FoobarRequest{
 		CreateKey: &messages.CreateKeyRequest{
-			Region:      region.Region,
-			AccountId:   arn.AccountID,
-			AwsIamRole:  awsIamRole,
-			Credentials: credentials,
+			Region:           region.Region,
+			AccountId:        arn.AccountID,
+			AwsIamRole:       awsIamRole,
+			Credentials:      credentials,
+			AttestationNonce: nonce,
 		},
 	})
 
 	// Step 4:
+	//   Check that the attestation is a response to this request.
+	root, err := os.ReadFile(rootPath)
+	utils.PanicOnErr(err)
+	rootPublicKeyBlock, _ := pem.Decode(root)
+	rootPublicKey, err := x509.ParseCertificate(rootPublicKeyBlock.Bytes)
+	utils.PanicOnErr(err)
+	attestation, err := nitro_eclave_attestation_document.AuthenticateDocument(resp.CreateKey.Attestation, *rootPublicKey, true)
+	utils.PanicOnErr(err)
+	checkAttestationNonce(attestation, nonce)
+
+	// Step 5:
 	//   Save the attestation for the next operation.
 	os.WriteFile(attestationPath, []byte(resp.CreateKey.Attestation), 0644)
 }
@@ -89,24 +108,35 @@ func CreateKey(ctx context.Context, awsIamRole, attestationPath string) {
 // https://github.com/ghostunnel/ghostunnel did help!
 
 type Proxy struct {
+	listener net.Listener
 	leftHost string
 }
 
-func NewProxy(leftHost string) *Proxy {
+func NewProxy(right transport.Listener, leftHost string) *Proxy {
+	log.Printf("starting proxy, listening on %s\n", right)
+	listener, err := right.Listen()
+	utils.PanicOnErr(err)
+
 	proxy := &Proxy{
+		listener: listener,
 		leftHost: leftHost,
 	}
 	go func() { proxy.start() }()
 	return proxy
 }
 
-func (proxy Proxy) start() {
-	log.Printf("starting proxy, listening on vsock (cid=%d, port=%d)\n", constants.INSTANCE_CID, constants.INSTANCE_LISTENING_PORT)
-	listener, err := vsock.ListenContextID(constants.INSTANCE_CID, constants.INSTANCE_LISTENING_PORT, nil)
-	utils.PanicOnErr(err)
+// Close stops accepting connections. Connections which are already proxied
+// are not interrupted.
+func (proxy *Proxy) Close() error {
+	return proxy.listener.Close()
+}
 
+func (proxy *Proxy) start() {
 	for {
-		conn, err := listener.Accept()
+		conn, err := proxy.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Println("listener.Accept() failed: ", err)
 			continue
@@ -117,7 +147,7 @@ func (proxy Proxy) start() {
 	}
 }
 
-func (proxy Proxy) handleConnection(right net.Conn) {
+func (proxy *Proxy) handleConnection(right net.Conn) {
 	left, err := net.Dial("tcp", proxy.leftHost)
 	if err != nil {
 		log.Println("Dial() failed: ", err)
@@ -136,7 +166,7 @@ func (proxy Proxy) handleConnection(right net.Conn) {
 	log.Println("connection closed")
 }
 
-func (proxy Proxy) copy(dst net.Conn, src net.Conn) {
+func (proxy *Proxy) copy(dst net.Conn, src net.Conn) {
 	defer src.Close()
 	defer dst.Close()
 	_, err := io.Copy(dst, src)
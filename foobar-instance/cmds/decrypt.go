@@ -20,13 +20,18 @@ import (
 )
 
 // Decryption works as followingL
-// 1. tell enclave to create an attestation with an ephemeral RSA key
+// 1. tell enclave to open a decrypt session, i.e. to create an attestation
+//    with a single-use RSA key
 // 2. use the attestation with KMS to derive an encrypted CEK.
 // 3. give the ciphertext and CEK to the enclave.
 // 4. receive a response inside an attestation.
 // 5. decode the attestation and print the result.
 
-func Decrypt(ctx context.Context, attestationPath, rootPath, ciphertext string) {
+// Decrypt returns the verified result along with the SHA-256 of the request
+// which was sent to the enclave, so callers can compare it with
+// InitialRequest, and the result signed by the enclave, for VerifyResult. The
+// enclave runs computation on the plaintext.
+func Decrypt(ctx context.Context, cfg Config, attestationPath, rootPath, ciphertext string, computation Computation) (messages.DecryptResponseAttestationUserData, []byte, string) {
 	// Step 1: Use the attestation from createKey to get the key id
 	attestationBytes, err := os.ReadFile(attestationPath)
 	utils.PanicOnErr(err)
@@ -56,14 +61,21 @@ func Decrypt(ctx context.Context, attestationPath, rootPath, ciphertext string)
 
 	// Step 3: request a fresh attestation from the enclave. We don't need to
 	// valdidate it, KMS takes care of that.
-	resp, _ := sendRequest(messages.FoobarRequest{GetAttestation: &messages.GetAttestationRequest{}})
+	// The connection is reused for the decrypt request. Enclaves which predate
+	// decrypt sessions don't return a session id, the decrypt request then
+	// doesn't reference one either.
+	enclaveClient := dialEnclave(ctx, cfg)
+	defer enclaveClient.Close()
+	registerKey(ctx, enclaveClient, attestationBytes)
+	resp, _ := sendRequest(ctx, enclaveClient, messages.FoobarRequest{GetAttestation: &messages.GetAttestationRequest{OpenSession: true}})
 	freshAttestation := resp.GetAttestation.Attestation
+	sessionId := resp.GetAttestation.SessionId
 
 	// Step 4: get an encrypted-shared secret from KMS
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(userData.Region))
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(userData.Region))
 	utils.PanicOnErr(err)
 
-	kmsClient := kms.NewFromConfig(cfg)
+	kmsClient := kms.NewFromConfig(awsCfg, cfg.kmsOptions)
 	deriveSharedSecretOutput, err := kmsClient.DeriveSharedSecret(ctx, &kms.DeriveSharedSecretInput{
 		KeyAgreementAlgorithm: types.KeyAgreementAlgorithmSpecEcdh,
 		KeyId:                 &userData.KeyId,
@@ -78,15 +90,24 @@ func Decrypt(ctx context.Context, attestationPath, rootPath, ciphertext string)
 	log.Printf("Encrypted shared secret: %s", base64.RawURLEncoding.EncodeToString(deriveSharedSecretOutput.CiphertextForRecipient))
 
 	// Step 5: send the encrypted shared secret to the enclave
-	resp2, msgBytes := sendRequest(messages.FoobarRequest{Decrypt: &messages.DecryptRequest{
+	nonce := newAttestationNonce()
+	resp2, msgBytes := sendRequest(ctx, enclaveClient, messages.FoobarRequest{Decrypt: &messages.DecryptRequest{
+		KeyId:                 userData.KeyId,
+		SessionId:             sessionId,
 		EncryptedSharedSecret: deriveSharedSecretOutput.CiphertextForRecipient,
 		Nonce:                 ciphertextMessage.Nonce,
 		Ciphertext:            ciphertextMessage.Ciphertext,
+		AttestationNonce:      nonce,
+		OneShotUntil:          ciphertextMessage.OneShotUntil,
+		Computation:           computation.Name,
+		Parameters:            computation.Parameters,
+		WasmModule:            computation.WasmModule,
 	}})
 
 	// Step 6: verify attestation is valid and extract response.
 	responseAttestation, err := nitro_eclave_attestation_document.AuthenticateDocument(resp2.Decrypt.Attestation, *rootPublicKey, true)
 	utils.PanicOnErr(err)
+	checkAttestationNonce(responseAttestation, nonce)
 	log.Printf("attestation valid")
 	log.Printf("PCR0: %02x", responseAttestation.PCRs[0])
 
@@ -94,12 +115,21 @@ func Decrypt(ctx context.Context, attestationPath, rootPath, ciphertext string)
 	err = json.Unmarshal(responseAttestation.UserData, &response)
 	utils.PanicOnErr(err)
 
+	if response.KeyId != userData.KeyId {
+		utils.PanicOnErr(fmt.Errorf("enclave decrypted with key %s, expected %s", response.KeyId, userData.KeyId))
+	}
+
+	checkComputationResult(response.Result, computation)
+
 	log.Printf("Request SHA-256: %02x", response.InitialRequest)
 
 	// Calculate expected sha
 	h := sha256.New()
 	h.Write(msgBytes)
-	log.Printf("expected:        %02x", h.Sum(nil))
+	expected := h.Sum(nil)
+	log.Printf("expected:        %02x", expected)
 
-	fmt.Printf("Count 'a': %d\n", response.Count)
+	fmt.Printf("%s: %s\n", response.Result.Computation, response.Result.Value)
+	fmt.Printf("Signed result: %s\n", resp2.Decrypt.SignedResult)
+	return response, expected, resp2.Decrypt.SignedResult
 }
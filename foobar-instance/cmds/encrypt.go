@@ -14,6 +14,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
 
 	"golang.org/x/crypto/hkdf"
 
@@ -29,8 +30,18 @@ import (
 // 4. Use the CEK to encrypt the plaintext with AES-GCM.
 // 5. Return the ciphertext as a json blob, containing the ephemeral ECC public
 //    key.
+//
+// The ciphertext is bound to the key's id, the enclave only decrypts it when
+// asked to with that key. With a non-zero oneShot, it decrypts the ciphertext
+// at most once, within oneShot.
 
-func Encrypt(attestationPath, rootPath, plaintext string) {
+func Encrypt(attestationPath, rootPath, plaintext string, oneShot time.Duration) string {
+	return EncryptBound(attestationPath, rootPath, plaintext, oneShot, messages.Binding{})
+}
+
+// EncryptBound is Encrypt, for a ciphertext the enclave only uses as binding
+// allows, e.g. to re-encrypt it to a given recipient.
+func EncryptBound(attestationPath, rootPath, plaintext string, oneShot time.Duration, binding messages.Binding) string {
 	attestationBytes, err := os.ReadFile(attestationPath)
 	utils.PanicOnErr(err)
 
@@ -82,7 +93,11 @@ func Encrypt(attestationPath, rootPath, plaintext string) {
 	nonce := make([]byte, aesgcm.NonceSize())
 	_, err = rand.Read(nonce)
 	utils.PanicOnErr(err)
-	ciphertext := aesgcm.Seal(nil, nonce, []byte(plaintext), nil)
+	var oneShotUntil int64
+	if oneShot > 0 {
+		oneShotUntil = time.Now().Add(oneShot).Unix()
+	}
+	ciphertext := aesgcm.Seal(nil, nonce, []byte(plaintext), messages.AdditionalData(userData.KeyId, oneShotUntil, binding))
 
 	// Step 6: print the result
 	ephemeralEcdsaKeyPublicKeyBytes, err := x509.MarshalPKIXPublicKey(&ephemeralEcdsaKey.PublicKey)
@@ -91,16 +106,19 @@ func Encrypt(attestationPath, rootPath, plaintext string) {
 		EphemeralKey: ephemeralEcdsaKeyPublicKeyBytes,
 		Nonce:        nonce,
 		Ciphertext:   ciphertext,
+		OneShotUntil: oneShotUntil,
 	}
 	messageBytes, err := json.Marshal(message)
 	utils.PanicOnErr(err)
 
 	messageString := base64.RawURLEncoding.EncodeToString(messageBytes)
 	fmt.Println(messageString)
+	return messageString
 }
 
 type ciphertextMessage struct {
 	EphemeralKey []byte `json:"e"`
 	Nonce        []byte `json:"n"`
 	Ciphertext   []byte `json:"c"`
+	OneShotUntil int64  `json:"o,omitempty"`
 }
@@ -0,0 +1,39 @@
+package cmds
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-instance/fakekms"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/utils"
+)
+
+// Runs a local stand-in for AWS KMS. Point the enclave (--kms-endpoint) and
+// the CLI (--kms-endpoint) at it to run create-key and decrypt without an AWS
+// account. rootPath is usually the root certificate written by the enclave's
+// NSM simulator.
+
+func FakeKms(listenAddress, accountId string, principals map[string]string, rootPath string) {
+	root, err := os.ReadFile(rootPath)
+	utils.PanicOnErr(err)
+
+	rootPublicKeyBlock, _ := pem.Decode(root)
+	if rootPublicKeyBlock == nil {
+		utils.PanicOnErr(errors.New("invalid root certificate"))
+	}
+	rootPublicKey, err := x509.ParseCertificate(rootPublicKeyBlock.Bytes)
+	utils.PanicOnErr(err)
+
+	server := fakekms.New(fakekms.Config{
+		AccountId:  accountId,
+		Principals: principals,
+		Root:       rootPublicKey,
+	})
+
+	log.Printf("fake-kms listening on %s (account id: %s)\n", listenAddress, accountId)
+	utils.PanicOnErr(http.ListenAndServe(listenAddress, server))
+}
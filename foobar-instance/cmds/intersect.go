@@ -0,0 +1,158 @@
+package cmds
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	nitro_eclave_attestation_document "github.com/alokmenghrajani/go-nitro-enclave-attestation-document"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/ecies"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/utils"
+)
+
+// Intersect computes the intersection of the ciphertexts of leftPath and
+// rightPath, one per line, encrypted for leftParty and rightParty (see
+// EncryptBound). Without recipientPath, only its size leaves the enclave. With
+// recipientPath, a PEM public key which both parties bound their ciphertexts
+// to, the enclave seals the intersecting plaintexts to it, which are written to
+// outputPath, one per line, for Unseal. It verifies the attestation and returns
+// the attested user data, the sealed plaintexts and the user data signed by the
+// enclave, for VerifyResult.
+func Intersect(ctx context.Context, cfg Config, attestationPath, rootPath, leftPath, leftParty, rightPath, rightParty, recipientPath, outputPath string) (messages.IntersectResponseAttestationUserData, []ecies.Message, string) {
+	var recipient []byte
+	if recipientPath != "" {
+		recipient = readPublicKey(recipientPath)
+	}
+
+	batch := openBatch(ctx, cfg, attestationPath, rootPath, readCiphertexts(leftPath), readCiphertexts(rightPath))
+	defer batch.enclaveClient.Close()
+
+	req := &messages.IntersectRequest{
+		SessionId:        batch.sessionId,
+		AttestationNonce: newAttestationNonce(),
+		Left:             batch.items[0],
+		Right:            batch.items[1],
+		LeftParty:        leftParty,
+		RightParty:       rightParty,
+		Recipient:        recipient,
+	}
+	resp, _ := sendRequest(ctx, batch.enclaveClient, messages.FoobarRequest{Intersect: req})
+
+	responseAttestation, err := nitro_eclave_attestation_document.AuthenticateDocument(resp.Intersect.Attestation, *batch.rootPublicKey, true)
+	utils.PanicOnErr(err)
+	checkAttestationNonce(responseAttestation, req.AttestationNonce)
+
+	var response messages.IntersectResponseAttestationUserData
+	err = json.Unmarshal(responseAttestation.UserData, &response)
+	utils.PanicOnErr(err)
+
+	if !bytes.Equal(response.LeftDigest, messages.InputSetDigest(req.Left)) || !bytes.Equal(response.RightDigest, messages.InputSetDigest(req.Right)) {
+		utils.PanicOnErr(fmt.Errorf("attested input digests don't match the ciphertexts"))
+	}
+	if response.LeftParty != leftParty || response.RightParty != rightParty {
+		utils.PanicOnErr(fmt.Errorf("attested parties %q and %q don't match the request", response.LeftParty, response.RightParty))
+	}
+	elements := resp.Intersect.Elements
+	if recipient != nil {
+		recipientHash := sha256.Sum256(recipient)
+		if !bytes.Equal(response.RecipientHash, recipientHash[:]) {
+			utils.PanicOnErr(fmt.Errorf("attested recipient hash %02x doesn't match the recipient", response.RecipientHash))
+		}
+		if !bytes.Equal(response.ElementsHash, messages.ElementsHash(elements)) || len(elements) != response.Size {
+			utils.PanicOnErr(fmt.Errorf("attested elements hash %02x doesn't match the %d elements", response.ElementsHash, len(elements)))
+		}
+	} else if len(elements) != 0 || response.RecipientHash != nil {
+		utils.PanicOnErr(fmt.Errorf("got elements without a recipient"))
+	}
+	log.Printf("attestation valid")
+
+	fmt.Printf("Intersection size: %d\n", response.Size)
+	fmt.Printf("Rejected: %d left, %d right\n", response.LeftRejected, response.RightRejected)
+	fmt.Printf("Minimum set size: %d\n", response.MinSetSize)
+	fmt.Printf("Signed result: %s\n", resp.Intersect.SignedResult)
+
+	if recipient != nil {
+		var lines []string
+		for _, element := range elements {
+			elementBytes, err := json.Marshal(element)
+			utils.PanicOnErr(err)
+			lines = append(lines, base64.RawURLEncoding.EncodeToString(elementBytes)+"\n")
+		}
+		err = os.WriteFile(outputPath, []byte(strings.Join(lines, "")), 0644)
+		utils.PanicOnErr(err)
+		log.Printf("wrote %d sealed elements to %s", len(elements), outputPath)
+	}
+	return response, elements, resp.Intersect.SignedResult
+}
+
+// Unseal decrypts the messages of inputPath, one per line, as written by
+// Intersect or printed by ReEncrypt, with keyPath, the recipient's PEM private
+// key (PKCS #8 or SEC 1).
+func Unseal(keyPath, inputPath string) [][]byte {
+	keyPem, err := os.ReadFile(keyPath)
+	utils.PanicOnErr(err)
+	keyBlock, _ := pem.Decode(keyPem)
+	if keyBlock == nil {
+		utils.PanicOnErr(fmt.Errorf("no PEM data in %s", keyPath))
+	}
+	var key any
+	if keyBlock.Type == "EC PRIVATE KEY" {
+		key, err = x509.ParseECPrivateKey(keyBlock.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	}
+	utils.PanicOnErr(err)
+	var privateKey *ecdh.PrivateKey
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		privateKey, err = key.ECDH()
+		utils.PanicOnErr(err)
+	case *ecdh.PrivateKey:
+		privateKey = key
+	default:
+		utils.PanicOnErr(fmt.Errorf("%s is not an elliptic curve private key", keyPath))
+	}
+
+	input, err := os.ReadFile(inputPath)
+	utils.PanicOnErr(err)
+	var plaintexts [][]byte
+	for _, line := range strings.Split(string(input), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		messageBytes, err := base64.RawURLEncoding.DecodeString(line)
+		utils.PanicOnErr(err)
+		var message ecies.Message
+		err = json.Unmarshal(messageBytes, &message)
+		utils.PanicOnErr(err)
+		plaintext, err := ecies.Open(privateKey, &message, nil)
+		utils.PanicOnErr(err)
+		fmt.Printf("%s\n", plaintext)
+		plaintexts = append(plaintexts, plaintext)
+	}
+	return plaintexts
+}
+
+// readPublicKey reads a PEM public key, e.g. from openssl's -pubout, and
+// returns its DER encoding.
+func readPublicKey(path string) []byte {
+	publicKeyPem, err := os.ReadFile(path)
+	utils.PanicOnErr(err)
+	publicKeyBlock, _ := pem.Decode(publicKeyPem)
+	if publicKeyBlock == nil {
+		utils.PanicOnErr(fmt.Errorf("no PEM data in %s", path))
+	}
+	return publicKeyBlock.Bytes
+}
@@ -0,0 +1,54 @@
+package cmds
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+
+	nitro_eclave_attestation_document "github.com/alokmenghrajani/go-nitro-enclave-attestation-document"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/utils"
+)
+
+// ListKeys asks the enclave for the keys it created, verifies the attestation
+// and that it commits to the keys, and prints them. It returns the verified
+// keys.
+func ListKeys(ctx context.Context, cfg Config, rootPath string) []messages.Key {
+	root, err := os.ReadFile(rootPath)
+	utils.PanicOnErr(err)
+
+	rootPublicKeyBlock, _ := pem.Decode(root)
+	rootPublicKey, err := x509.ParseCertificate(rootPublicKeyBlock.Bytes)
+	utils.PanicOnErr(err)
+
+	enclaveClient := dialEnclave(ctx, cfg)
+	defer enclaveClient.Close()
+	resp, _ := sendRequest(ctx, enclaveClient, messages.FoobarRequest{ListKeys: &messages.ListKeysRequest{}})
+
+	attestation, err := nitro_eclave_attestation_document.AuthenticateDocument(resp.ListKeys.Attestation, *rootPublicKey, true)
+	utils.PanicOnErr(err)
+
+	var userData messages.ListKeysResponseAttestationUserData
+	err = json.Unmarshal(attestation.UserData, &userData)
+	utils.PanicOnErr(err)
+
+	keys := resp.ListKeys.Keys
+	if userData.Count != len(keys) || !bytes.Equal(userData.KeysHash, messages.KeysHash(keys)) {
+		utils.PanicOnErr(fmt.Errorf("got %d keys, the attestation commits to %d other keys", len(keys), userData.Count))
+	}
+
+	for _, key := range keys {
+		fmt.Printf("%s\n", key.KeyId)
+		fmt.Printf("  Region:      %s\n", key.Region)
+		fmt.Printf("  Created at:  %s\n", key.CreatedAt.Format(time.RFC3339))
+		fmt.Printf("  Policy hash: %02x\n", key.PolicyHash)
+		fmt.Printf("  Public key:  %s\n", base64.RawURLEncoding.EncodeToString(key.PublicKey))
+	}
+	return keys
+}
@@ -0,0 +1,109 @@
+package cmds
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	nitro_eclave_attestation_document "github.com/alokmenghrajani/go-nitro-enclave-attestation-document"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/utils"
+)
+
+// ReEncrypt has the enclave decrypt ciphertext and seal the plaintext to a
+// recipient: either recipientPath, a PEM public key the ciphertext was bound
+// to (see RecipientBinding), or the foobar key of recipientAttestationPath, a
+// create-key attestation of the same enclave image. It verifies the
+// attestation and returns the new ciphertext, in the encrypt command's format:
+// a foobar recipient decrypts it with the decrypt command. It also returns the
+// attested user data signed by the enclave, for VerifyResult.
+func ReEncrypt(ctx context.Context, cfg Config, attestationPath, rootPath, ciphertext, recipientPath, recipientAttestationPath string) (string, string) {
+	if (recipientPath == "") == (recipientAttestationPath == "") {
+		utils.PanicOnErr(fmt.Errorf("expected either a recipient or a recipient attestation"))
+	}
+
+	ciphertextMessageBytes, err := base64.RawURLEncoding.DecodeString(ciphertext)
+	utils.PanicOnErr(err)
+	input := make([]ciphertextMessage, 1)
+	err = json.Unmarshal(ciphertextMessageBytes, &input[0])
+	utils.PanicOnErr(err)
+
+	batch := openBatch(ctx, cfg, attestationPath, rootPath, input)
+	defer batch.enclaveClient.Close()
+	item := batch.items[0][0]
+
+	// The enclave verifies the recipient's attestation itself.
+	var recipient, recipientAttestation []byte
+	var recipientKeyId string
+	if recipientPath != "" {
+		recipient = readPublicKey(recipientPath)
+	} else {
+		attestationBytes, err := os.ReadFile(recipientAttestationPath)
+		utils.PanicOnErr(err)
+		attestation, err := nitro_eclave_attestation_document.AuthenticateDocument(attestationBytes, *batch.rootPublicKey, true)
+		utils.PanicOnErr(err)
+		var userData messages.CreateKeyResponseAttestationUserData
+		err = json.Unmarshal(attestation.UserData, &userData)
+		utils.PanicOnErr(err)
+		log.Printf("recipient key id: %s", userData.KeyId)
+		log.Printf("recipient PCR0: %02x", attestation.PCRs[0])
+		recipient, recipientAttestation, recipientKeyId = userData.PublicKey, attestationBytes, userData.KeyId
+	}
+
+	req := &messages.ReEncryptRequest{
+		KeyId:                 item.KeyId,
+		SessionId:             batch.sessionId,
+		EncryptedSharedSecret: item.EncryptedSharedSecret,
+		Nonce:                 item.Nonce,
+		Ciphertext:            item.Ciphertext,
+		AttestationNonce:      newAttestationNonce(),
+		OneShotUntil:          item.OneShotUntil,
+	}
+	if recipientAttestation != nil {
+		req.RecipientAttestation = recipientAttestation
+	} else {
+		req.Recipient = recipient
+	}
+	resp, _ := sendRequest(ctx, batch.enclaveClient, messages.FoobarRequest{ReEncrypt: req})
+
+	responseAttestation, err := nitro_eclave_attestation_document.AuthenticateDocument(resp.ReEncrypt.Attestation, *batch.rootPublicKey, true)
+	utils.PanicOnErr(err)
+	checkAttestationNonce(responseAttestation, req.AttestationNonce)
+
+	var response messages.ReEncryptResponseAttestationUserData
+	err = json.Unmarshal(responseAttestation.UserData, &response)
+	utils.PanicOnErr(err)
+
+	if response.KeyId != req.KeyId {
+		utils.PanicOnErr(fmt.Errorf("enclave decrypted with key %s, expected %s", response.KeyId, req.KeyId))
+	}
+	recipientHash := sha256.Sum256(recipient)
+	if !bytes.Equal(response.RecipientHash, recipientHash[:]) || response.RecipientKeyId != recipientKeyId {
+		utils.PanicOnErr(fmt.Errorf("attested recipient %s %02x doesn't match the recipient", response.RecipientKeyId, response.RecipientHash))
+	}
+	if !bytes.Equal(response.CiphertextHash, messages.CiphertextHash(resp.ReEncrypt.Ciphertext)) {
+		utils.PanicOnErr(fmt.Errorf("attested ciphertext hash %02x doesn't match the ciphertext", response.CiphertextHash))
+	}
+	log.Printf("attestation valid")
+
+	messageBytes, err := json.Marshal(resp.ReEncrypt.Ciphertext)
+	utils.PanicOnErr(err)
+	messageString := base64.RawURLEncoding.EncodeToString(messageBytes)
+	fmt.Println(messageString)
+	// The new ciphertext is the only thing on stdout, so that it can be
+	// captured.
+	log.Printf("signed result: %s", resp.ReEncrypt.SignedResult)
+	return messageString, resp.ReEncrypt.SignedResult
+}
+
+// RecipientBinding binds a ciphertext to the PEM public key at recipientPath:
+// the enclave re-encrypts it to that key only, and doesn't use it otherwise.
+func RecipientBinding(recipientPath string) messages.Binding {
+	recipientHash := sha256.Sum256(readPublicKey(recipientPath))
+	return messages.Binding{RecipientHash: recipientHash[:]}
+}
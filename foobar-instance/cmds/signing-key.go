@@ -0,0 +1,96 @@
+package cmds
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+
+	nitro_eclave_attestation_document "github.com/alokmenghrajani/go-nitro-enclave-attestation-document"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/signing"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/utils"
+)
+
+// GetSigningKey asks the enclave for its signing key, verifies the attestation
+// and writes the public key to outputPath, as PEM. Whoever trusts that file
+// can then check signed results with VerifyResult, without the Nitro PKI.
+func GetSigningKey(ctx context.Context, cfg Config, rootPath, outputPath string) messages.GetSigningKeyResponseAttestationUserData {
+	root, err := os.ReadFile(rootPath)
+	utils.PanicOnErr(err)
+
+	rootPublicKeyBlock, _ := pem.Decode(root)
+	rootPublicKey, err := x509.ParseCertificate(rootPublicKeyBlock.Bytes)
+	utils.PanicOnErr(err)
+
+	enclaveClient := dialEnclave(ctx, cfg)
+	defer enclaveClient.Close()
+	nonce := newAttestationNonce()
+	resp, _ := sendRequest(ctx, enclaveClient, messages.FoobarRequest{GetSigningKey: &messages.GetSigningKeyRequest{AttestationNonce: nonce}})
+
+	attestation, err := nitro_eclave_attestation_document.AuthenticateDocument(resp.GetSigningKey.Attestation, *rootPublicKey, true)
+	utils.PanicOnErr(err)
+	checkAttestationNonce(attestation, nonce)
+	log.Printf("attestation valid")
+	log.Printf("PCR0: %02x", attestation.PCRs[0])
+
+	var userData messages.GetSigningKeyResponseAttestationUserData
+	err = json.Unmarshal(attestation.UserData, &userData)
+	utils.PanicOnErr(err)
+
+	publicKey, err := signing.ParsePublicKey(userData.PublicKey)
+	utils.PanicOnErr(err)
+	if signing.Thumbprint(publicKey) != userData.Thumbprint {
+		utils.PanicOnErr(fmt.Errorf("attested thumbprint %s doesn't match the key", userData.Thumbprint))
+	}
+
+	err = os.WriteFile(outputPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: userData.PublicKey}), 0644)
+	utils.PanicOnErr(err)
+	fmt.Printf("Signing key thumbprint: %s\n", userData.Thumbprint)
+	return userData
+}
+
+// VerifyResult checks signedResult, as returned by decrypt, batch-decrypt,
+// aggregate, intersect or re-encrypt, with keyPath, the PEM public key written
+// by GetSigningKey. It prints and returns the verified payload.
+func VerifyResult(keyPath, signedResult string) signing.Payload {
+	publicKey, err := signing.ParsePublicKey(readPublicKey(keyPath))
+	utils.PanicOnErr(err)
+
+	payload, err := signing.Verify(publicKey, signedResult)
+	utils.PanicOnErr(err)
+	log.Printf("signature valid")
+
+	switch {
+	case payload.Result != nil:
+		fmt.Printf("%s: %s\n", payload.Result.Computation, payload.Result.Value)
+	case payload.Aggregate != nil && payload.AggregateResult != nil:
+		if !bytes.Equal(payload.Aggregate.ResultHash, payload.AggregateResult.Hash()) {
+			utils.PanicOnErr(fmt.Errorf("signed result hash %02x doesn't match the result %+v", payload.Aggregate.ResultHash, *payload.AggregateResult))
+		}
+		fmt.Printf("Aggregate: %+v\n", *payload.AggregateResult)
+	case payload.Intersect != nil:
+		fmt.Printf("Intersection size: %d\n", payload.Intersect.Size)
+		fmt.Printf("Parties: %s, %s\n", payload.Intersect.LeftParty, payload.Intersect.RightParty)
+	case payload.ReEncrypt != nil:
+		fmt.Printf("Re-encrypted ciphertext SHA-256: %02x\n", payload.ReEncrypt.CiphertextHash)
+		fmt.Printf("Recipient SHA-256: %02x\n", payload.ReEncrypt.RecipientHash)
+	default:
+		utils.PanicOnErr(fmt.Errorf("signed payload has no result"))
+	}
+	if payload.KeyId != "" {
+		fmt.Printf("Key id: %s\n", payload.KeyId)
+	}
+	fmt.Printf("Request SHA-256: %02x\n", payload.Request)
+	if payload.Result != nil {
+		fmt.Printf("Parameters SHA-256: %02x\n", payload.Result.ParametersHash)
+		if payload.Result.ModuleHash != nil {
+			fmt.Printf("Module SHA-256: %02x\n", payload.Result.ModuleHash)
+		}
+	}
+	return *payload
+}
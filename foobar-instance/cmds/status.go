@@ -0,0 +1,81 @@
+package cmds
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	nitro_eclave_attestation_document "github.com/alokmenghrajani/go-nitro-enclave-attestation-document"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/utils"
+)
+
+// Status asks the enclave for its status, verifies the attestation and that it
+// commits to the status, and prints it. It returns the verified status and
+// PCRs.
+func Status(ctx context.Context, cfg Config, rootPath string) (messages.EnclaveStatus, map[int32][]byte) {
+	root, err := os.ReadFile(rootPath)
+	utils.PanicOnErr(err)
+
+	rootPublicKeyBlock, _ := pem.Decode(root)
+	rootPublicKey, err := x509.ParseCertificate(rootPublicKeyBlock.Bytes)
+	utils.PanicOnErr(err)
+
+	enclaveClient := dialEnclave(ctx, cfg)
+	defer enclaveClient.Close()
+	resp, _ := sendRequest(ctx, enclaveClient, messages.FoobarRequest{Status: &messages.StatusRequest{}})
+
+	attestation, err := nitro_eclave_attestation_document.AuthenticateDocument(resp.Status.Attestation, *rootPublicKey, true)
+	utils.PanicOnErr(err)
+
+	var userData messages.StatusResponseAttestationUserData
+	err = json.Unmarshal(attestation.UserData, &userData)
+	utils.PanicOnErr(err)
+	status := resp.Status.Status
+	if !bytes.Equal(userData.StatusHash, status.Hash()) {
+		utils.PanicOnErr(fmt.Errorf("the attestation commits to another status"))
+	}
+
+	fmt.Printf("Build version:       %s\n", status.BuildVersion)
+	fmt.Printf("Uptime:              %s\n", time.Duration(status.UptimeMs)*time.Millisecond)
+	fmt.Printf("RSA key:             %d bits, generated at %s\n", status.RsaKey.Bits, status.RsaKey.GeneratedAt.Format(time.RFC3339))
+	fmt.Printf("RSA key fingerprint: %02x\n", status.RsaKey.Fingerprint)
+	fmt.Println("PCRs:")
+	var pcrIndexes []int
+	for i := range attestation.PCRs {
+		pcrIndexes = append(pcrIndexes, int(i))
+	}
+	sort.Ints(pcrIndexes)
+	for _, i := range pcrIndexes {
+		fmt.Printf("  %2d: %02x\n", i, attestation.PCRs[int32(i)])
+	}
+	fmt.Println("Keys:")
+	for _, keyId := range status.KeyIds {
+		fmt.Printf("  %s\n", keyId)
+	}
+	fmt.Printf("Open sessions:       %d\n", status.OpenSessions)
+	fmt.Println("Requests:")
+	printCounters(status.Requests)
+	fmt.Println("Errors:")
+	printCounters(status.Errors)
+	fmt.Printf("Panics:              %d\n", status.Health.Panics)
+
+	return status, attestation.PCRs
+}
+
+func printCounters(counters map[string]uint64) {
+	var names []string
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %-18s %d\n", name+":", counters[name])
+	}
+}
@@ -0,0 +1,1730 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nitro_eclave_attestation_document "github.com/alokmenghrajani/go-nitro-enclave-attestation-document"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/computations"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave/server"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-instance/cmds"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-instance/enclave"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/ecies"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/transport"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/wire"
+)
+
+func TestCreateKeyEncryptDecrypt(t *testing.T) {
+	for _, protocol := range []string{"json", "grpc"} {
+		t.Run(protocol, func(t *testing.T) {
+			testCreateKeyEncryptDecrypt(t, protocol == "grpc")
+		})
+	}
+}
+
+func testCreateKeyEncryptDecrypt(t *testing.T, useGrpc bool) {
+	ctx := context.Background()
+	h := newHarness(t)
+	h.cfg.Grpc = useGrpc
+
+	cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+
+	tests := []struct {
+		plaintext string
+		count     int64
+	}{
+		{"attack at dawn", 4},
+		{"", 0},
+		{"zzz", 0},
+		{"aaaaaaaaaa", 10},
+		// Larger than bufio.Scanner's 64 KiB limit, which the protocol used to
+		// rely on.
+		{strings.Repeat("ab", 100*1024), 100 * 1024},
+	}
+	for _, tt := range tests {
+		ciphertext := cmds.Encrypt(h.attestationPath, h.rootPath, tt.plaintext, 0)
+		response, expectedRequestHash, _ := cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{})
+
+		if count := resultInt(t, &response.Result); count != tt.count {
+			t.Errorf("Decrypt(%q): got count %d, want %d", tt.plaintext, count, tt.count)
+		}
+		if !bytes.Equal(response.InitialRequest, expectedRequestHash) {
+			t.Errorf("Decrypt(%q): got request hash %02x, want %02x", tt.plaintext, response.InitialRequest, expectedRequestHash)
+		}
+	}
+}
+
+// The key policy only lets KMS derive shared secrets for the enclave image
+// which created the key.
+func TestDecryptRequiresMatchingPcr0(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+
+	cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+	ciphertext := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", 0)
+
+	if err := h.simulator.SetPCR(0, bytes.Repeat([]byte{0x01}, 48)); err != nil {
+		t.Fatal(err)
+	}
+	mustPanic(t, func() {
+		cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{})
+	})
+}
+
+// The enclave can't tell which key KMS derived the shared secret with, a
+// parent instance which names another of the enclave's keys in the request
+// doesn't get a result attested under that key.
+func TestDecryptKeyIdBinding(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+
+	cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+	otherPath := filepath.Join(h.dir, "other.out")
+	cmds.CreateKey(ctx, h.cfg, testRole, otherPath, h.rootPath)
+	keys := cmds.ListKeys(ctx, h.cfg, h.rootPath)
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+	ciphertext := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", 0)
+	response, _, _ := cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{})
+
+	otherKeyId := keys[0].KeyId
+	if otherKeyId == response.KeyId {
+		otherKeyId = keys[1].KeyId
+	}
+	h.server.Use(func(next server.Handler) server.Handler {
+		return func(ctx context.Context, req *server.Request, res *messages.FoobarResponse) error {
+			if req.Decrypt != nil {
+				req.Decrypt.KeyId = otherKeyId
+			}
+			return next(ctx, req, res)
+		}
+	})
+	mustFailWith(t, messages.ErrorCodeDecryptionFailed, func() {
+		cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{})
+	})
+}
+
+// Requests sent concurrently over a single connection each get their own
+// response.
+func TestPipelinedRequests(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+
+	c, err := enclave.Dial(ctx, h.cfg.Enclave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, msgBytes, err := c.Send(ctx, messages.FoobarRequest{GetAttestation: &messages.GetAttestationRequest{}})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			var req messages.FoobarRequest
+			if err := json.Unmarshal(msgBytes, &req); err != nil {
+				t.Error(err)
+				return
+			}
+			if resp.Id != req.Id || resp.GetAttestation == nil {
+				t.Errorf("request %d: got response %d %+v", req.Id, resp.Id, resp)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Enclave errors are surfaced as *messages.Error, regardless of the protocol.
+func TestErrorCodes(t *testing.T) {
+	for _, protocol := range []string{"json", "grpc"} {
+		t.Run(protocol, func(t *testing.T) {
+			dial := enclave.Dial
+			if protocol == "grpc" {
+				dial = enclave.DialGRPC
+			}
+			testErrorCodes(t, dial)
+		})
+	}
+}
+
+func testErrorCodes(t *testing.T, dial func(context.Context, transport.Dialer) (*enclave.Client, error)) {
+	ctx := context.Background()
+	h := newHarness(t)
+
+	cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+	keyId := cmds.ListKeys(ctx, h.cfg, h.rootPath)[0].KeyId
+
+	c, err := dial(ctx, h.cfg.Enclave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Both protocols start with the handshake.
+	if c.Hello.ProtocolVersion != messages.ProtocolVersion || !slices.Contains(c.Hello.Operations, messages.OperationDecrypt) {
+		t.Errorf("got hello %+v", c.Hello)
+	}
+
+	tests := []struct {
+		name string
+		req  messages.FoobarRequest
+		code messages.ErrorCode
+	}{
+		{"missing fields", messages.FoobarRequest{CreateKey: &messages.CreateKeyRequest{}}, messages.ErrorCodeInvalidRequest},
+		{"nonce too large", messages.FoobarRequest{GetAttestation: &messages.GetAttestationRequest{AttestationNonce: make([]byte, messages.MaxAttestationNonceSize+1)}}, messages.ErrorCodeInvalidRequest},
+		{"missing key id", messages.FoobarRequest{Decrypt: &messages.DecryptRequest{EncryptedSharedSecret: []byte("garbage")}}, messages.ErrorCodeInvalidRequest},
+		{"unknown key", messages.FoobarRequest{Decrypt: &messages.DecryptRequest{KeyId: "unknown", EncryptedSharedSecret: []byte("garbage")}}, messages.ErrorCodeUnknownKey},
+		{"garbage shared secret", messages.FoobarRequest{Decrypt: &messages.DecryptRequest{KeyId: keyId, EncryptedSharedSecret: []byte("garbage")}}, messages.ErrorCodeDecryptionFailed},
+	}
+	for _, tt := range tests {
+		_, _, err := c.Send(ctx, tt.req)
+		var e *messages.Error
+		if !errors.As(err, &e) {
+			t.Errorf("%s: got %v, want a *messages.Error", tt.name, err)
+			continue
+		}
+		if e.Code != tt.code || e.Retryable {
+			t.Errorf("%s: got %+v, want code %s, not retryable", tt.name, e, tt.code)
+		}
+	}
+}
+
+// Both sides refuse a peer which speaks another protocol version.
+func TestHandshake(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+
+	conn, err := h.cfg.Enclave.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reqBytes, err := json.Marshal(messages.FoobarRequest{Hello: &messages.HelloRequest{ProtocolVersion: messages.ProtocolVersion - 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wire.WriteFrame(conn, reqBytes); err != nil {
+		t.Fatal(err)
+	}
+	resBytes, err := wire.ReadFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res messages.FoobarResponse
+	if err := json.Unmarshal(resBytes, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Error == nil || res.Error.Code != messages.ErrorCodeIncompatibleProtocol || res.Hello != nil {
+		t.Errorf("got %s, want %s", resBytes, messages.ErrorCodeIncompatibleProtocol)
+	}
+
+	tests := []struct {
+		name     string
+		response string
+		want     string
+	}{
+		{"other version", `{"hello":{"protocolVersion":4,"buildVersion":"old","operations":["decrypt"]}}`, "speaks protocol version 4"},
+		{"predates the handshake", `{"error":"unexpected command"}`, "predates protocol versioning"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := enclave.Dial(ctx, fakeEnclave(t, tt.response))
+			if err == nil || !strings.Contains(err.Error(), "incompatible enclave") || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an incompatible enclave which %s", err, tt.want)
+			}
+		})
+	}
+}
+
+// fakeEnclave answers the first request of each connection with response.
+func fakeEnclave(t *testing.T, response string) transport.Dialer {
+	endpoint := transport.Unix{Path: filepath.Join(t.TempDir(), "fake-enclave.sock")}
+	l, err := endpoint.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := wire.ReadFrame(conn); err == nil {
+				wire.WriteFrame(conn, []byte(response))
+			}
+			conn.Close()
+		}
+	}()
+	return endpoint
+}
+
+// The harness connects over a unix socket, which the Authorization middleware
+// rejects since the peer has no vsock CID.
+func TestAuthorization(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+	h.server.Use(server.Authorization([]uint32{3}))
+
+	// Even the handshake is rejected.
+	_, err := enclave.Dial(ctx, h.cfg.Enclave)
+	var e *messages.Error
+	if !errors.As(err, &e) || e.Code != messages.ErrorCodeUnauthorized {
+		t.Errorf("got %v, want %s", err, messages.ErrorCodeUnauthorized)
+	}
+}
+
+// A panicking request gets an internal error, the enclave keeps serving and
+// reports the panic in its attestations.
+func TestPanicRecovery(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+	h.server.Use(func(next server.Handler) server.Handler {
+		return func(ctx context.Context, req *server.Request, res *messages.FoobarResponse) error {
+			if req.Decrypt != nil {
+				panic("boom")
+			}
+			return next(ctx, req, res)
+		}
+	})
+
+	c, err := enclave.Dial(ctx, h.cfg.Enclave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, _, err = c.Send(ctx, messages.FoobarRequest{Decrypt: &messages.DecryptRequest{KeyId: "unknown"}})
+	var e *messages.Error
+	if !errors.As(err, &e) || e.Code != messages.ErrorCodeInternal {
+		t.Fatalf("got %v, want %s", err, messages.ErrorCodeInternal)
+	}
+
+	resp, _, err := c.Send(ctx, messages.FoobarRequest{GetAttestation: &messages.GetAttestationRequest{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := nitro_eclave_attestation_document.AuthenticateDocument(resp.GetAttestation.Attestation, *h.simulator.Root(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var userData messages.GetAttestationResponseAttestationUserData
+	if err := json.Unmarshal(doc.UserData, &userData); err != nil {
+		t.Fatal(err)
+	}
+	if userData.Health.Panics != 1 {
+		t.Errorf("got %d panics, want 1", userData.Health.Panics)
+	}
+}
+
+// blockGetAttestation makes getAttestation requests wait for release, or for
+// their context to expire.
+func blockGetAttestation(release <-chan struct{}) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(ctx context.Context, req *server.Request, res *messages.FoobarResponse) error {
+			if req.GetAttestation != nil {
+				select {
+				case <-release:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return next(ctx, req, res)
+		}
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+	h.server.Use(blockGetAttestation(nil))
+
+	c, err := enclave.Dial(ctx, h.cfg.Enclave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, _, err = c.Send(ctx, messages.FoobarRequest{TimeoutMs: 100, GetAttestation: &messages.GetAttestationRequest{}})
+	var e *messages.Error
+	if !errors.As(err, &e) || e.Code != messages.ErrorCodeDeadlineExceeded || !e.Retryable {
+		t.Errorf("got %v, want %s", err, messages.ErrorCodeDeadlineExceeded)
+	}
+}
+
+// Shutdown waits for in-flight requests, which still get their response.
+func TestGracefulShutdown(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t)
+	release := make(chan struct{})
+	h.server.Use(blockGetAttestation(release))
+
+	c, err := enclave.Dial(ctx, h.cfg.Enclave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	sent := make(chan error)
+	go func() {
+		_, _, err := c.Send(ctx, messages.FoobarRequest{GetAttestation: &messages.GetAttestationRequest{}})
+		sent <- err
+	}()
+	// Give the request time to reach the enclave.
+	time.Sleep(100 * time.Millisecond)
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- h.server.Shutdown(ctx)
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the request completed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-sent; err != nil {
+		t.Errorf("in-flight request failed: %s", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown failed: %s", err)
+	}
+	if _, err := enclave.Dial(ctx, h.cfg.Enclave); err == nil {
+		t.Errorf("Dial succeeded after Shutdown")
+	}
+}
+
+// Connections beyond MaxConnections wait for another one to close.
+func TestConnectionLimit(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t, func(s *server.Server) {
+		s.MaxConnections = 1
+	})
+
+	first, err := enclave.Dial(ctx, h.cfg.Enclave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialed := make(chan error)
+	go func() {
+		c, err := enclave.Dial(ctx, h.cfg.Enclave)
+		if err == nil {
+			_, _, err = c.Send(ctx, messages.FoobarRequest{GetAttestation: &messages.GetAttestationRequest{}})
+			c.Close()
+		}
+		dialed <- err
+	}()
+	select {
+	case err := <-dialed:
+		t.Fatalf("second connection served while the first is open: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case err := <-dialed:
+		if err != nil {
+			t.Errorf("second connection failed: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second connection not served after the first closed")
+	}
+}
+
+// A frame's payload is only read once it fits in MaxBufferedBytes, however
+// many request slots are free.
+func TestBufferedBytesLimit(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t, func(s *server.Server) {
+		s.MaxBufferedBytes = wire.MaxFrameSize
+	})
+
+	// Announce the largest frame and stall: the whole budget is reserved.
+	first, err := h.cfg.Enclave.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], wire.MaxFrameSize)
+	if _, err := first.Write(header[:]); err != nil {
+		t.Fatal(err)
+	}
+	// Give the header time to reach the enclave.
+	time.Sleep(100 * time.Millisecond)
+
+	// Even the handshake waits.
+	sent := make(chan error)
+	go func() {
+		c, err := enclave.Dial(ctx, h.cfg.Enclave)
+		if err == nil {
+			_, _, err = c.Send(ctx, messages.FoobarRequest{GetAttestation: &messages.GetAttestationRequest{}})
+			c.Close()
+		}
+		sent <- err
+	}()
+	select {
+	case err := <-sent:
+		t.Fatalf("request served while the budget is reserved: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Errorf("request failed: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not served after the budget was given back")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	for _, protocol := range []string{"json", "grpc"} {
+		t.Run(protocol, func(t *testing.T) {
+			ctx := context.Background()
+			h := newHarness(t)
+			h.cfg.Grpc = protocol == "grpc"
+
+			cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+			ciphertext := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", 0)
+			cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{})
+
+			// The status doesn't fit in the attestation's user data anymore.
+			for i := 0; i < 5; i++ {
+				cmds.CreateKey(ctx, h.cfg, testRole, filepath.Join(h.dir, fmt.Sprintf("attestation-%d.out", i)), h.rootPath)
+			}
+			cmds.GetSigningKey(ctx, h.cfg, h.rootPath, filepath.Join(h.dir, "signing-key.pem"))
+
+			status, pcrs := cmds.Status(ctx, h.cfg, h.rootPath)
+			if len(status.KeyIds) != 6 {
+				t.Errorf("got keys %v, want 6 keys", status.KeyIds)
+			}
+			if status.Requests[messages.OperationCreateKey] != 6 || status.Requests[messages.OperationDecrypt] != 1 {
+				t.Errorf("got requests %v, want 6 createKey and 1 decrypt", status.Requests)
+			}
+			if len(status.Errors) != 0 {
+				t.Errorf("got errors %v, want none", status.Errors)
+			}
+			if len(status.RsaKey.Fingerprint) != 32 || status.RsaKey.Bits != 2048 {
+				t.Errorf("got RSA key %+v, want a 2048 bits key and a SHA-256 fingerprint", status.RsaKey)
+			}
+			if !bytes.Equal(pcrs[0], testPcr0) {
+				t.Errorf("got PCR0 %02x, want %02x", pcrs[0], testPcr0)
+			}
+		})
+	}
+}
+
+// The enclave keeps track of the keys it creates, and reports the key it
+// decrypted with.
+func TestListKeys(t *testing.T) {
+	for _, protocol := range []string{"json", "grpc"} {
+		t.Run(protocol, func(t *testing.T) {
+			ctx := context.Background()
+			h := newHarness(t)
+			h.cfg.Grpc = protocol == "grpc"
+
+			if keys := cmds.ListKeys(ctx, h.cfg, h.rootPath); len(keys) != 0 {
+				t.Fatalf("got keys %+v, want none", keys)
+			}
+
+			cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+			attestationBytes, err := os.ReadFile(h.attestationPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, err := nitro_eclave_attestation_document.AuthenticateDocument(attestationBytes, *h.simulator.Root(), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var created messages.CreateKeyResponseAttestationUserData
+			if err := json.Unmarshal(doc.UserData, &created); err != nil {
+				t.Fatal(err)
+			}
+
+			// The keys don't all fit in the attestation's user data.
+			for i := 0; i < 4; i++ {
+				cmds.CreateKey(ctx, h.cfg, testRole, filepath.Join(h.dir, fmt.Sprintf("attestation-%d.out", i)), h.rootPath)
+			}
+
+			keys := cmds.ListKeys(ctx, h.cfg, h.rootPath)
+			if len(keys) != 5 {
+				t.Fatalf("got keys %+v, want 5 keys", keys)
+			}
+			key := keys[0]
+			if key.KeyId != created.KeyId || key.Region != testRegion || !bytes.Equal(key.PublicKey, created.PublicKey) {
+				t.Errorf("got key %+v, want the key from the create-key attestation %+v", key, created)
+			}
+			for _, key := range keys {
+				if len(key.PolicyHash) != 32 || key.CreatedAt.IsZero() {
+					t.Errorf("got policy hash %02x and creation time %s", key.PolicyHash, key.CreatedAt)
+				}
+			}
+
+			ciphertext := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", 0)
+			response, _, _ := cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{})
+			if response.KeyId != created.KeyId {
+				t.Errorf("got key id %s, want %s", response.KeyId, created.KeyId)
+			}
+		})
+	}
+}
+
+// A restarted enclave forgets its keys. They are registered again from their
+// createKey attestation, if the same enclave image produced it.
+func TestRegisterKey(t *testing.T) {
+	for _, protocol := range []string{"json", "grpc"} {
+		t.Run(protocol, func(t *testing.T) {
+			ctx := context.Background()
+			h := newHarness(t)
+			h.cfg.Grpc = protocol == "grpc"
+
+			cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+			created := cmds.ListKeys(ctx, h.cfg, h.rootPath)[0]
+			ciphertext := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", 0)
+
+			// A key created by another enclave image.
+			otherPcr0 := bytes.Repeat([]byte{0xaa}, 48)
+			otherAttestationPath := filepath.Join(h.dir, "other-attestation.out")
+			h.simulator.SetPCR(0, otherPcr0)
+			cmds.CreateKey(ctx, h.cfg, testRole, otherAttestationPath, h.rootPath)
+			h.simulator.SetPCR(0, testPcr0)
+
+			// A key created by an enclave with another NSM root.
+			other := newHarness(t)
+			cmds.CreateKey(ctx, other.cfg, testRole, other.attestationPath, other.rootPath)
+
+			h.restart(t)
+			if keys := cmds.ListKeys(ctx, h.cfg, h.rootPath); len(keys) != 0 {
+				t.Fatalf("got keys %+v after a restart, want none", keys)
+			}
+
+			response, _, _ := cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{})
+			if response.KeyId != created.KeyId || resultInt(t, &response.Result) != 4 {
+				t.Errorf("got %+v, want a count of 4 with key %s", response, created.KeyId)
+			}
+			keys := cmds.ListKeys(ctx, h.cfg, h.rootPath)
+			if len(keys) != 1 || keys[0].KeyId != created.KeyId || !bytes.Equal(keys[0].PolicyHash, created.PolicyHash) || !bytes.Equal(keys[0].PublicKey, created.PublicKey) {
+				t.Errorf("got keys %+v, want %+v", keys, created)
+			}
+
+			dial := enclave.Dial
+			if protocol == "grpc" {
+				dial = enclave.DialGRPC
+			}
+			c, err := dial(ctx, h.cfg.Enclave)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			resp, _, err := c.Send(ctx, messages.FoobarRequest{GetSigningKey: &messages.GetSigningKeyRequest{}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			signingKeyAttestation := resp.GetSigningKey.Attestation
+			tests := []struct {
+				name            string
+				attestationPath string
+				attestation     []byte
+				code            messages.ErrorCode
+			}{
+				{"other PCR0", otherAttestationPath, nil, messages.ErrorCodeAttestationRejected},
+				{"other root", other.attestationPath, nil, messages.ErrorCodeAttestationRejected},
+				{"not a createKey attestation", "", signingKeyAttestation, messages.ErrorCodeInvalidRequest},
+				{"garbage", "", []byte("garbage"), messages.ErrorCodeAttestationRejected},
+			}
+			for _, tt := range tests {
+				attestation := tt.attestation
+				if tt.attestationPath != "" {
+					if attestation, err = os.ReadFile(tt.attestationPath); err != nil {
+						t.Fatal(err)
+					}
+				}
+				_, _, err := c.Send(ctx, messages.FoobarRequest{RegisterKey: &messages.RegisterKeyRequest{Attestation: attestation}})
+				var e *messages.Error
+				if !errors.As(err, &e) || e.Code != tt.code {
+					t.Errorf("%s: got %v, want %s", tt.name, err, tt.code)
+				}
+			}
+			if keys := cmds.ListKeys(ctx, h.cfg, h.rootPath); len(keys) != 1 {
+				t.Errorf("got keys %+v, want 1 key", keys)
+			}
+		})
+	}
+}
+
+// After a rotation, the previous RSA key keeps decrypting during the overlap
+// only.
+func TestRsaKeyRotation(t *testing.T) {
+	tests := []struct {
+		name    string
+		overlap time.Duration
+		works   bool
+	}{
+		{"within overlap", 10 * time.Minute, true},
+		{"without overlap", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := newHarness(t, func(s *server.Server) {
+				s.RsaKeyOverlap = tt.overlap
+				// Ignore decrypt sessions, as enclaves which predate them do,
+				// so that KMS encrypts to the current key. Rotate between KMS
+				// encrypting the shared secret and the enclave decrypting it.
+				s.Use(func(next server.Handler) server.Handler {
+					return func(ctx context.Context, req *server.Request, res *messages.FoobarResponse) error {
+						if req.GetAttestation != nil {
+							req.GetAttestation.OpenSession = false
+						}
+						if req.Decrypt != nil {
+							if err := s.RotateRsaKey(); err != nil {
+								return err
+							}
+						}
+						return next(ctx, req, res)
+					}
+				})
+			})
+
+			cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+			before := getRsaKey(t, h)
+			ciphertext := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", 0)
+			if tt.works {
+				cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{})
+			} else {
+				mustPanic(t, func() {
+					cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{})
+				})
+			}
+
+			after := getRsaKey(t, h)
+			if bytes.Equal(after.Fingerprint, before.Fingerprint) || !after.GeneratedAt.After(before.GeneratedAt) {
+				t.Errorf("got key %+v after the rotation, want a newer key than %+v", after, before)
+			}
+		})
+	}
+}
+
+func TestRsaKeySize(t *testing.T) {
+	h := newHarness(t, func(s *server.Server) {
+		s.RsaKeySize = 3072
+	})
+	if key := getRsaKey(t, h); key.Bits != 3072 {
+		t.Errorf("got a %d bits key, want 3072", key.Bits)
+	}
+}
+
+// getRsaKey returns the RSA key in a fresh attestation, after checking that
+// the attested fingerprint matches the attested public key.
+func getRsaKey(t *testing.T, h *harness) messages.RsaKey {
+	t.Helper()
+	ctx := context.Background()
+	c, err := enclave.Dial(ctx, h.cfg.Enclave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	resp, _, err := c.Send(ctx, messages.FoobarRequest{GetAttestation: &messages.GetAttestationRequest{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := nitro_eclave_attestation_document.AuthenticateDocument(resp.GetAttestation.Attestation, *h.simulator.Root(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var userData messages.GetAttestationResponseAttestationUserData
+	if err := json.Unmarshal(doc.UserData, &userData); err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := sha256.Sum256(doc.PublicKey)
+	if !bytes.Equal(userData.RsaKey.Fingerprint, fingerprint[:]) {
+		t.Errorf("got fingerprint %02x, want %02x", userData.RsaKey.Fingerprint, fingerprint)
+	}
+	return userData.RsaKey
+}
+
+// The RSA key of a decrypt session only decrypts once, and only until the
+// session expires.
+func TestDecryptSession(t *testing.T) {
+	t.Run("single use", func(t *testing.T) {
+		ctx := context.Background()
+		var mu sync.Mutex
+		var decrypts []messages.DecryptRequest
+		h := newHarness(t, func(s *server.Server) {
+			s.Use(func(next server.Handler) server.Handler {
+				return func(ctx context.Context, req *server.Request, res *messages.FoobarResponse) error {
+					if req.Decrypt != nil {
+						mu.Lock()
+						decrypts = append(decrypts, *req.Decrypt)
+						mu.Unlock()
+					}
+					return next(ctx, req, res)
+				}
+			})
+		})
+
+		cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+		ciphertext := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", 0)
+		cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{})
+		if len(decrypts) != 1 || decrypts[0].SessionId == "" {
+			t.Fatalf("got decrypt requests %+v, want 1 request with a session", decrypts)
+		}
+
+		c, err := enclave.Dial(ctx, h.cfg.Enclave)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		_, _, err = c.Send(ctx, messages.FoobarRequest{Decrypt: &decrypts[0]})
+		var e *messages.Error
+		if !errors.As(err, &e) || e.Code != messages.ErrorCodeSessionNotFound {
+			t.Errorf("replay: got %v, want %s", err, messages.ErrorCodeSessionNotFound)
+		}
+
+		if status, _ := cmds.Status(ctx, h.cfg, h.rootPath); status.OpenSessions != 0 {
+			t.Errorf("got %d open sessions, want 0", status.OpenSessions)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		ctx := context.Background()
+		h := newHarness(t, func(s *server.Server) {
+			s.DecryptSessionTTL = time.Nanosecond
+		})
+
+		cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+		ciphertext := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", 0)
+		mustPanic(t, func() {
+			cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{})
+		})
+	})
+
+	// Sessions expire without traffic, and only MaxDecryptSessions can be
+	// open at a time.
+	t.Run("limits", func(t *testing.T) {
+		ctx := context.Background()
+		h := newHarness(t, func(s *server.Server) {
+			s.DecryptSessionTTL = 2 * time.Second
+			s.MaxDecryptSessions = 2
+		})
+
+		c, err := enclave.Dial(ctx, h.cfg.Enclave)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		openSession := func() error {
+			_, _, err := c.Send(ctx, messages.FoobarRequest{GetAttestation: &messages.GetAttestationRequest{OpenSession: true}})
+			return err
+		}
+		for i := 0; i < 2; i++ {
+			if err := openSession(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var e *messages.Error
+		if err := openSession(); !errors.As(err, &e) || e.Code != messages.ErrorCodeUnavailable || !e.Retryable {
+			t.Errorf("got %v, want a retryable %s", err, messages.ErrorCodeUnavailable)
+		}
+
+		time.Sleep(3 * time.Second)
+		if status, _ := cmds.Status(ctx, h.cfg, h.rootPath); status.OpenSessions != 0 {
+			t.Errorf("got %d open sessions, want 0", status.OpenSessions)
+		}
+		if err := openSession(); err != nil {
+			t.Errorf("after the sessions expired: got %v", err)
+		}
+	})
+}
+
+// The enclave attests the client's nonce, the commands reject attestations
+// which carry a different one.
+func TestAttestationNonce(t *testing.T) {
+	for _, protocol := range []string{"json", "grpc"} {
+		t.Run(protocol, func(t *testing.T) {
+			ctx := context.Background()
+			h := newHarness(t)
+			dial := enclave.Dial
+			if protocol == "grpc" {
+				dial = enclave.DialGRPC
+			}
+			c, err := dial(ctx, h.cfg.Enclave)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			nonce := []byte("some nonce")
+			resp, _, err := c.Send(ctx, messages.FoobarRequest{GetAttestation: &messages.GetAttestationRequest{AttestationNonce: nonce}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, err := nitro_eclave_attestation_document.AuthenticateDocument(resp.GetAttestation.Attestation, *h.simulator.Root(), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(doc.Nonce, nonce) {
+				t.Errorf("got nonce %q, want %q", doc.Nonce, nonce)
+			}
+		})
+	}
+
+	// Stands in for a replayed response: the attestation is genuine, but
+	// carries another nonce.
+	replay := func(s *server.Server) {
+		s.Use(func(next server.Handler) server.Handler {
+			return func(ctx context.Context, req *server.Request, res *messages.FoobarResponse) error {
+				switch {
+				case req.CreateKey != nil:
+					req.CreateKey.AttestationNonce = []byte("old nonce")
+				case req.Decrypt != nil:
+					req.Decrypt.AttestationNonce = []byte("old nonce")
+				}
+				return next(ctx, req, res)
+			}
+		})
+	}
+
+	t.Run("create-key replay", func(t *testing.T) {
+		h := newHarness(t, replay)
+		mustPanic(t, func() {
+			cmds.CreateKey(context.Background(), h.cfg, testRole, h.attestationPath, h.rootPath)
+		})
+	})
+
+	t.Run("decrypt replay", func(t *testing.T) {
+		ctx := context.Background()
+		h := newHarness(t)
+		cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+		ciphertext := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", 0)
+		replay(h.server)
+		mustPanic(t, func() {
+			cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{})
+		})
+	})
+}
+
+// One-shot ciphertexts are decrypted once, reusable ones any number of times.
+func TestOneShotCiphertext(t *testing.T) {
+	for _, protocol := range []string{"json", "grpc"} {
+		t.Run(protocol, func(t *testing.T) {
+			ctx := context.Background()
+			h := newHarness(t)
+			h.cfg.Grpc = protocol == "grpc"
+			cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+
+			reusable := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", 0)
+			cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, reusable, cmds.Computation{})
+			cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, reusable, cmds.Computation{})
+
+			oneShot := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", time.Hour)
+			cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, oneShot, cmds.Computation{})
+			mustFailWith(t, messages.ErrorCodeReplay, func() {
+				cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, oneShot, cmds.Computation{})
+			})
+		})
+	}
+
+	// Every operation which decrypts goes through the replay cache, a
+	// ciphertext used up by one can't be used by another.
+	t.Run("every operation", func(t *testing.T) {
+		ctx := context.Background()
+		h := newHarness(t, func(s *server.Server) { s.MinIntersectSetSize = 1 })
+		cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+		write := func(name string, ciphertexts ...string) string {
+			path := filepath.Join(h.dir, name)
+			if err := os.WriteFile(path, []byte(strings.Join(ciphertexts, "\n")+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			return path
+		}
+
+		oneShot := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", time.Hour)
+		cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, oneShot, cmds.Computation{})
+		results := cmds.BatchDecrypt(ctx, h.cfg, h.attestationPath, h.rootPath, write("batch.txt", oneShot), filepath.Join(h.dir, "receipts.json"), cmds.Computation{})
+		if e := results[0].Error; e == nil || e.Code != messages.ErrorCodeReplay {
+			t.Errorf("batch-decrypt: got %v, want %s", e, messages.ErrorCodeReplay)
+		}
+
+		aggregatePath := write("aggregate.txt",
+			cmds.EncryptBound(h.attestationPath, h.rootPath, "1", time.Hour, messages.Binding{Purpose: messages.PurposeAggregate}),
+			cmds.EncryptBound(h.attestationPath, h.rootPath, "2", 0, messages.Binding{Purpose: messages.PurposeAggregate}))
+		cmds.Aggregate(ctx, h.cfg, h.attestationPath, h.rootPath, aggregatePath, messages.AggregateParameters{})
+		if got, _ := cmds.Aggregate(ctx, h.cfg, h.attestationPath, h.rootPath, aggregatePath, messages.AggregateParameters{}); got.Count != 1 || got.Rejected == nil || *got.Rejected != 1 {
+			t.Errorf("aggregate: got %+v, want a count of 1 and 1 rejected", got)
+		}
+
+		leftPath := write("left.txt",
+			cmds.EncryptBound(h.attestationPath, h.rootPath, "bob", time.Hour, messages.Binding{Party: "alice"}),
+			cmds.EncryptBound(h.attestationPath, h.rootPath, "carol", 0, messages.Binding{Party: "alice"}))
+		rightPath := write("right.txt", cmds.EncryptBound(h.attestationPath, h.rootPath, "bob", 0, messages.Binding{Party: "bob"}))
+		outputPath := filepath.Join(h.dir, "intersection.txt")
+		cmds.Intersect(ctx, h.cfg, h.attestationPath, h.rootPath, leftPath, "alice", rightPath, "bob", "", outputPath)
+		if got, _, _ := cmds.Intersect(ctx, h.cfg, h.attestationPath, h.rootPath, leftPath, "alice", rightPath, "bob", "", outputPath); got.Size != 0 || got.LeftRejected != 1 {
+			t.Errorf("intersect: got %+v, want a size of 0 and 1 rejected on the left", got)
+		}
+	})
+
+	// The one-shot flag is authenticated, it can't be dropped.
+	t.Run("flag removed", func(t *testing.T) {
+		ctx := context.Background()
+		h := newHarness(t, func(s *server.Server) {
+			s.Use(func(next server.Handler) server.Handler {
+				return func(ctx context.Context, req *server.Request, res *messages.FoobarResponse) error {
+					if req.Decrypt != nil {
+						req.Decrypt.OneShotUntil = 0
+					}
+					return next(ctx, req, res)
+				}
+			})
+		})
+		cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+		oneShot := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", time.Hour)
+		mustFailWith(t, messages.ErrorCodeDecryptionFailed, func() {
+			cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, oneShot, cmds.Computation{})
+		})
+	})
+
+	// The enclave only remembers ciphertexts for ReplayWindow.
+	t.Run("beyond replay window", func(t *testing.T) {
+		ctx := context.Background()
+		h := newHarness(t, func(s *server.Server) {
+			s.ReplayWindow = time.Minute
+		})
+		cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+		oneShot := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", time.Hour)
+		mustFailWith(t, messages.ErrorCodeInvalidRequest, func() {
+			cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, oneShot, cmds.Computation{})
+		})
+	})
+}
+
+func TestBatchDecrypt(t *testing.T) {
+	for _, protocol := range []string{"json", "grpc"} {
+		t.Run(protocol, func(t *testing.T) {
+			ctx := context.Background()
+			h := newHarness(t, func(s *server.Server) {
+				s.ReplayWindow = time.Minute
+			})
+			h.cfg.Grpc = protocol == "grpc"
+			cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+
+			// A one-shot ciphertext appears twice: one of the copies fails,
+			// the other doesn't. Another one expires beyond the replay window.
+			oneShot := cmds.Encrypt(h.attestationPath, h.rootPath, "aa", 30*time.Second)
+			ciphertexts := []string{
+				cmds.Encrypt(h.attestationPath, h.rootPath, "banana", 0),
+				cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", 0),
+				oneShot,
+				cmds.Encrypt(h.attestationPath, h.rootPath, "a", time.Hour),
+				oneShot,
+			}
+			inputPath := filepath.Join(h.dir, "ciphertexts.txt")
+			if err := os.WriteFile(inputPath, []byte(strings.Join(ciphertexts, "\n")+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			receiptsPath := filepath.Join(h.dir, "receipts.json")
+
+			results := cmds.BatchDecrypt(ctx, h.cfg, h.attestationPath, h.rootPath, inputPath, receiptsPath, cmds.Computation{})
+			if len(results) != len(ciphertexts) {
+				t.Fatalf("got %d results, want %d", len(results), len(ciphertexts))
+			}
+			for i, want := range []int64{3, 4} {
+				if results[i].Error != nil || resultInt(t, results[i].Result) != want {
+					t.Errorf("result %d: got %v (%v), want %d", i, results[i].Result, results[i].Error, want)
+				}
+			}
+			if e := results[3].Error; e == nil || e.Code != messages.ErrorCodeInvalidRequest {
+				t.Errorf("result 3: got %v, want %s", e, messages.ErrorCodeInvalidRequest)
+			}
+			first, second := results[2], results[4]
+			if first.Error != nil {
+				first, second = second, first
+			}
+			if first.Error != nil || resultInt(t, first.Result) != 2 || second.Error == nil || second.Error.Code != messages.ErrorCodeReplay {
+				t.Errorf("one-shot copies: got %+v and %+v, want a count of 2 and %s", first, second, messages.ErrorCodeReplay)
+			}
+
+			// The session ended with the batch.
+			if status, _ := cmds.Status(ctx, h.cfg, h.rootPath); status.OpenSessions != 0 {
+				t.Errorf("got %d open sessions, want 0", status.OpenSessions)
+			}
+
+			// Receipts can be verified on their own, and can't be altered.
+			for i := range ciphertexts {
+				if got := cmds.VerifyReceipt(h.rootPath, receiptsPath, i); !reflect.DeepEqual(got, results[i]) {
+					t.Errorf("receipt %d: got %+v, want %+v", i, got, results[i])
+				}
+			}
+			receiptsBytes, err := os.ReadFile(receiptsPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var receipts []cmds.Receipt
+			if err := json.Unmarshal(receiptsBytes, &receipts); err != nil {
+				t.Fatal(err)
+			}
+			receipts[1].Result.Result.Value = messages.IntValue(5)
+			receipts[0].Index = 2
+			tamperedPath := filepath.Join(h.dir, "tampered.json")
+			tamperedBytes, _ := json.Marshal(receipts)
+			if err := os.WriteFile(tamperedPath, tamperedBytes, 0644); err != nil {
+				t.Fatal(err)
+			}
+			mustPanic(t, func() { cmds.VerifyReceipt(h.rootPath, tamperedPath, 0) })
+			mustPanic(t, func() { cmds.VerifyReceipt(h.rootPath, tamperedPath, 1) })
+		})
+	}
+}
+
+// Batches which take longer than the session lives, or than KMS accepts an
+// attestation, have the enclave attest the session again.
+func TestBatchDecryptRefresh(t *testing.T) {
+	ctx := context.Background()
+	var refreshes atomic.Int32
+	h := newHarness(t, func(s *server.Server) {
+		s.DecryptSessionTTL = 300 * time.Millisecond
+		s.Use(func(next server.Handler) server.Handler {
+			return func(ctx context.Context, req *server.Request, res *messages.FoobarResponse) error {
+				if req.GetAttestation != nil && req.GetAttestation.SessionId != "" {
+					refreshes.Add(1)
+					time.Sleep(100 * time.Millisecond)
+				}
+				return next(ctx, req, res)
+			}
+		})
+	})
+	h.cfg.AttestationRefresh = time.Nanosecond
+	cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+
+	var ciphertexts []string
+	for i := 0; i < 5; i++ {
+		ciphertexts = append(ciphertexts, cmds.Encrypt(h.attestationPath, h.rootPath, strings.Repeat("a", i), 0))
+	}
+	inputPath := filepath.Join(h.dir, "ciphertexts.txt")
+	if err := os.WriteFile(inputPath, []byte(strings.Join(ciphertexts, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	results := cmds.BatchDecrypt(ctx, h.cfg, h.attestationPath, h.rootPath, inputPath, filepath.Join(h.dir, "receipts.json"), cmds.Computation{})
+	for i, result := range results {
+		if result.Error != nil || resultInt(t, result.Result) != int64(i) {
+			t.Errorf("result %d: got %v (%v), want %d", i, result.Result, result.Error, i)
+		}
+	}
+	if got := refreshes.Load(); got != int32(len(ciphertexts)) {
+		t.Errorf("got %d refreshes, want %d", got, len(ciphertexts))
+	}
+
+	// A session which is gone can't be refreshed.
+	c, err := enclave.Dial(ctx, h.cfg.Enclave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, _, err = c.Send(ctx, messages.FoobarRequest{GetAttestation: &messages.GetAttestationRequest{SessionId: "unknown"}})
+	var e *messages.Error
+	if !errors.As(err, &e) || e.Code != messages.ErrorCodeSessionNotFound {
+		t.Errorf("got %v, want %s", err, messages.ErrorCodeSessionNotFound)
+	}
+}
+
+// A computation which reverses the plaintext, registered by the test.
+type reverse struct{}
+
+func (reverse) Validate(parameters []byte) error {
+	return nil
+}
+
+func (reverse) Run(ctx context.Context, plaintext []byte, parameters []byte) (messages.Value, error) {
+	reversed := make([]byte, len(plaintext))
+	for i, b := range plaintext {
+		reversed[len(plaintext)-1-i] = b
+	}
+	return messages.BytesValue(reversed), nil
+}
+
+func TestComputations(t *testing.T) {
+	for _, protocol := range []string{"json", "grpc"} {
+		t.Run(protocol, func(t *testing.T) {
+			ctx := context.Background()
+			h := newHarness(t, func(s *server.Server) {
+				if err := s.Computations.Register("reverse", reverse{}); err != nil {
+					t.Fatal(err)
+				}
+			})
+			h.cfg.Grpc = protocol == "grpc"
+			cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+			ciphertext := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", 0)
+
+			tests := []struct {
+				computation string
+				parameters  string
+				want        messages.Value
+			}{
+				{"", "", messages.IntValue(4)},
+				{"count", "", messages.IntValue(4)},
+				{"count", `{"byte": "t"}`, messages.IntValue(3)},
+				{"length", "", messages.IntValue(14)},
+				{"reverse", "", messages.BytesValue([]byte("nwad ta kcatta"))},
+			}
+			for _, tt := range tests {
+				response, _, _ := cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{Name: tt.computation, Parameters: []byte(tt.parameters)})
+				want := tt.computation
+				if want == "" {
+					want = messages.DefaultComputation
+				}
+				if response.Result.Computation != want || !bytes.Equal(response.Result.ParametersHash, messages.ParametersHash([]byte(tt.parameters))) {
+					t.Errorf("%s(%s): got computation %s with parameters %02x", tt.computation, tt.parameters, response.Result.Computation, response.Result.ParametersHash)
+				}
+				if !reflect.DeepEqual(response.Result.Value, tt.want) {
+					t.Errorf("%s(%s): got %s %s, want %s %s", tt.computation, tt.parameters, response.Result.Type, response.Result.Value, tt.want.Type, tt.want)
+				}
+			}
+
+			mustFailWith(t, messages.ErrorCodeInvalidRequest, func() {
+				cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{Name: "unknown"})
+			})
+			mustFailWith(t, messages.ErrorCodeInvalidRequest, func() {
+				cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{Name: "count", Parameters: []byte(`{"byte": "ab"}`)})
+			})
+			mustFailWith(t, messages.ErrorCodeInvalidRequest, func() {
+				cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{Name: "length", Parameters: []byte(`{}`)})
+			})
+		})
+	}
+}
+
+func TestWasmComputation(t *testing.T) {
+	countModule := wasmModule(wasmOptions{compute: wasmCount})
+	for _, protocol := range []string{"json", "grpc"} {
+		t.Run(protocol, func(t *testing.T) {
+			ctx := context.Background()
+			h := newHarness(t, func(s *server.Server) {
+				err := s.Computations.SetWasmLimits(computations.WasmLimits{MemoryPages: 1, Fuel: 1000, Timeout: 200 * time.Millisecond})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.Computations.RegisterWasm(ctx, "count-wasm", countModule); err != nil {
+					t.Fatal(err)
+				}
+			})
+			h.cfg.Grpc = protocol == "grpc"
+			cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+			ciphertext := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", 0)
+
+			// Sent with the request, or registered in the enclave.
+			for _, computation := range []cmds.Computation{
+				{WasmModule: countModule, Parameters: []byte("t")},
+				{Name: "count-wasm", Parameters: []byte("t")},
+			} {
+				response, _, _ := cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, computation)
+				if !bytes.Equal(response.Result.ModuleHash, messages.ModuleHash(countModule)) {
+					t.Errorf("%s: got module hash %02x, want %02x", response.Result.Computation, response.Result.ModuleHash, messages.ModuleHash(countModule))
+				}
+				if want := messages.BytesValue([]byte{3, 0, 0, 0}); !reflect.DeepEqual(response.Result.Value, want) {
+					t.Errorf("%s: got %s, want %s", response.Result.Computation, response.Result.Value, want)
+				}
+			}
+
+			// Larger than gRPC's default message size limit.
+			paddedModule := wasmModule(wasmOptions{compute: wasmCount, padding: 5 << 20})
+			response, _, _ := cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{WasmModule: paddedModule, Parameters: []byte("t")})
+			if want := messages.BytesValue([]byte{3, 0, 0, 0}); !reflect.DeepEqual(response.Result.Value, want) {
+				t.Errorf("padded module: got %s, want %s", response.Result.Value, want)
+			}
+
+			// Built-in computations don't have a module hash.
+			response, _, _ = cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{})
+			if response.Result.ModuleHash != nil {
+				t.Errorf("got module hash %02x for %s", response.Result.ModuleHash, response.Result.Computation)
+			}
+
+			tests := []struct {
+				name        string
+				computation cmds.Computation
+				code        messages.ErrorCode
+			}{
+				{"out of fuel", cmds.Computation{WasmModule: wasmModule(wasmOptions{compute: wasmCalls})}, messages.ErrorCodeComputationFailed},
+				{"trap", cmds.Computation{WasmModule: wasmModule(wasmOptions{compute: wasmTrap})}, messages.ErrorCodeComputationFailed},
+				{"too much memory", cmds.Computation{WasmModule: wasmModule(wasmOptions{compute: wasmCount, memoryPages: 2})}, messages.ErrorCodeInvalidRequest},
+				{"imports", cmds.Computation{WasmModule: wasmModule(wasmOptions{compute: wasmCount, importFunction: true})}, messages.ErrorCodeInvalidRequest},
+				{"garbage", cmds.Computation{WasmModule: []byte("garbage")}, messages.ErrorCodeInvalidRequest},
+				{"named computation", cmds.Computation{Name: "count", WasmModule: countModule}, messages.ErrorCodeInvalidRequest},
+				{"large output", cmds.Computation{WasmModule: wasmModule(wasmOptions{compute: wasmLarge})}, messages.ErrorCodeResultTooLarge},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					mustFailWith(t, tt.code, func() {
+						cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, tt.computation)
+					})
+				})
+			}
+
+			// Fuel only counts calls: a loop which doesn't call anything runs
+			// until the timeout stops it.
+			start := time.Now()
+			func() {
+				defer func() {
+					if r := recover(); !strings.Contains(fmt.Sprint(r), string(messages.ErrorCodeComputationFailed)) || !strings.Contains(fmt.Sprint(r), "ran for more than 200ms") {
+						t.Errorf("loop without calls: got %v, want the run timed out", r)
+					}
+				}()
+				cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{WasmModule: wasmModule(wasmOptions{compute: wasmSpin})})
+			}()
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("loop without calls ran for %s", elapsed)
+			}
+
+			// Batch results aren't in the attestation, they can be larger.
+			inputPath := filepath.Join(h.dir, "ciphertexts.txt")
+			if err := os.WriteFile(inputPath, []byte(ciphertext+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			largeModule := wasmModule(wasmOptions{compute: wasmLarge})
+			results := cmds.BatchDecrypt(ctx, h.cfg, h.attestationPath, h.rootPath, inputPath, filepath.Join(h.dir, "receipts.json"), cmds.Computation{WasmModule: largeModule})
+			if want := messages.BytesValue(make([]byte, 400)); results[0].Result == nil || !reflect.DeepEqual(results[0].Result.Value, want) {
+				t.Errorf("got %+v, want 400 zero bytes", results[0])
+			}
+		})
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	for _, protocol := range []string{"json", "grpc"} {
+		t.Run(protocol, func(t *testing.T) {
+			ctx := context.Background()
+			h := newHarness(t)
+			h.cfg.Grpc = protocol == "grpc"
+			cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+
+			var ciphertexts []string
+			for _, plaintext := range []string{"1", "2.5", " 10 ", "-4", "banana", "250"} {
+				ciphertexts = append(ciphertexts, cmds.EncryptBound(h.attestationPath, h.rootPath, plaintext, 0, messages.Binding{Purpose: messages.PurposeAggregate}))
+			}
+			write := func(name string, ciphertexts ...string) string {
+				path := filepath.Join(h.dir, name)
+				if err := os.WriteFile(path, []byte(strings.Join(ciphertexts, "\n")+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			}
+			inputPath := write("ciphertexts.txt", ciphertexts...)
+
+			// Without noise, the results are exact. 250 is clamped to 100.
+			got, _ := cmds.Aggregate(ctx, h.cfg, h.attestationPath, h.rootPath, inputPath, messages.AggregateParameters{
+				MinCohort: 5,
+				Bounds:    &messages.AggregateBounds{Lower: -10, Upper: 100},
+				Buckets:   []float64{0, 5},
+			})
+			rejected := 1
+			want := messages.AggregateResult{Count: 5, Sum: 109.5, Mean: 21.9, Histogram: []float64{1, 2, 2}, Rejected: &rejected}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+
+			// The attestation only commits to the hash of large histograms.
+			buckets := make([]float64, messages.MaxAggregateBuckets)
+			for i := range buckets {
+				buckets[i] = float64(i)
+			}
+			got, _ = cmds.Aggregate(ctx, h.cfg, h.attestationPath, h.rootPath, inputPath, messages.AggregateParameters{Buckets: buckets})
+			if len(got.Histogram) != len(buckets)+1 || got.Histogram[0] != 1 || got.Histogram[251] != 1 {
+				t.Errorf("got a histogram of %d buckets, want %d with -4 in the first one and 250 in bucket 251", len(got.Histogram), len(buckets)+1)
+			}
+
+			mustFailWith(t, messages.ErrorCodeCohortTooSmall, func() {
+				cmds.Aggregate(ctx, h.cfg, h.attestationPath, h.rootPath, inputPath, messages.AggregateParameters{MinCohort: 6})
+			})
+			mustFailWith(t, messages.ErrorCodeInvalidRequest, func() {
+				cmds.Aggregate(ctx, h.cfg, h.attestationPath, h.rootPath, inputPath, messages.AggregateParameters{Epsilon: 1})
+			})
+
+			// With noise, the results are close to the exact ones with a
+			// generous epsilon. The number of rejected items would reveal the
+			// exact count.
+			got, _ = cmds.Aggregate(ctx, h.cfg, h.attestationPath, h.rootPath, inputPath, messages.AggregateParameters{
+				MinCohort: 4,
+				Epsilon:   1000,
+				Bounds:    &messages.AggregateBounds{Lower: -10, Upper: 100},
+			})
+			if got.Count == 5 || math.Abs(got.Count-5) > 1 || math.Abs(got.Sum-109.5) > 10 {
+				t.Errorf("got %+v, want noisy values close to a count of 5 and a sum of 109.5", got)
+			}
+			if got.Mean < -10 || got.Mean > 100 {
+				t.Errorf("got a mean of %g, want it within the bounds", got.Mean)
+			}
+			if got.Rejected != nil {
+				t.Errorf("got %d rejected items, want none reported with noise", *got.Rejected)
+			}
+			mustFailWith(t, messages.ErrorCodeCohortTooSmall, func() {
+				cmds.Aggregate(ctx, h.cfg, h.attestationPath, h.rootPath, inputPath, messages.AggregateParameters{
+					MinCohort: 6,
+					Epsilon:   1000,
+					Bounds:    &messages.AggregateBounds{Lower: -10, Upper: 100},
+				})
+			})
+
+			// A repeated ciphertext would count twice.
+			mustFailWith(t, messages.ErrorCodeInvalidRequest, func() {
+				cmds.Aggregate(ctx, h.cfg, h.attestationPath, h.rootPath, write("repeated.txt", ciphertexts[0], ciphertexts[1], ciphertexts[0]), messages.AggregateParameters{})
+			})
+
+			// Values bound to aggregates can't leave the enclave on their own,
+			// and aggregates only take values bound to them.
+			mustFailWith(t, messages.ErrorCodeDecryptionFailed, func() {
+				cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertexts[0], cmds.Computation{})
+			})
+			results := cmds.BatchDecrypt(ctx, h.cfg, h.attestationPath, h.rootPath, inputPath, filepath.Join(h.dir, "receipts.json"), cmds.Computation{})
+			for i, result := range results {
+				if result.Error == nil || result.Error.Code != messages.ErrorCodeDecryptionFailed {
+					t.Errorf("batch-decrypt %d: got %+v, want %s", i, result, messages.ErrorCodeDecryptionFailed)
+				}
+			}
+			_, recipientPath := newRecipient(t, h.dir)
+			mustFailWith(t, messages.ErrorCodeDecryptionFailed, func() {
+				cmds.ReEncrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertexts[0], recipientPath, "")
+			})
+			unbound := write("unbound.txt", cmds.Encrypt(h.attestationPath, h.rootPath, "1", 0))
+			if got, _ := cmds.Aggregate(ctx, h.cfg, h.attestationPath, h.rootPath, unbound, messages.AggregateParameters{}); got.Count != 0 || got.Rejected == nil || *got.Rejected != 1 {
+				t.Errorf("got %+v, want an unbound value rejected", got)
+			}
+		})
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	for _, protocol := range []string{"json", "grpc"} {
+		t.Run(protocol, func(t *testing.T) {
+			ctx := context.Background()
+			h := newHarness(t, func(s *server.Server) { s.MinIntersectSetSize = 3 })
+			h.cfg.Grpc = protocol == "grpc"
+			cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+
+			writeCiphertexts := func(name string, binding messages.Binding, plaintexts ...string) string {
+				var ciphertexts []string
+				for _, plaintext := range plaintexts {
+					ciphertexts = append(ciphertexts, cmds.EncryptBound(h.attestationPath, h.rootPath, plaintext, 0, binding))
+				}
+				path := filepath.Join(h.dir, name)
+				if err := os.WriteFile(path, []byte(strings.Join(ciphertexts, "\n")+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			}
+			leftPath := writeCiphertexts("left.txt", messages.Binding{Party: "alice"}, "alice", "bob", "carol", "bob")
+			rightPath := writeCiphertexts("right.txt", messages.Binding{Party: "bob"}, "carol", "dave", "bob", "erin")
+
+			// The right set has a ciphertext the enclave rejects: its one-shot
+			// expiry is beyond the replay window.
+			rejected := cmds.EncryptBound(h.attestationPath, h.rootPath, "alice", 48*time.Hour, messages.Binding{Party: "bob"})
+			right, err := os.ReadFile(rightPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(rightPath, append(right, rejected+"\n"...), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			// Without a recipient, only the size leaves the enclave.
+			outputPath := filepath.Join(h.dir, "intersection.txt")
+			got, elements, _ := cmds.Intersect(ctx, h.cfg, h.attestationPath, h.rootPath, leftPath, "alice", rightPath, "bob", "", outputPath)
+			if got.Size != 2 || got.LeftRejected != 0 || got.RightRejected != 1 || got.MinSetSize != 3 || elements != nil {
+				t.Errorf("got %+v and %d elements, want a size of 2, 1 rejected on the right, a minimum set size of 3 and no elements", got, len(elements))
+			}
+
+			// A party can't pass the other's ciphertexts off as its own: they
+			// don't decrypt in its set, which leaves both sets empty.
+			mustFailWith(t, messages.ErrorCodeCohortTooSmall, func() {
+				cmds.Intersect(ctx, h.cfg, h.attestationPath, h.rootPath, leftPath, "bob", rightPath, "alice", "", outputPath)
+			})
+
+			// Nor probe the other set with a few guesses: repeated values and
+			// ciphertexts which don't decrypt don't count towards the minimum.
+			probePath := writeCiphertexts("probe.txt", messages.Binding{Party: "bob"}, "alice", "alice", "alice")
+			probe, err := os.ReadFile(probePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(probePath, append(probe, rejected+"\n"...), 0644); err != nil {
+				t.Fatal(err)
+			}
+			mustFailWith(t, messages.ErrorCodeCohortTooSmall, func() {
+				cmds.Intersect(ctx, h.cfg, h.attestationPath, h.rootPath, leftPath, "alice", probePath, "bob", "", outputPath)
+			})
+
+			// Nor put the same ciphertexts in both sets.
+			left, err := os.ReadFile(leftPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			overlapPath := filepath.Join(h.dir, "overlap.txt")
+			if err := os.WriteFile(overlapPath, append(append([]byte{}, right...), left...), 0644); err != nil {
+				t.Fatal(err)
+			}
+			mustFailWith(t, messages.ErrorCodeInvalidRequest, func() {
+				cmds.Intersect(ctx, h.cfg, h.attestationPath, h.rootPath, leftPath, "alice", overlapPath, "bob", "", outputPath)
+			})
+			mustFailWith(t, messages.ErrorCodeInvalidRequest, func() {
+				cmds.Intersect(ctx, h.cfg, h.attestationPath, h.rootPath, leftPath, "alice", rightPath, "alice", "", outputPath)
+			})
+
+			// With a recipient both parties bound their ciphertexts to, the
+			// intersecting values are sealed to it.
+			keyPath, recipientPath := newRecipient(t, h.dir)
+			boundLeftPath := writeCiphertexts("bound-left.txt", messages.Binding{RecipientHash: cmds.RecipientBinding(recipientPath).RecipientHash, Party: "alice"}, "alice", "bob", "carol")
+			boundRightPath := writeCiphertexts("bound-right.txt", messages.Binding{RecipientHash: cmds.RecipientBinding(recipientPath).RecipientHash, Party: "bob"}, "carol", "dave", "bob")
+			got, elements, _ = cmds.Intersect(ctx, h.cfg, h.attestationPath, h.rootPath, boundLeftPath, "alice", boundRightPath, "bob", recipientPath, outputPath)
+			if got.Size != 2 || len(elements) != 2 {
+				t.Errorf("got %+v and %d elements, want 2", got, len(elements))
+			}
+			plaintexts := cmds.Unseal(keyPath, outputPath)
+			if want := [][]byte{[]byte("bob"), []byte("carol")}; !reflect.DeepEqual(plaintexts, want) {
+				t.Errorf("got %q, want %q", plaintexts, want)
+			}
+
+			// Otherwise the values aren't sealed to anyone.
+			mustFailWith(t, messages.ErrorCodeCohortTooSmall, func() {
+				cmds.Intersect(ctx, h.cfg, h.attestationPath, h.rootPath, leftPath, "alice", boundRightPath, "bob", recipientPath, outputPath)
+			})
+
+			// The recipient must be an elliptic curve public key.
+			if err := os.WriteFile(recipientPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("garbage")}), 0644); err != nil {
+				t.Fatal(err)
+			}
+			mustFailWith(t, messages.ErrorCodeInvalidRequest, func() {
+				cmds.Intersect(ctx, h.cfg, h.attestationPath, h.rootPath, boundLeftPath, "alice", boundRightPath, "bob", recipientPath, outputPath)
+			})
+		})
+	}
+}
+
+func TestReEncrypt(t *testing.T) {
+	for _, protocol := range []string{"json", "grpc"} {
+		t.Run(protocol, func(t *testing.T) {
+			ctx := context.Background()
+			h := newHarness(t)
+			h.cfg.Grpc = protocol == "grpc"
+			cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+			otherAttestationPath := filepath.Join(h.dir, "other-attestation.out")
+			cmds.CreateKey(ctx, h.cfg, testRole, otherAttestationPath, h.rootPath)
+
+			// To another foobar key, which decrypts it as usual.
+			ciphertext := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", 0)
+			reEncrypted, _ := cmds.ReEncrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, "", otherAttestationPath)
+			result, _, _ := cmds.Decrypt(ctx, h.cfg, otherAttestationPath, h.rootPath, reEncrypted, cmds.Computation{})
+			if got := resultInt(t, &result.Result); got != 4 {
+				t.Errorf("got a count of %d, want 4", got)
+			}
+			mustFailWith(t, messages.ErrorCodeDecryptionFailed, func() {
+				cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, reEncrypted, cmds.Computation{})
+			})
+
+			// Not to a foobar key of another enclave image, which the parent
+			// instance could have made.
+			otherImageAttestationPath := filepath.Join(h.dir, "other-image-attestation.out")
+			h.simulator.SetPCR(0, bytes.Repeat([]byte{0xaa}, 48))
+			cmds.CreateKey(ctx, h.cfg, testRole, otherImageAttestationPath, h.rootPath)
+			h.simulator.SetPCR(0, testPcr0)
+			mustFailWith(t, messages.ErrorCodeAttestationRejected, func() {
+				cmds.ReEncrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, "", otherImageAttestationPath)
+			})
+
+			// Nor a ciphertext whose one-shot flag or binding the new one would
+			// drop. The one-shot ciphertext isn't used up.
+			oneShot := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", time.Hour)
+			mustFailWith(t, messages.ErrorCodeInvalidRequest, func() {
+				cmds.ReEncrypt(ctx, h.cfg, h.attestationPath, h.rootPath, oneShot, "", otherAttestationPath)
+			})
+			cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, oneShot, cmds.Computation{})
+			for name, binding := range map[string]messages.Binding{
+				"party":     {Party: "alice"},
+				"aggregate": {Purpose: messages.PurposeAggregate},
+			} {
+				t.Run(name, func(t *testing.T) {
+					bound := cmds.EncryptBound(h.attestationPath, h.rootPath, "attack at dawn", 0, binding)
+					mustFailWith(t, messages.ErrorCodeDecryptionFailed, func() {
+						cmds.ReEncrypt(ctx, h.cfg, h.attestationPath, h.rootPath, bound, "", otherAttestationPath)
+					})
+				})
+			}
+
+			// To a recipient's key, if the data owner bound the ciphertext to it.
+			keyPath, recipientPath := newRecipient(t, h.dir)
+			bound := cmds.EncryptBound(h.attestationPath, h.rootPath, "attack at dawn", 0, cmds.RecipientBinding(recipientPath))
+			reEncrypted, _ = cmds.ReEncrypt(ctx, h.cfg, h.attestationPath, h.rootPath, bound, recipientPath, "")
+			sealedPath := filepath.Join(h.dir, "sealed.txt")
+			if err := os.WriteFile(sealedPath, []byte(reEncrypted+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got := cmds.Unseal(keyPath, sealedPath); len(got) != 1 || string(got[0]) != "attack at dawn" {
+				t.Errorf("got %q, want %q", got, "attack at dawn")
+			}
+
+			// Otherwise the enclave would hand any plaintext over to a key the
+			// parent instance holds.
+			_, otherRecipientPath := newRecipient(t, t.TempDir())
+			for name, f := range map[string]func(){
+				"unbound":         func() { cmds.ReEncrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, recipientPath, "") },
+				"other recipient": func() { cmds.ReEncrypt(ctx, h.cfg, h.attestationPath, h.rootPath, bound, otherRecipientPath, "") },
+				"decrypt":         func() { cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, bound, cmds.Computation{}) },
+			} {
+				t.Run(name, func(t *testing.T) {
+					mustFailWith(t, messages.ErrorCodeDecryptionFailed, f)
+				})
+			}
+
+			// Re-encrypting a one-shot ciphertext uses it up.
+			oneShot = cmds.EncryptBound(h.attestationPath, h.rootPath, "a", time.Hour, cmds.RecipientBinding(recipientPath))
+			cmds.ReEncrypt(ctx, h.cfg, h.attestationPath, h.rootPath, oneShot, recipientPath, "")
+			mustFailWith(t, messages.ErrorCodeReplay, func() {
+				cmds.ReEncrypt(ctx, h.cfg, h.attestationPath, h.rootPath, oneShot, recipientPath, "")
+			})
+
+			if err := os.WriteFile(recipientPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("garbage")}), 0644); err != nil {
+				t.Fatal(err)
+			}
+			mustFailWith(t, messages.ErrorCodeInvalidRequest, func() {
+				cmds.ReEncrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, recipientPath, "")
+			})
+		})
+	}
+}
+
+func TestSigningKey(t *testing.T) {
+	for _, protocol := range []string{"json", "grpc"} {
+		t.Run(protocol, func(t *testing.T) {
+			ctx := context.Background()
+			h := newHarness(t, func(s *server.Server) { s.MinIntersectSetSize = 1 })
+			h.cfg.Grpc = protocol == "grpc"
+			cmds.CreateKey(ctx, h.cfg, testRole, h.attestationPath, h.rootPath)
+			keyPath := filepath.Join(h.dir, "signing-key.pem")
+			userData := cmds.GetSigningKey(ctx, h.cfg, h.rootPath, keyPath)
+			if userData.Thumbprint == "" {
+				t.Fatal("missing thumbprint")
+			}
+
+			ciphertext := cmds.Encrypt(h.attestationPath, h.rootPath, "attack at dawn", 0)
+			response, _, signedResult := cmds.Decrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, cmds.Computation{})
+			payload := cmds.VerifyResult(keyPath, signedResult)
+			if payload.Result == nil || !reflect.DeepEqual(*payload.Result, response.Result) {
+				t.Errorf("got a signed result of %+v, want %+v", payload.Result, response.Result)
+			}
+			if payload.KeyId != response.KeyId || !bytes.Equal(payload.Request, response.InitialRequest) {
+				t.Errorf("got key %s and request %02x, want %s and %02x", payload.KeyId, payload.Request, response.KeyId, response.InitialRequest)
+			}
+
+			// Batch results are signed individually, over the item's digest.
+			inputPath := filepath.Join(h.dir, "ciphertexts.txt")
+			if err := os.WriteFile(inputPath, []byte(ciphertext+"\n"+cmds.Encrypt(h.attestationPath, h.rootPath, "banana", 0)+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			receiptsPath := filepath.Join(h.dir, "receipts.json")
+			cmds.BatchDecrypt(ctx, h.cfg, h.attestationPath, h.rootPath, inputPath, receiptsPath, cmds.Computation{})
+			receiptsBytes, err := os.ReadFile(receiptsPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var receipts []cmds.Receipt
+			if err := json.Unmarshal(receiptsBytes, &receipts); err != nil {
+				t.Fatal(err)
+			}
+			for i, receipt := range receipts {
+				payload := cmds.VerifyResult(keyPath, receipt.Result.SignedResult)
+				if !reflect.DeepEqual(payload.Result, receipt.Result.Result) || !bytes.Equal(payload.Request, receipt.Request) {
+					t.Errorf("receipt %d: got %+v, want %+v over %02x", i, payload, receipt.Result.Result, receipt.Request)
+				}
+			}
+
+			// The results of the other operations are signed too, over the
+			// user data the enclave attests.
+			numbersPath := filepath.Join(h.dir, "numbers.txt")
+			aggregateBinding := messages.Binding{Purpose: messages.PurposeAggregate}
+			if err := os.WriteFile(numbersPath, []byte(cmds.EncryptBound(h.attestationPath, h.rootPath, "3", 0, aggregateBinding)+"\n"+cmds.EncryptBound(h.attestationPath, h.rootPath, "5", 0, aggregateBinding)+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			aggregate, signedAggregate := cmds.Aggregate(ctx, h.cfg, h.attestationPath, h.rootPath, numbersPath, messages.AggregateParameters{})
+			payload = cmds.VerifyResult(keyPath, signedAggregate)
+			if payload.Aggregate == nil || payload.AggregateResult == nil || !reflect.DeepEqual(*payload.AggregateResult, aggregate) || !bytes.Equal(payload.Aggregate.ResultHash, aggregate.Hash()) {
+				t.Errorf("got a signed aggregate of %+v, want %+v", payload, aggregate)
+			}
+
+			leftPath := filepath.Join(h.dir, "left.txt")
+			rightPath := filepath.Join(h.dir, "right.txt")
+			if err := os.WriteFile(leftPath, []byte(cmds.EncryptBound(h.attestationPath, h.rootPath, "bob", 0, messages.Binding{Party: "alice"})+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(rightPath, []byte(cmds.EncryptBound(h.attestationPath, h.rootPath, "bob", 0, messages.Binding{Party: "bob"})+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			intersection, _, signedIntersection := cmds.Intersect(ctx, h.cfg, h.attestationPath, h.rootPath, leftPath, "alice", rightPath, "bob", "", filepath.Join(h.dir, "intersection.txt"))
+			payload = cmds.VerifyResult(keyPath, signedIntersection)
+			if payload.Intersect == nil || !reflect.DeepEqual(*payload.Intersect, intersection) || !bytes.Equal(payload.Request, intersection.InitialRequest) {
+				t.Errorf("got a signed intersection of %+v, want %+v", payload.Intersect, intersection)
+			}
+
+			otherAttestationPath := filepath.Join(h.dir, "other-attestation.out")
+			cmds.CreateKey(ctx, h.cfg, testRole, otherAttestationPath, h.rootPath)
+			reEncrypted, signedReEncryption := cmds.ReEncrypt(ctx, h.cfg, h.attestationPath, h.rootPath, ciphertext, "", otherAttestationPath)
+			payload = cmds.VerifyResult(keyPath, signedReEncryption)
+			if payload.ReEncrypt == nil || payload.KeyId != response.KeyId || payload.ReEncrypt.RecipientKeyId == "" {
+				t.Errorf("got a signed re-encryption of %+v", payload.ReEncrypt)
+			}
+			reEncryptedBytes, err := base64.RawURLEncoding.DecodeString(reEncrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sealed ecies.Message
+			if err := json.Unmarshal(reEncryptedBytes, &sealed); err != nil {
+				t.Fatal(err)
+			}
+			if payload.ReEncrypt != nil && !bytes.Equal(payload.ReEncrypt.CiphertextHash, messages.CiphertextHash(sealed)) {
+				t.Errorf("got a signed ciphertext hash of %02x, want %02x", payload.ReEncrypt.CiphertextHash, messages.CiphertextHash(sealed))
+			}
+
+			// Another result's payload doesn't match the signature.
+			parts := strings.Split(signedResult, ".")
+			parts[1] = strings.Split(receipts[1].Result.SignedResult, ".")[1]
+			tampered := strings.Join(parts, ".")
+			mustPanic(t, func() {
+				cmds.VerifyResult(keyPath, tampered)
+			})
+
+			// Another enclave has another key.
+			otherKeyPath := filepath.Join(h.dir, "other-signing-key.pem")
+			other := newHarness(t)
+			cmds.GetSigningKey(ctx, other.cfg, other.rootPath, otherKeyPath)
+			mustPanic(t, func() {
+				cmds.VerifyResult(otherKeyPath, signedResult)
+			})
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package e2e
+
+// A minimal WebAssembly assembler, for the test modules. Every module has the
+// same layout: a memory, a heap pointer and three functions, alloc, compute
+// and nop. Only compute's body varies.
+
+const (
+	wasmI32 = 0x7f
+	wasmI64 = 0x7e
+)
+
+func uleb(n uint32) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return b
+}
+
+func wasmVec(items ...[]byte) []byte {
+	return concat(uleb(uint32(len(items))), concat(items...))
+}
+
+func wasmName(name string) []byte {
+	return concat(uleb(uint32(len(name))), []byte(name))
+}
+
+func wasmSection(id byte, contents []byte) []byte {
+	return concat([]byte{id}, uleb(uint32(len(contents))), contents)
+}
+
+type wasmOptions struct {
+	memoryPages uint32
+	// compute's body, with two i32 locals after the parameters.
+	compute []byte
+	// Imports a function, which the enclave must refuse.
+	importFunction bool
+	// Size of a custom section, to make the module larger.
+	padding uint32
+}
+
+func wasmModule(o wasmOptions) []byte {
+	if o.memoryPages == 0 {
+		o.memoryPages = 1
+	}
+	// Imported functions come first in the index space.
+	first := uint32(0)
+	var imports []byte
+	if o.importFunction {
+		first = 1
+		imports = wasmSection(2, wasmVec(concat(wasmName("env"), wasmName("f"), []byte{0x00, 0x02})))
+	}
+	alloc := []byte{
+		0x23, 0x00, // global.get $heap
+		0x23, 0x00, // global.get $heap
+		0x20, 0x00, // local.get $size
+		0x6a,       // i32.add
+		0x24, 0x00, // global.set $heap
+		0x0b, // end
+	}
+	code := func(locals []byte, body []byte) []byte {
+		f := concat(locals, body)
+		return concat(uleb(uint32(len(f))), f)
+	}
+	return concat(
+		[]byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00},
+		wasmSection(1, wasmVec(
+			[]byte{0x60, 0x01, wasmI32, 0x01, wasmI32},
+			[]byte{0x60, 0x04, wasmI32, wasmI32, wasmI32, wasmI32, 0x01, wasmI64},
+			[]byte{0x60, 0x00, 0x00},
+		)),
+		imports,
+		wasmSection(3, wasmVec([]byte{0x00}, []byte{0x01}, []byte{0x02})),
+		wasmSection(5, wasmVec(concat([]byte{0x00}, uleb(o.memoryPages)))),
+		// $heap starts at 1024, below is for compute's output.
+		wasmSection(6, wasmVec([]byte{wasmI32, 0x01, 0x41, 0x80, 0x08, 0x0b})),
+		wasmSection(7, wasmVec(
+			concat(wasmName("memory"), []byte{0x02, 0x00}),
+			concat(wasmName("alloc"), []byte{0x00}, uleb(first)),
+			concat(wasmName("compute"), []byte{0x00}, uleb(first+1)),
+		)),
+		wasmSection(10, wasmVec(
+			code([]byte{0x00}, alloc),
+			code([]byte{0x01, 0x02, wasmI32}, o.compute),
+			code([]byte{0x00}, []byte{0x0b}),
+		)),
+		padding(o.padding),
+	)
+}
+
+func padding(size uint32) []byte {
+	if size == 0 {
+		return nil
+	}
+	return wasmSection(0, concat(wasmName("padding"), make([]byte, size)))
+}
+
+// Counts the plaintext's occurrences of the first byte of the parameters.
+// The output is the count, as 4 little-endian bytes.
+var wasmCount = []byte{
+	0x02, 0x40, // block
+	0x03, 0x40, // loop
+	0x20, 0x04, 0x20, 0x01, 0x4f, 0x0d, 0x01, // br_if 1 (i >= plaintextLen)
+	0x20, 0x00, 0x20, 0x04, 0x6a, 0x2d, 0x00, 0x00, // plaintext[i]
+	0x20, 0x02, 0x2d, 0x00, 0x00, // parameters[0]
+	0x46,                         // i32.eq
+	0x20, 0x05, 0x6a, 0x21, 0x05, // count += eq
+	0x20, 0x04, 0x41, 0x01, 0x6a, 0x21, 0x04, // i++
+	0x0c, 0x00, // br 0
+	0x0b,                                     // end
+	0x0b,                                     // end
+	0x41, 0x00, 0x20, 0x05, 0x36, 0x02, 0x00, // store count at 0
+	0x42, 0x04, // return ptr 0, length 4
+	0x0b,
+}
+
+// Calls nop forever.
+var wasmCalls = []byte{
+	0x03, 0x40, // loop
+	0x10, 0x02, // call nop
+	0x0c, 0x00, // br 0
+	0x0b, // end
+	0x42, 0x00,
+	0x0b,
+}
+
+// Loops forever, without calls.
+var wasmSpin = []byte{
+	0x03, 0x40, // loop
+	0x0c, 0x00, // br 0
+	0x0b, // end
+	0x42, 0x00,
+	0x0b,
+}
+
+// Returns 400 zero bytes.
+var wasmLarge = []byte{
+	0x42, 0x90, 0x03, // return ptr 0, length 400
+	0x0b,
+}
+
+var wasmTrap = []byte{
+	0x00, // unreachable
+	0x0b,
+}
@@ -0,0 +1,215 @@
+package enclave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/foobarpb"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/transport"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/wire"
+)
+
+// Client multiplexes requests over a single connection to the enclave. Send is
+// safe for concurrent use: every request gets its own id and responses are
+// matched by id, in whatever order the enclave sends them.
+//
+// Clients created with DialGRPC use gRPC instead of the JSON protocol, Send
+// then behaves the same way.
+type Client struct {
+	conn  net.Conn
+	Hello messages.HelloResponse
+
+	grpcConn *grpc.ClientConn
+	rpc      foobarpb.FoobarClient
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextId  uint64
+	pending map[uint64]chan messages.FoobarResponse
+	// err is set and done is closed once the connection is no longer usable.
+	err  error
+	done chan struct{}
+}
+
+// Dial connects to the enclave and performs the handshake. It fails if the
+// enclave speaks a different protocol version.
+func Dial(ctx context.Context, dialer transport.Dialer) (*Client, error) {
+	log.Printf("Connecting to %s\n", dialer)
+	conn, err := dialer.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:    conn,
+		pending: map[uint64]chan messages.FoobarResponse{},
+		done:    make(chan struct{}),
+	}
+	if err := c.handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// handshake runs before readLoop is started, the hello is therefore the only
+// request in flight. This keeps the error readable when talking to enclaves
+// which predate request ids.
+func (c *Client) handshake() error {
+	req := messages.FoobarRequest{Hello: &messages.HelloRequest{ProtocolVersion: messages.ProtocolVersion}}
+	log.Printf("Send: %v", req)
+	msgBytes, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if err := wire.WriteFrame(c.conn, msgBytes); err != nil {
+		return err
+	}
+	resp, err := readResponse(c.conn)
+	if err != nil {
+		return err
+	}
+	if resp.Error != nil && resp.Error.Code == messages.ErrorCodeIncompatibleProtocol {
+		return fmt.Errorf("incompatible enclave: %w", resp.Error)
+	}
+	if resp.Error != nil && resp.Error.Code != "" {
+		return resp.Error
+	}
+	if resp.Error != nil || resp.Hello == nil {
+		return fmt.Errorf("incompatible enclave: the enclave predates protocol versioning, the instance speaks protocol version %d", messages.ProtocolVersion)
+	}
+	return c.setHello(*resp.Hello)
+}
+
+// setHello checks the enclave's hello, whichever the protocol.
+func (c *Client) setHello(hello messages.HelloResponse) error {
+	log.Printf("enclave build %s, protocol version %d, operations %v\n", hello.BuildVersion, hello.ProtocolVersion, hello.Operations)
+
+	if hello.ProtocolVersion != messages.ProtocolVersion {
+		return fmt.Errorf("incompatible enclave: the enclave (build %s) speaks protocol version %d, the instance speaks protocol version %d",
+			hello.BuildVersion, hello.ProtocolVersion, messages.ProtocolVersion)
+	}
+	c.Hello = hello
+	return nil
+}
+
+// Send sends req and waits for its response. It returns the response and the
+// exact bytes which were sent, since some attestations commit to the request.
+// An error is returned if the enclave doesn't support the operation or the
+// connection fails. Errors reported by the enclave are *messages.Error, use
+// errors.As to inspect the code and whether the request can be retried.
+func (c *Client) Send(ctx context.Context, req messages.FoobarRequest) (messages.FoobarResponse, []byte, error) {
+	operation := req.Operation()
+	if !slices.Contains(c.Hello.Operations, operation) {
+		return messages.FoobarResponse{}, nil, fmt.Errorf("incompatible enclave: the enclave (build %s) does not support %q", c.Hello.BuildVersion, operation)
+	}
+	if c.rpc != nil {
+		return c.sendGRPC(ctx, req)
+	}
+
+	ch := make(chan messages.FoobarResponse, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return messages.FoobarResponse{}, nil, c.err
+	}
+	c.nextId++
+	req.Id = c.nextId
+	if deadline, ok := ctx.Deadline(); ok {
+		// Rounded up, 0 would mean no timeout.
+		req.TimeoutMs = int64(time.Until(deadline)/time.Millisecond) + 1
+	}
+	c.pending[req.Id] = ch
+	c.mu.Unlock()
+	defer c.forget(req.Id)
+
+	log.Printf("Send: %v", req)
+	msgBytes, err := json.Marshal(req)
+	if err != nil {
+		return messages.FoobarResponse{}, nil, err
+	}
+	c.writeMu.Lock()
+	err = wire.WriteFrame(c.conn, msgBytes)
+	c.writeMu.Unlock()
+	if err != nil {
+		return messages.FoobarResponse{}, nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return resp, msgBytes, resp.Error
+		}
+		return resp, msgBytes, nil
+	case <-c.done:
+		return messages.FoobarResponse{}, nil, c.err
+	case <-ctx.Done():
+		return messages.FoobarResponse{}, nil, ctx.Err()
+	}
+}
+
+func (c *Client) forget(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+// readLoop routes responses to the pending requests until the connection
+// fails.
+func (c *Client) readLoop() {
+	for {
+		resp, err := readResponse(c.conn)
+		if err != nil {
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+			close(c.done)
+			return
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[resp.Id]
+		c.mu.Unlock()
+		if !ok {
+			// The request was abandoned, e.g. because its context was canceled.
+			log.Printf("dropping response to unknown request %d\n", resp.Id)
+			continue
+		}
+		ch <- resp
+	}
+}
+
+func readResponse(conn net.Conn) (messages.FoobarResponse, error) {
+	var resp messages.FoobarResponse
+	respBytes, err := wire.ReadFrame(conn)
+	if errors.Is(err, io.EOF) {
+		err = errors.New("enclave closed the connection without responding")
+	}
+	if err != nil {
+		return resp, err
+	}
+	if err := json.Unmarshal(respBytes, &resp); err != nil {
+		return resp, err
+	}
+	log.Printf("Recv: %v", resp)
+	return resp, nil
+}
+
+// Close closes the connection. Pending requests fail.
+func (c *Client) Close() error {
+	if c.grpcConn != nil {
+		return c.grpcConn.Close()
+	}
+	return c.conn.Close()
+}
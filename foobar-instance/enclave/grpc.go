@@ -0,0 +1,231 @@
+package enclave
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/foobarpb"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/transport"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/wire"
+)
+
+// DialGRPC returns a client which talks to the enclave over gRPC, and performs
+// the handshake. It fails if the enclave speaks a different protocol version.
+//
+// The connection isn't encrypted: like the JSON protocol, gRPC relies on
+// attestations rather than on the transport. Messages can be as large as the
+// JSON protocol's frames.
+func DialGRPC(ctx context.Context, dialer transport.Dialer) (*Client, error) {
+	log.Printf("Connecting to %s (gRPC)\n", dialer)
+	conn, err := grpc.NewClient("passthrough:///foobar-enclave",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return dialer.Dial(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(wire.MaxFrameSize), grpc.MaxCallSendMsgSize(wire.MaxFrameSize)))
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{grpcConn: conn, rpc: foobarpb.NewFoobarClient(conn)}
+	if err := c.handshakeGRPC(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) handshakeGRPC(ctx context.Context) error {
+	res, err := c.rpc.Hello(ctx, &foobarpb.HelloRequest{ProtocolVersion: messages.ProtocolVersion})
+	if status.Code(err) == codes.Unimplemented {
+		return fmt.Errorf("incompatible enclave: the enclave predates the gRPC handshake, the instance speaks protocol version %d", messages.ProtocolVersion)
+	}
+	if err != nil {
+		return foobarpb.ErrorFromStatus(err)
+	}
+	return c.setHello(messages.HelloResponse{
+		ProtocolVersion: int(res.GetProtocolVersion()),
+		BuildVersion:    res.GetBuildVersion(),
+		Operations:      res.GetOperations(),
+	})
+}
+
+// sendGRPC converts req to its gRPC equivalent. The returned bytes are the
+// deterministic encoding of the gRPC request, which is what the decrypt
+// attestation commits to.
+func (c *Client) sendGRPC(ctx context.Context, req messages.FoobarRequest) (messages.FoobarResponse, []byte, error) {
+	var resp messages.FoobarResponse
+	var msg proto.Message
+	var err error
+	switch {
+	case req.CreateKey != nil:
+		r := &foobarpb.CreateKeyRequest{
+			Region:     req.CreateKey.Region,
+			AccountId:  req.CreateKey.AccountId,
+			AwsIamRole: req.CreateKey.AwsIamRole,
+			Credentials: &foobarpb.Credentials{
+				AccessKeyId:     req.CreateKey.Credentials.AccessKeyId,
+				SecretAccessKey: req.CreateKey.Credentials.SecretAccessKey,
+				Token:           req.CreateKey.Credentials.Token,
+			},
+			AttestationNonce: req.CreateKey.AttestationNonce,
+		}
+		msg = r
+		var res *foobarpb.CreateKeyResponse
+		if res, err = c.rpc.CreateKey(ctx, r); err == nil {
+			resp.CreateKey = &messages.CreateKeyResponse{Attestation: res.GetAttestation()}
+		}
+	case req.GetAttestation != nil:
+		r := &foobarpb.GetAttestationRequest{
+			OpenSession:      req.GetAttestation.OpenSession,
+			SessionId:        req.GetAttestation.SessionId,
+			AttestationNonce: req.GetAttestation.AttestationNonce,
+		}
+		msg = r
+		var res *foobarpb.GetAttestationResponse
+		if res, err = c.rpc.GetAttestation(ctx, r); err == nil {
+			resp.GetAttestation = &messages.GetAttestationResponse{
+				Attestation: res.GetAttestation(),
+				SessionId:   res.GetSessionId(),
+			}
+		}
+	case req.Decrypt != nil:
+		r := &foobarpb.DecryptRequest{
+			KeyId:            req.Decrypt.KeyId,
+			SessionId:        req.Decrypt.SessionId,
+			SharedSecret:     req.Decrypt.EncryptedSharedSecret,
+			Nonce:            req.Decrypt.Nonce,
+			Ciphertext:       req.Decrypt.Ciphertext,
+			AttestationNonce: req.Decrypt.AttestationNonce,
+			OneShotUntil:     req.Decrypt.OneShotUntil,
+			Computation:      req.Decrypt.Computation,
+			Parameters:       req.Decrypt.Parameters,
+			WasmModule:       req.Decrypt.WasmModule,
+		}
+		msg = r
+		var res *foobarpb.DecryptResponse
+		if res, err = c.rpc.Decrypt(ctx, r); err == nil {
+			resp.Decrypt = &messages.DecryptResponse{Attestation: res.GetAttestation(), SignedResult: res.GetSignedResult()}
+		}
+	case req.Status != nil:
+		r := &foobarpb.StatusRequest{}
+		msg = r
+		var res *foobarpb.StatusResponse
+		if res, err = c.rpc.Status(ctx, r); err == nil {
+			resp.Status = &messages.StatusResponse{Attestation: res.GetAttestation(), Status: foobarpb.StatusToMessage(res.GetStatus())}
+		}
+	case req.ListKeys != nil:
+		r := &foobarpb.ListKeysRequest{}
+		msg = r
+		var res *foobarpb.ListKeysResponse
+		if res, err = c.rpc.ListKeys(ctx, r); err == nil {
+			resp.ListKeys = &messages.ListKeysResponse{Attestation: res.GetAttestation(), Keys: foobarpb.KeysToMessages(res.GetKeys())}
+		}
+	case req.BatchDecrypt != nil:
+		r := &foobarpb.BatchDecryptRequest{
+			SessionId:        req.BatchDecrypt.SessionId,
+			AttestationNonce: req.BatchDecrypt.AttestationNonce,
+			Computation:      req.BatchDecrypt.Computation,
+			Parameters:       req.BatchDecrypt.Parameters,
+			WasmModule:       req.BatchDecrypt.WasmModule,
+			Items:            foobarpb.ItemsFromMessages(req.BatchDecrypt.Items),
+		}
+		msg = r
+		var res *foobarpb.BatchDecryptResponse
+		if res, err = c.rpc.BatchDecrypt(ctx, r); err == nil {
+			resp.BatchDecrypt = &messages.BatchDecryptResponse{Attestation: res.GetAttestation()}
+			for _, result := range res.GetResults() {
+				resp.BatchDecrypt.Results = append(resp.BatchDecrypt.Results, foobarpb.ResultToMessage(result))
+			}
+		}
+	case req.Aggregate != nil:
+		r := &foobarpb.AggregateRequest{
+			SessionId:        req.Aggregate.SessionId,
+			AttestationNonce: req.Aggregate.AttestationNonce,
+			Parameters:       foobarpb.AggregateParametersFromMessage(req.Aggregate.Parameters),
+			Items:            foobarpb.ItemsFromMessages(req.Aggregate.Items),
+		}
+		msg = r
+		var res *foobarpb.AggregateResponse
+		if res, err = c.rpc.Aggregate(ctx, r); err == nil {
+			resp.Aggregate = &messages.AggregateResponse{
+				Attestation:  res.GetAttestation(),
+				Result:       foobarpb.AggregateResultToMessage(res.GetResult()),
+				SignedResult: res.GetSignedResult(),
+			}
+		}
+	case req.Intersect != nil:
+		r := &foobarpb.IntersectRequest{
+			SessionId:        req.Intersect.SessionId,
+			AttestationNonce: req.Intersect.AttestationNonce,
+			Left:             foobarpb.ItemsFromMessages(req.Intersect.Left),
+			Right:            foobarpb.ItemsFromMessages(req.Intersect.Right),
+			LeftParty:        req.Intersect.LeftParty,
+			RightParty:       req.Intersect.RightParty,
+			Recipient:        req.Intersect.Recipient,
+		}
+		msg = r
+		var res *foobarpb.IntersectResponse
+		if res, err = c.rpc.Intersect(ctx, r); err == nil {
+			resp.Intersect = &messages.IntersectResponse{
+				Attestation:  res.GetAttestation(),
+				Elements:     foobarpb.SealedToMessages(res.GetElements()),
+				SignedResult: res.GetSignedResult(),
+			}
+		}
+	case req.ReEncrypt != nil:
+		r := &foobarpb.ReEncryptRequest{
+			KeyId:                req.ReEncrypt.KeyId,
+			SessionId:            req.ReEncrypt.SessionId,
+			SharedSecret:         req.ReEncrypt.EncryptedSharedSecret,
+			Nonce:                req.ReEncrypt.Nonce,
+			Ciphertext:           req.ReEncrypt.Ciphertext,
+			AttestationNonce:     req.ReEncrypt.AttestationNonce,
+			OneShotUntil:         req.ReEncrypt.OneShotUntil,
+			Recipient:            req.ReEncrypt.Recipient,
+			RecipientAttestation: req.ReEncrypt.RecipientAttestation,
+		}
+		msg = r
+		var res *foobarpb.ReEncryptResponse
+		if res, err = c.rpc.ReEncrypt(ctx, r); err == nil {
+			resp.ReEncrypt = &messages.ReEncryptResponse{
+				Attestation:  res.GetAttestation(),
+				Ciphertext:   foobarpb.SealedToMessage(res.GetCiphertext()),
+				SignedResult: res.GetSignedResult(),
+			}
+		}
+	case req.GetSigningKey != nil:
+		r := &foobarpb.GetSigningKeyRequest{AttestationNonce: req.GetSigningKey.AttestationNonce}
+		msg = r
+		var res *foobarpb.GetSigningKeyResponse
+		if res, err = c.rpc.GetSigningKey(ctx, r); err == nil {
+			resp.GetSigningKey = &messages.GetSigningKeyResponse{Attestation: res.GetAttestation()}
+		}
+	case req.RegisterKey != nil:
+		r := &foobarpb.RegisterKeyRequest{Attestation: req.RegisterKey.Attestation}
+		msg = r
+		var res *foobarpb.RegisterKeyResponse
+		if res, err = c.rpc.RegisterKey(ctx, r); err == nil {
+			resp.RegisterKey = &messages.RegisterKeyResponse{KeyId: res.GetKeyId(), Registered: res.GetRegistered()}
+		}
+	default:
+		return resp, nil, fmt.Errorf("%q is not available over gRPC", req.Operation())
+	}
+	if err != nil {
+		return resp, nil, foobarpb.ErrorFromStatus(err)
+	}
+
+	msgBytes, err := foobarpb.MarshalDeterministic(msg)
+	if err != nil {
+		return resp, nil, err
+	}
+	return resp, msgBytes, nil
+}
@@ -0,0 +1,316 @@
+package fakekms
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+type KeyMetadata struct {
+	AWSAccountId           string     `json:"AWSAccountId"`
+	Arn                    string     `json:"Arn"`
+	CreationDate           epochTime  `json:"CreationDate"`
+	DeletionDate           *epochTime `json:"DeletionDate,omitempty"`
+	Description            string     `json:"Description"`
+	Enabled                bool       `json:"Enabled"`
+	KeyAgreementAlgorithms []string   `json:"KeyAgreementAlgorithms"`
+	KeyId                  string     `json:"KeyId"`
+	KeyManager             string     `json:"KeyManager"`
+	KeySpec                string     `json:"KeySpec"`
+	KeyState               string     `json:"KeyState"`
+	KeyUsage               string     `json:"KeyUsage"`
+	MultiRegion            bool       `json:"MultiRegion"`
+	Origin                 string     `json:"Origin"`
+}
+
+type createKeyInput struct {
+	Description                    string
+	KeySpec                        string
+	KeyUsage                       string
+	Policy                         *string
+	BypassPolicyLockoutSafetyCheck bool
+}
+
+type createKeyOutput struct {
+	KeyMetadata KeyMetadata
+}
+
+var curves = map[string]elliptic.Curve{
+	"ECC_NIST_P256": elliptic.P256(),
+	"ECC_NIST_P384": elliptic.P384(),
+	"ECC_NIST_P521": elliptic.P521(),
+}
+
+func (s *Server) createKey(c caller, in createKeyInput) (*createKeyOutput, error) {
+	curve, ok := curves[in.KeySpec]
+	if !ok || in.KeyUsage != "KEY_AGREEMENT" {
+		return nil, &Error{Type: "UnsupportedOperationException", Message: "fake-kms only supports ECC_NIST_* keys with KEY_AGREEMENT usage"}
+	}
+
+	// Without a policy, KMS grants the account root full access.
+	policy := fmt.Sprintf(`{"Version":"2012-10-17","Statement":[{"Sid":"Enable IAM User Permissions","Effect":"Allow","Principal":{"AWS":"arn:aws:iam::%s:root"},"Action":"kms:*","Resource":"*"}]}`, s.config.AccountId)
+	if in.Policy != nil {
+		policy = *in.Policy
+	}
+	parsedPolicy, err := ParsePolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	// The lockout safety check ensures the caller can still manage the key.
+	if !in.BypassPolicyLockoutSafetyCheck && !parsedPolicy.Allows("kms:PutKeyPolicy", c.arn, s.config.AccountId, nil) {
+		return nil, &Error{Type: "MalformedPolicyDocumentException", Message: "The new key policy will not allow you to update the key policy in the future."}
+	}
+
+	privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyId, err := newKeyId()
+	if err != nil {
+		return nil, err
+	}
+
+	k := &key{
+		metadata: KeyMetadata{
+			AWSAccountId:           s.config.AccountId,
+			Arn:                    fmt.Sprintf("arn:aws:kms:%s:%s:key/%s", c.region, s.config.AccountId, keyId),
+			CreationDate:           epochTime(time.Now()),
+			Description:            in.Description,
+			Enabled:                true,
+			KeyAgreementAlgorithms: []string{"ECDH"},
+			KeyId:                  keyId,
+			KeyManager:             "CUSTOMER",
+			KeySpec:                in.KeySpec,
+			KeyState:               "Enabled",
+			KeyUsage:               in.KeyUsage,
+			Origin:                 "AWS_KMS",
+		},
+		policy:     policy,
+		privateKey: privateKey,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[keyId] = k
+	return &createKeyOutput{KeyMetadata: k.metadata}, nil
+}
+
+func newKeyId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+type keyIdInput struct {
+	KeyId string
+}
+
+type describeKeyOutput struct {
+	KeyMetadata KeyMetadata
+}
+
+func (s *Server) describeKey(c caller, in keyIdInput) (*describeKeyOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, err := s.lookup(in.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(c, k, "kms:DescribeKey", nil); err != nil {
+		return nil, err
+	}
+	return &describeKeyOutput{KeyMetadata: k.metadata}, nil
+}
+
+type getPublicKeyOutput struct {
+	KeyId                  string
+	KeySpec                string
+	KeyUsage               string
+	KeyAgreementAlgorithms []string
+	PublicKey              []byte
+}
+
+func (s *Server) getPublicKey(c caller, in keyIdInput) (*getPublicKeyOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, err := s.lookup(in.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(c, k, "kms:GetPublicKey", nil); err != nil {
+		return nil, err
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&k.privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &getPublicKeyOutput{
+		KeyId:                  k.metadata.Arn,
+		KeySpec:                k.metadata.KeySpec,
+		KeyUsage:               k.metadata.KeyUsage,
+		KeyAgreementAlgorithms: k.metadata.KeyAgreementAlgorithms,
+		PublicKey:              publicKey,
+	}, nil
+}
+
+type deriveSharedSecretInput struct {
+	KeyId                 string
+	KeyAgreementAlgorithm string
+	PublicKey             []byte
+	Recipient             *struct {
+		AttestationDocument    []byte
+		KeyEncryptionAlgorithm string
+	}
+}
+
+type deriveSharedSecretOutput struct {
+	KeyId                  string
+	KeyAgreementAlgorithm  string
+	KeyOrigin              string
+	SharedSecret           []byte `json:",omitempty"`
+	CiphertextForRecipient []byte `json:",omitempty"`
+}
+
+func (s *Server) deriveSharedSecret(c caller, in deriveSharedSecretInput) (*deriveSharedSecretOutput, error) {
+	if in.KeyAgreementAlgorithm != "ECDH" {
+		return nil, &Error{Type: "ValidationException", Message: "KeyAgreementAlgorithm must be ECDH"}
+	}
+
+	// The attestation document is verified before evaluating the policy, since
+	// it provides the kms:RecipientAttestation:* condition keys.
+	var recipient *recipient
+	context := map[string]string{}
+	if in.Recipient != nil {
+		if in.Recipient.KeyEncryptionAlgorithm != "RSAES_OAEP_SHA_256" {
+			return nil, &Error{Type: "ValidationException", Message: "KeyEncryptionAlgorithm must be RSAES_OAEP_SHA_256"}
+		}
+		var err error
+		recipient, err = s.verifyRecipient(in.Recipient.AttestationDocument)
+		if err != nil {
+			return nil, err
+		}
+		context = recipient.conditionKeys()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, err := s.lookup(in.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(c, k, "kms:DeriveSharedSecret", context); err != nil {
+		return nil, err
+	}
+
+	pkixPublicKey, err := x509.ParsePKIXPublicKey(in.PublicKey)
+	if err != nil {
+		return nil, &Error{Type: "ValidationException", Message: fmt.Sprintf("invalid PublicKey: %s", err)}
+	}
+	ecdsaPublicKey, ok := pkixPublicKey.(*ecdsa.PublicKey)
+	if !ok || ecdsaPublicKey.Curve != k.privateKey.Curve {
+		return nil, &Error{Type: "ValidationException", Message: "PublicKey does not match the key spec"}
+	}
+	publicKey, err := ecdsaPublicKey.ECDH()
+	if err != nil {
+		return nil, &Error{Type: "ValidationException", Message: fmt.Sprintf("invalid PublicKey: %s", err)}
+	}
+	privateKey, err := k.privateKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := privateKey.ECDH(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &deriveSharedSecretOutput{
+		KeyId:                 k.metadata.Arn,
+		KeyAgreementAlgorithm: in.KeyAgreementAlgorithm,
+		KeyOrigin:             k.metadata.Origin,
+	}
+	if recipient == nil {
+		out.SharedSecret = sharedSecret
+		return out, nil
+	}
+	out.CiphertextForRecipient, err = envelope(recipient.publicKey, sharedSecret)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type getKeyPolicyInput struct {
+	KeyId      string
+	PolicyName *string
+}
+
+type getKeyPolicyOutput struct {
+	Policy     string
+	PolicyName string
+}
+
+func (s *Server) getKeyPolicy(c caller, in getKeyPolicyInput) (*getKeyPolicyOutput, error) {
+	if in.PolicyName != nil && *in.PolicyName != "default" {
+		return nil, &Error{Type: "ValidationException", Message: "PolicyName must be default"}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, err := s.lookup(in.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(c, k, "kms:GetKeyPolicy", nil); err != nil {
+		return nil, err
+	}
+	return &getKeyPolicyOutput{Policy: k.policy, PolicyName: "default"}, nil
+}
+
+type scheduleKeyDeletionInput struct {
+	KeyId               string
+	PendingWindowInDays *int
+}
+
+type scheduleKeyDeletionOutput struct {
+	KeyId               string
+	DeletionDate        epochTime
+	KeyState            string
+	PendingWindowInDays int
+}
+
+func (s *Server) scheduleKeyDeletion(c caller, in scheduleKeyDeletionInput) (*scheduleKeyDeletionOutput, error) {
+	days := 30
+	if in.PendingWindowInDays != nil {
+		days = *in.PendingWindowInDays
+	}
+	if days < 7 || days > 30 {
+		return nil, &Error{Type: "ValidationException", Message: "PendingWindowInDays must be between 7 and 30"}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, err := s.lookup(in.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(c, k, "kms:ScheduleKeyDeletion", nil); err != nil {
+		return nil, err
+	}
+
+	deletionDate := epochTime(time.Now().Add(time.Duration(days) * 24 * time.Hour))
+	k.metadata.Enabled = false
+	k.metadata.KeyState = "PendingDeletion"
+	k.metadata.DeletionDate = &deletionDate
+	return &scheduleKeyDeletionOutput{
+		KeyId:               k.metadata.Arn,
+		DeletionDate:        deletionDate,
+		KeyState:            k.metadata.KeyState,
+		PendingWindowInDays: days,
+	}, nil
+}
@@ -0,0 +1,206 @@
+package fakekms
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Policy is a parsed key policy. It accepts the same documents as KMS, which
+// means most fields can either be a string or a list of strings.
+type Policy struct {
+	Version    string      `json:"Version"`
+	Statements []Statement `json:"Statement"`
+}
+
+type Statement struct {
+	Sid       string                           `json:"Sid"`
+	Effect    string                           `json:"Effect"`
+	Principal Principal                        `json:"Principal"`
+	Action    stringList                       `json:"Action"`
+	Resource  stringList                       `json:"Resource"`
+	Condition map[string]map[string]stringList `json:"Condition"`
+}
+
+// Principal is either "*" or a map such as {"AWS": ["arn:..."]}.
+type Principal struct {
+	Wildcard bool
+	AWS      stringList
+}
+
+func (p *Principal) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		if s != "*" {
+			return fmt.Errorf("invalid principal: %q", s)
+		}
+		p.Wildcard = true
+		return nil
+	}
+	var m map[string]stringList
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	for k, v := range m {
+		if k != "AWS" {
+			return fmt.Errorf("unsupported principal type: %q", k)
+		}
+		p.AWS = v
+	}
+	return nil
+}
+
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = []string{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+func ParsePolicy(policy string) (*Policy, error) {
+	var p Policy
+	if err := json.Unmarshal([]byte(policy), &p); err != nil {
+		return nil, &Error{Type: "MalformedPolicyDocumentException", Message: err.Error()}
+	}
+	if len(p.Statements) == 0 {
+		return nil, &Error{Type: "MalformedPolicyDocumentException", Message: "policy has no statements"}
+	}
+	for _, statement := range p.Statements {
+		if statement.Effect != "Allow" && statement.Effect != "Deny" {
+			return nil, &Error{Type: "MalformedPolicyDocumentException", Message: fmt.Sprintf("invalid effect: %q", statement.Effect)}
+		}
+		for operator := range statement.Condition {
+			if _, ok := conditionOperators[operator]; !ok {
+				return nil, &Error{Type: "MalformedPolicyDocumentException", Message: fmt.Sprintf("unsupported condition operator: %q", operator)}
+			}
+		}
+	}
+	return &p, nil
+}
+
+// Allows evaluates the policy the way IAM does: an explicit Deny wins, then at
+// least one Allow is required. context holds the condition keys of the
+// request, e.g. kms:RecipientAttestation:PCR0.
+func (p *Policy) Allows(action, principal, accountId string, context map[string]string) bool {
+	allowed := false
+	for _, statement := range p.Statements {
+		if !statement.matches(action, principal, accountId, context) {
+			continue
+		}
+		if statement.Effect == "Deny" {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
+}
+
+func (s *Statement) matches(action, principal, accountId string, context map[string]string) bool {
+	return s.matchesPrincipal(principal, accountId) && s.matchesAction(action) && s.matchesConditions(context)
+}
+
+func (s *Statement) matchesPrincipal(principal, accountId string) bool {
+	if s.Principal.Wildcard {
+		return true
+	}
+	for _, p := range s.Principal.AWS {
+		if p == "*" || p == principal {
+			return true
+		}
+		// Granting permissions to the account root delegates to IAM. IAM is not
+		// emulated, every principal of the account is allowed.
+		if p == fmt.Sprintf("arn:aws:iam::%s:root", accountId) && strings.HasPrefix(principal, fmt.Sprintf("arn:aws:iam::%s:", accountId)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Statement) matchesAction(action string) bool {
+	for _, a := range s.Action {
+		if globMatch(strings.ToLower(a), strings.ToLower(action)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Every condition must hold. A condition on a key missing from the request
+// context never holds.
+func (s *Statement) matchesConditions(context map[string]string) bool {
+	for operator, conditions := range s.Condition {
+		for conditionKey, expected := range conditions {
+			actual, ok := lookupConditionKey(context, conditionKey)
+			if !ok || !conditionOperators[operator](actual, expected) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Condition keys are case insensitive.
+func lookupConditionKey(context map[string]string, conditionKey string) (string, bool) {
+	for k, v := range context {
+		if strings.EqualFold(k, conditionKey) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+var conditionOperators = map[string]func(actual string, expected []string) bool{
+	"StringEquals": func(actual string, expected []string) bool {
+		for _, e := range expected {
+			if actual == e {
+				return true
+			}
+		}
+		return false
+	},
+	"StringEqualsIgnoreCase": func(actual string, expected []string) bool {
+		for _, e := range expected {
+			if strings.EqualFold(actual, e) {
+				return true
+			}
+		}
+		return false
+	},
+	"StringLike": func(actual string, expected []string) bool {
+		for _, e := range expected {
+			if globMatch(e, actual) {
+				return true
+			}
+		}
+		return false
+	},
+}
+
+// globMatch implements IAM wildcards: "*" matches any sequence of characters
+// (including "/") and "?" matches a single character.
+func globMatch(pattern, s string) bool {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String()).MatchString(s)
+}
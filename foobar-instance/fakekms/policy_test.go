@@ -0,0 +1,166 @@
+package fakekms
+
+import (
+	"errors"
+	"testing"
+)
+
+const (
+	testAccount = "123456789012"
+	testRole    = "arn:aws:iam::123456789012:role/foobar"
+	testPcr0    = "aa11"
+)
+
+// The shape of the policy create-key attaches: key administration for the
+// account, and DeriveSharedSecret only for an enclave with the image's PCR0.
+const testPolicy = `{
+	"Version": "2012-10-17",
+	"Statement": [
+		{
+			"Sid": "Enable IAM User Permissions",
+			"Effect": "Allow",
+			"Principal": {"AWS": "arn:aws:iam::123456789012:root"},
+			"Action": ["kms:Describe*", "kms:GetPublicKey", "kms:PutKeyPolicy"],
+			"Resource": "*"
+		},
+		{
+			"Sid": "Enclave only",
+			"Effect": "Allow",
+			"Principal": {"AWS": ["arn:aws:iam::123456789012:role/foobar"]},
+			"Action": "kms:DeriveSharedSecret",
+			"Resource": "*",
+			"Condition": {"StringEqualsIgnoreCase": {"kms:RecipientAttestation:PCR0": "AA11"}}
+		},
+		{
+			"Sid": "No deletion",
+			"Effect": "Deny",
+			"Principal": "*",
+			"Action": "kms:ScheduleKeyDeletion",
+			"Resource": "*"
+		}
+	]
+}`
+
+func TestPolicyAllows(t *testing.T) {
+	policy, err := ParsePolicy(testPolicy)
+	if err != nil {
+		t.Fatalf("ParsePolicy failed: %s", err)
+	}
+	pcr0 := map[string]string{"kms:RecipientAttestation:PCR0": testPcr0}
+	tests := []struct {
+		name      string
+		action    string
+		principal string
+		context   map[string]string
+		want      bool
+	}{
+		{"allowed", "kms:DeriveSharedSecret", testRole, pcr0, true},
+		{"condition key case", "kms:DeriveSharedSecret", testRole, map[string]string{"KMS:RECIPIENTATTESTATION:PCR0": testPcr0}, true},
+		{"action glob", "kms:DescribeKey", "arn:aws:iam::123456789012:user/admin", nil, true},
+		{"action case", "KMS:GetPublicKey", testRole, nil, true},
+		{"wrong PCR0", "kms:DeriveSharedSecret", testRole, map[string]string{"kms:RecipientAttestation:PCR0": "bb22"}, false},
+		{"missing condition key", "kms:DeriveSharedSecret", testRole, nil, false},
+		{"other PCR", "kms:DeriveSharedSecret", testRole, map[string]string{"kms:RecipientAttestation:PCR1": testPcr0}, false},
+		{"other principal", "kms:DeriveSharedSecret", "arn:aws:iam::123456789012:role/other", pcr0, false},
+		{"other account", "kms:DescribeKey", "arn:aws:iam::210987654321:user/admin", nil, false},
+		{"no statement", "kms:Decrypt", testRole, pcr0, false},
+		{"explicit deny", "kms:ScheduleKeyDeletion", testRole, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Allows(tt.action, tt.principal, testAccount, tt.context); got != tt.want {
+				t.Errorf("Allows(%s, %s, %v) = %t, want %t", tt.action, tt.principal, tt.context, got, tt.want)
+			}
+		})
+	}
+}
+
+// A Deny wins over an Allow of the same action.
+func TestPolicyDenyWins(t *testing.T) {
+	policy, err := ParsePolicy(`{"Statement": [
+		{"Effect": "Allow", "Principal": "*", "Action": "kms:*", "Resource": "*"},
+		{"Effect": "Deny", "Principal": "*", "Action": "kms:DeriveSharedSecret", "Resource": "*",
+		 "Condition": {"StringLike": {"kms:RecipientAttestation:PCR0": "bb*"}}}
+	]}`)
+	if err != nil {
+		t.Fatalf("ParsePolicy failed: %s", err)
+	}
+	if !policy.Allows("kms:DeriveSharedSecret", testRole, testAccount, map[string]string{"kms:RecipientAttestation:PCR0": testPcr0}) {
+		t.Errorf("denied a request the Deny's condition doesn't match")
+	}
+	if policy.Allows("kms:DeriveSharedSecret", testRole, testAccount, map[string]string{"kms:RecipientAttestation:PCR0": "bb22"}) {
+		t.Errorf("allowed a request the Deny matches")
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+	}{
+		{"not JSON", `{`},
+		{"no statements", `{"Statement": []}`},
+		{"invalid effect", `{"Statement": [{"Effect": "Maybe", "Principal": "*", "Action": "kms:*"}]}`},
+		{"invalid principal", `{"Statement": [{"Effect": "Allow", "Principal": "someone", "Action": "kms:*"}]}`},
+		{"unsupported principal type", `{"Statement": [{"Effect": "Allow", "Principal": {"Service": "ec2.amazonaws.com"}, "Action": "kms:*"}]}`},
+		{"unsupported operator", `{"Statement": [{"Effect": "Allow", "Principal": "*", "Action": "kms:*", "Condition": {"NumericEquals": {"a": "1"}}}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePolicy(tt.policy)
+			var kmsErr *Error
+			if !errors.As(err, &kmsErr) || kmsErr.Type != "MalformedPolicyDocumentException" {
+				t.Errorf("got %v, want a MalformedPolicyDocumentException", err)
+			}
+		})
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"kms:*", "kms:Decrypt", true},
+		{"arn:aws:iam::*:role/*", "arn:aws:iam::123:role/a/b", true},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"a.c", "abc", false},
+		{"kms:Describe*", "kms:GetPublicKey", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %t, want %t", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+// The condition keys of a verified attestation are what the policy sees.
+func TestRecipientConditionKeys(t *testing.T) {
+	policy, err := ParsePolicy(testPolicy)
+	if err != nil {
+		t.Fatalf("ParsePolicy failed: %s", err)
+	}
+	tests := []struct {
+		name string
+		pcrs map[int32][]byte
+		want bool
+	}{
+		{"image PCR0", map[int32][]byte{0: {0xaa, 0x11}, 1: {0x01}}, true},
+		{"other PCR0", map[int32][]byte{0: {0xaa, 0x12}, 1: {0x01}}, false},
+		{"no PCR0", map[int32][]byte{1: {0xaa, 0x11}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			context := (&recipient{pcrs: tt.pcrs}).conditionKeys()
+			if got := policy.Allows("kms:DeriveSharedSecret", testRole, testAccount, context); got != tt.want {
+				t.Errorf("got %t with %v, want %t", got, context, tt.want)
+			}
+		})
+	}
+	context := (&recipient{pcrs: map[int32][]byte{0: {0xaa, 0x11}}}).conditionKeys()
+	if context["kms:RecipientAttestation:ImageSha384"] != testPcr0 {
+		t.Errorf("got ImageSha384 %q, want %q", context["kms:RecipientAttestation:ImageSha384"], testPcr0)
+	}
+}
@@ -0,0 +1,173 @@
+package fakekms
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"time"
+
+	nitro_eclave_attestation_document "github.com/alokmenghrajani/go-nitro-enclave-attestation-document"
+)
+
+// KMS rejects attestation documents older than 5 minutes.
+const maxAttestationAge = 5 * time.Minute
+
+// recipient is an enclave which has proven its identity with an attestation
+// document.
+type recipient struct {
+	pcrs      map[int32][]byte
+	publicKey *rsa.PublicKey
+}
+
+func (s *Server) verifyRecipient(attestationDocument []byte) (*recipient, error) {
+	if s.config.Root == nil {
+		return nil, &Error{Type: "ValidationException", Message: "fake-kms has no attestation root configured"}
+	}
+	doc, err := nitro_eclave_attestation_document.AuthenticateDocument(attestationDocument, *s.config.Root, true)
+	if err != nil {
+		return nil, &Error{Type: "ValidationException", Message: fmt.Sprintf("invalid attestation document: %s", err)}
+	}
+
+	timestamp := time.UnixMilli(int64(doc.TimeStamp))
+	if time.Since(timestamp) > maxAttestationAge {
+		return nil, &Error{Type: "ValidationException", Message: fmt.Sprintf("attestation document is too old: %s", timestamp)}
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(doc.PublicKey)
+	if err != nil {
+		return nil, &Error{Type: "ValidationException", Message: fmt.Sprintf("invalid attestation document public key: %s", err)}
+	}
+	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, &Error{Type: "ValidationException", Message: "attestation document public key is not an RSA key"}
+	}
+
+	return &recipient{pcrs: doc.PCRs, publicKey: rsaPublicKey}, nil
+}
+
+// conditionKeys returns the kms:RecipientAttestation:* condition keys. PCR
+// values are lowercase hex, ImageSha384 is an alias for PCR0.
+func (r *recipient) conditionKeys() map[string]string {
+	keys := map[string]string{}
+	for i, pcr := range r.pcrs {
+		keys[fmt.Sprintf("kms:RecipientAttestation:PCR%d", i)] = fmt.Sprintf("%02x", pcr)
+	}
+	if pcr0, ok := r.pcrs[0]; ok {
+		keys["kms:RecipientAttestation:ImageSha384"] = fmt.Sprintf("%02x", pcr0)
+	}
+	return keys
+}
+
+// The CMS (RFC 5652) structures KMS uses for CiphertextForRecipient: an
+// EnvelopedData with a single RSAES-OAEP-SHA-256 recipient and AES-256-CBC
+// content encryption.
+
+var (
+	oidData           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEnvelopedData  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidRsaesOaep      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 7}
+	oidMgf1           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+	oidSha256         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidAes256Cbc      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	sha256AlgorithmId = pkix.AlgorithmIdentifier{Algorithm: oidSha256, Parameters: asn1.NullRawValue}
+)
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     envelopedData `asn1:"explicit,tag:0"`
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []keyTransRecipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type keyTransRecipientInfo struct {
+	Version                int
+	SubjectKeyIdentifier   []byte `asn1:"tag:0"`
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0"`
+}
+
+type rsaesOaepParams struct {
+	HashAlgorithm    pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MaskGenAlgorithm pkix.AlgorithmIdentifier `asn1:"explicit,tag:1"`
+}
+
+func envelope(publicKey *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+	contentKey := make([]byte, 32)
+	if _, err := rand.Read(contentKey); err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	// PKCS#7 padding
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append([]byte{}, plaintext...)
+	for i := 0; i < padding; i++ {
+		padded = append(padded, byte(padding))
+	}
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, contentKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	mgf1Params, err := asn1.Marshal(sha256AlgorithmId)
+	if err != nil {
+		return nil, err
+	}
+	oaepParams, err := asn1.Marshal(rsaesOaepParams{
+		HashAlgorithm:    sha256AlgorithmId,
+		MaskGenAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidMgf1, Parameters: asn1.RawValue{FullBytes: mgf1Params}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	subjectKeyIdentifier := sha256.Sum256(x509.MarshalPKCS1PublicKey(publicKey))
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidEnvelopedData,
+		Content: envelopedData{
+			Version: 2,
+			RecipientInfos: []keyTransRecipientInfo{{
+				Version:                2,
+				SubjectKeyIdentifier:   subjectKeyIdentifier[:],
+				KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRsaesOaep, Parameters: asn1.RawValue{FullBytes: oaepParams}},
+				EncryptedKey:           encryptedKey,
+			}},
+			EncryptedContentInfo: encryptedContentInfo{
+				ContentType:                oidData,
+				ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidAes256Cbc, Parameters: asn1.RawValue{FullBytes: ivParams}},
+				EncryptedContent:           ciphertext,
+			},
+		},
+	})
+}
@@ -9,8 +9,18 @@ require (
 	github.com/aws/aws-sdk-go-v2/config v1.27.33
 	github.com/aws/aws-sdk-go-v2/feature/ec2/imds v1.16.13
 	github.com/aws/aws-sdk-go-v2/service/kms v1.36.2
-	github.com/mdlayher/vsock v1.2.1
 	github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared v0.0.0
+	golang.org/x/crypto v0.27.0
+	google.golang.org/grpc v1.65.0
+	google.golang.org/protobuf v1.34.2
+)
+
+require (
+	github.com/edgebitio/nitro-enclaves-sdk-go v1.0.0 // indirect
+	github.com/hf/nsm v0.0.0-20220930140112-cd181bd646b9 // indirect
+	github.com/tetratelabs/wazero v1.8.2 // indirect
+	golang.org/x/text v0.18.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240528184218-531527333157 // indirect
 )
 
 replace github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared => ../foobar-shared
@@ -28,14 +38,16 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/sts v1.30.7 // indirect
 	github.com/aws/smithy-go v1.21.0 // indirect
 	github.com/fxamacker/cbor/v2 v2.4.0 // indirect
-	github.com/google/go-cmp v0.6.0 // indirect
 	github.com/mdlayher/socket v0.4.1 // indirect
+	github.com/mdlayher/vsock v1.2.1 // indirect
 	github.com/stretchr/testify v1.8.4 // indirect
 	github.com/veraison/go-cose v1.0.0-rc.1 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
 	github.com/xhit/go-str2duration/v2 v2.1.0 // indirect
-	golang.org/x/crypto v0.27.0 // indirect
+	github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave v0.0.0
 	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/sys v0.25.0 // indirect
 )
+
+replace github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-enclave => ../foobar-enclave
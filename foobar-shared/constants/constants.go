@@ -13,3 +13,17 @@ const INSTANCE_CID = 3
 
 // Port the parent instance listens on and forward data to KMS.
 const INSTANCE_LISTENING_PORT = 1001
+
+// Environment variable which overrides the address the enclave listens on for
+// commands, e.g. "tcp://127.0.0.1:1000" when running on a laptop. See the
+// transport package for the address format.
+const ENCLAVE_ADDRESS_ENV = "FOOBAR_ENCLAVE_ADDR"
+
+// Environment variable which overrides the address of the KMS proxy the
+// instance listens on and the enclave connects to.
+const KMS_PROXY_ADDRESS_ENV = "FOOBAR_KMS_PROXY_ADDR"
+
+// Environment variable which overrides the AWS KMS endpoint used by both the
+// enclave and the instance, e.g. to use fake-kms. For the enclave, the setting
+// is part of the image and therefore covered by PCR0.
+const KMS_ENDPOINT_ENV = "FOOBAR_KMS_ENDPOINT"
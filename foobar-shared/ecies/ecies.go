@@ -0,0 +1,105 @@
+// Package ecies encrypts messages to an ECDH public key, the way the encrypt
+// command encrypts to the enclave's KMS key: an ephemeral key pair, ECDH, HKDF
+// and AES-GCM. The enclave uses it to hand plaintexts to a recipient without
+// exposing them to the parent instance.
+package ecies
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Message has the JSON encoding of the encrypt command's ciphertexts, a
+// message sealed to a foobar key can therefore be decrypted by its enclave.
+type Message struct {
+	EphemeralKey []byte `json:"e"`
+	Nonce        []byte `json:"n"`
+	Ciphertext   []byte `json:"c"`
+}
+
+// ParsePublicKey parses a PKIX, ASN.1 DER public key, as returned by KMS's
+// GetPublicKey or openssl's -pubout.
+func ParsePublicKey(der []byte) (*ecdh.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return key.ECDH()
+	case *ecdh.PublicKey:
+		return key, nil
+	default:
+		return nil, errors.New("not an elliptic curve public key")
+	}
+}
+
+// Seal encrypts plaintext to recipient. additionalData is authenticated but
+// not encrypted, the recipient must pass the same to Open.
+func Seal(recipient *ecdh.PublicKey, plaintext, additionalData []byte) (*Message, error) {
+	ephemeralKey, err := recipient.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := newGCM(ephemeralKey, recipient)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ephemeralPublicKey, err := x509.MarshalPKIXPublicKey(ephemeralKey.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		EphemeralKey: ephemeralPublicKey,
+		Nonce:        nonce,
+		Ciphertext:   aesgcm.Seal(nil, nonce, plaintext, additionalData),
+	}, nil
+}
+
+// Open decrypts a message sealed to key's public key.
+func Open(key *ecdh.PrivateKey, m *Message, additionalData []byte) ([]byte, error) {
+	ephemeralKey, err := ParsePublicKey(m.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := newGCM(key, ephemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	// Open panics on invalid nonces.
+	if len(m.Nonce) != aesgcm.NonceSize() {
+		return nil, errors.New("invalid nonce length")
+	}
+	return aesgcm.Open(nil, m.Nonce, m.Ciphertext, additionalData)
+}
+
+// newGCM derives the content encryption key (CEK) from the shared secret.
+func newGCM(key *ecdh.PrivateKey, peer *ecdh.PublicKey) (cipher.AEAD, error) {
+	sharedSecret, err := key.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	hkdf := hkdf.New(sha256.New, sharedSecret, []byte("foobar-service-salt"), nil)
+	cek := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf, cek); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,48 @@
+package ecies
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/x509"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := ParsePublicKey(der)
+	if err != nil {
+		t.Fatalf("ParsePublicKey failed: %s", err)
+	}
+
+	m, err := Seal(recipient, []byte("attack at dawn"), []byte("ad"))
+	if err != nil {
+		t.Fatalf("Seal failed: %s", err)
+	}
+	got, err := Open(key, m, []byte("ad"))
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	if !bytes.Equal(got, []byte("attack at dawn")) {
+		t.Errorf("got %q, want %q", got, "attack at dawn")
+	}
+
+	if _, err := Open(key, m, nil); err == nil {
+		t.Error("Open succeeded with different additional data")
+	}
+	other, _ := ecdh.P256().GenerateKey(rand.Reader)
+	if _, err := Open(other, m, []byte("ad")); err == nil {
+		t.Error("Open succeeded with another key")
+	}
+	m.Nonce = m.Nonce[1:]
+	if _, err := Open(key, m, []byte("ad")); err == nil {
+		t.Error("Open succeeded with a truncated nonce")
+	}
+}
@@ -0,0 +1,290 @@
+// Package foobarpb contains the gRPC service of the enclave. Regenerate the
+// code after changing foobar.proto with go generate (requires protoc,
+// protoc-gen-go and protoc-gen-go-grpc).
+package foobarpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative foobar.proto
+
+import (
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/ecies"
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// Domain of the ErrorInfo details which carry messages.Error.
+const errorDomain = "foobar"
+
+// MarshalDeterministic is the encoding whose SHA-256 the decrypt attestation
+// commits to. Protobuf encodings are not unique, both sides must therefore
+// re-encode the message the same way.
+func MarshalDeterministic(m proto.Message) ([]byte, error) {
+	return proto.MarshalOptions{Deterministic: true}.Marshal(m)
+}
+
+// StatusFromError converts an enclave error to a gRPC status. The status code
+// is an approximation, the exact error is kept in an ErrorInfo detail.
+func StatusFromError(e *messages.Error) *status.Status {
+	code := codes.Internal
+	switch {
+	case e.Code == messages.ErrorCodeDeadlineExceeded:
+		code = codes.DeadlineExceeded
+	case e.Retryable:
+		code = codes.Unavailable
+	case e.Code == messages.ErrorCodeInvalidRequest || e.Code == messages.ErrorCodeDecryptionFailed || e.Code == messages.ErrorCodeComputationFailed || e.Code == messages.ErrorCodeResultTooLarge:
+		code = codes.InvalidArgument
+	case e.Code == messages.ErrorCodeUnauthorized || e.Code == messages.ErrorCodeAttestationRejected:
+		code = codes.PermissionDenied
+	case e.Code == messages.ErrorCodeUnknownKey || e.Code == messages.ErrorCodeSessionNotFound:
+		code = codes.NotFound
+	case e.Code == messages.ErrorCodeReplay:
+		code = codes.AlreadyExists
+	case e.Code == messages.ErrorCodeCohortTooSmall || e.Code == messages.ErrorCodeIncompatibleProtocol:
+		code = codes.FailedPrecondition
+	}
+	s, err := status.New(code, e.Message).WithDetails(&errdetails.ErrorInfo{
+		Reason:   string(e.Code),
+		Domain:   errorDomain,
+		Metadata: map[string]string{"retryable": strconv.FormatBool(e.Retryable)},
+	})
+	if err != nil {
+		return status.New(code, e.Message)
+	}
+	return s
+}
+
+// ErrorFromStatus reverses StatusFromError, so that callers can handle errors
+// the same way regardless of the protocol. Errors which didn't come from the
+// enclave's handlers, e.g. deadlines or connection failures, are returned
+// unchanged.
+func ErrorFromStatus(err error) error {
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, detail := range s.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != errorDomain {
+			continue
+		}
+		retryable, _ := strconv.ParseBool(info.Metadata["retryable"])
+		return &messages.Error{Code: messages.ErrorCode(info.Reason), Message: s.Message(), Retryable: retryable}
+	}
+	return err
+}
+
+// ResultFromMessage converts a batch decrypt result, for both sides to share
+// the conversion.
+func ResultFromMessage(r messages.BatchDecryptResult) *BatchDecryptResult {
+	result := &BatchDecryptResult{Proof: r.Proof, SignedResult: r.SignedResult}
+	if r.Result != nil {
+		result.Result = &ComputationResult{
+			Computation:    r.Result.Computation,
+			ParametersHash: r.Result.ParametersHash,
+			ModuleHash:     r.Result.ModuleHash,
+			Type:           string(r.Result.Type),
+			Value:          r.Result.Value.Value,
+		}
+	}
+	if r.Error != nil {
+		result.Error = &Error{Code: string(r.Error.Code), Message: r.Error.Message, Retryable: r.Error.Retryable}
+	}
+	return result
+}
+
+// ResultToMessage reverses ResultFromMessage.
+func ResultToMessage(r *BatchDecryptResult) messages.BatchDecryptResult {
+	result := messages.BatchDecryptResult{Proof: r.GetProof(), SignedResult: r.GetSignedResult()}
+	if r.GetResult() != nil {
+		result.Result = &messages.ComputationResult{
+			Computation:    r.GetResult().GetComputation(),
+			ParametersHash: r.GetResult().GetParametersHash(),
+			ModuleHash:     r.GetResult().GetModuleHash(),
+			Value: messages.Value{
+				Type:  messages.ValueType(r.GetResult().GetType()),
+				Value: r.GetResult().GetValue(),
+			},
+		}
+	}
+	if r.GetError() != nil {
+		result.Error = &messages.Error{
+			Code:      messages.ErrorCode(r.GetError().GetCode()),
+			Message:   r.GetError().GetMessage(),
+			Retryable: r.GetError().GetRetryable(),
+		}
+	}
+	return result
+}
+
+// ItemsFromMessages converts the items of batch requests.
+func ItemsFromMessages(items []messages.BatchDecryptItem) []*BatchDecryptItem {
+	var r []*BatchDecryptItem
+	for _, item := range items {
+		r = append(r, &BatchDecryptItem{
+			KeyId:        item.KeyId,
+			SharedSecret: item.EncryptedSharedSecret,
+			Nonce:        item.Nonce,
+			Ciphertext:   item.Ciphertext,
+			OneShotUntil: item.OneShotUntil,
+		})
+	}
+	return r
+}
+
+// ItemsToMessages reverses ItemsFromMessages.
+func ItemsToMessages(items []*BatchDecryptItem) []messages.BatchDecryptItem {
+	r := make([]messages.BatchDecryptItem, len(items))
+	for i, item := range items {
+		r[i] = messages.BatchDecryptItem{
+			KeyId:                 item.GetKeyId(),
+			EncryptedSharedSecret: item.GetSharedSecret(),
+			Nonce:                 item.GetNonce(),
+			Ciphertext:            item.GetCiphertext(),
+			OneShotUntil:          item.GetOneShotUntil(),
+		}
+	}
+	return r
+}
+
+// AggregateParametersFromMessage converts aggregate parameters.
+func AggregateParametersFromMessage(p messages.AggregateParameters) *AggregateParameters {
+	r := &AggregateParameters{MinCohort: int64(p.MinCohort), Epsilon: p.Epsilon, Buckets: p.Buckets}
+	if p.Bounds != nil {
+		r.Bounds = &AggregateBounds{Lower: p.Bounds.Lower, Upper: p.Bounds.Upper}
+	}
+	return r
+}
+
+// AggregateParametersToMessage reverses AggregateParametersFromMessage.
+func AggregateParametersToMessage(p *AggregateParameters) messages.AggregateParameters {
+	r := messages.AggregateParameters{MinCohort: int(p.GetMinCohort()), Epsilon: p.GetEpsilon(), Buckets: p.GetBuckets()}
+	if p.GetBounds() != nil {
+		r.Bounds = &messages.AggregateBounds{Lower: p.GetBounds().GetLower(), Upper: p.GetBounds().GetUpper()}
+	}
+	return r
+}
+
+// AggregateResultFromMessage converts an aggregate result.
+func AggregateResultFromMessage(r messages.AggregateResult) *AggregateResult {
+	result := &AggregateResult{Count: r.Count, Sum: r.Sum, Mean: r.Mean, Histogram: r.Histogram}
+	if r.Rejected != nil {
+		rejected := int64(*r.Rejected)
+		result.Rejected = &rejected
+	}
+	return result
+}
+
+// AggregateResultToMessage reverses AggregateResultFromMessage.
+func AggregateResultToMessage(r *AggregateResult) messages.AggregateResult {
+	result := messages.AggregateResult{
+		Count:     r.GetCount(),
+		Sum:       r.GetSum(),
+		Mean:      r.GetMean(),
+		Histogram: r.GetHistogram(),
+	}
+	if r.Rejected != nil {
+		rejected := int(r.GetRejected())
+		result.Rejected = &rejected
+	}
+	return result
+}
+
+// KeysFromMessages converts the keys of a ListKeys response.
+func KeysFromMessages(keys []messages.Key) []*Key {
+	var r []*Key
+	for _, key := range keys {
+		r = append(r, &Key{
+			KeyId:      key.KeyId,
+			Region:     key.Region,
+			PublicKey:  key.PublicKey,
+			PolicyHash: key.PolicyHash,
+			CreatedAt:  key.CreatedAt.UnixNano(),
+		})
+	}
+	return r
+}
+
+// KeysToMessages reverses KeysFromMessages.
+func KeysToMessages(keys []*Key) []messages.Key {
+	r := make([]messages.Key, len(keys))
+	for i, key := range keys {
+		r[i] = messages.Key{
+			KeyId:      key.GetKeyId(),
+			Region:     key.GetRegion(),
+			PublicKey:  key.GetPublicKey(),
+			PolicyHash: key.GetPolicyHash(),
+			CreatedAt:  time.Unix(0, key.GetCreatedAt()).UTC(),
+		}
+	}
+	return r
+}
+
+// StatusFromMessage converts the status of a Status response.
+func StatusFromMessage(s messages.EnclaveStatus) *EnclaveStatus {
+	return &EnclaveStatus{
+		BuildVersion: s.BuildVersion,
+		UptimeMs:     s.UptimeMs,
+		RsaKey: &RsaKey{
+			Bits:        int64(s.RsaKey.Bits),
+			Fingerprint: s.RsaKey.Fingerprint,
+			GeneratedAt: s.RsaKey.GeneratedAt.UnixNano(),
+		},
+		KeyIds:       s.KeyIds,
+		OpenSessions: int64(s.OpenSessions),
+		Requests:     s.Requests,
+		Errors:       s.Errors,
+		Panics:       s.Health.Panics,
+	}
+}
+
+// StatusToMessage reverses StatusFromMessage.
+func StatusToMessage(s *EnclaveStatus) messages.EnclaveStatus {
+	return messages.EnclaveStatus{
+		BuildVersion: s.GetBuildVersion(),
+		UptimeMs:     s.GetUptimeMs(),
+		RsaKey: messages.RsaKey{
+			Bits:        int(s.GetRsaKey().GetBits()),
+			Fingerprint: s.GetRsaKey().GetFingerprint(),
+			GeneratedAt: time.Unix(0, s.GetRsaKey().GetGeneratedAt()).UTC(),
+		},
+		KeyIds:       s.GetKeyIds(),
+		OpenSessions: int(s.GetOpenSessions()),
+		Requests:     s.GetRequests(),
+		Errors:       s.GetErrors(),
+		Health:       messages.Health{Panics: s.GetPanics()},
+	}
+}
+
+// SealedFromMessage converts a sealed message.
+func SealedFromMessage(m ecies.Message) *SealedMessage {
+	return &SealedMessage{EphemeralKey: m.EphemeralKey, Nonce: m.Nonce, Ciphertext: m.Ciphertext}
+}
+
+// SealedToMessage reverses SealedFromMessage.
+func SealedToMessage(m *SealedMessage) ecies.Message {
+	return ecies.Message{EphemeralKey: m.GetEphemeralKey(), Nonce: m.GetNonce(), Ciphertext: m.GetCiphertext()}
+}
+
+// SealedFromMessages converts sealed messages.
+func SealedFromMessages(elements []ecies.Message) []*SealedMessage {
+	var r []*SealedMessage
+	for _, e := range elements {
+		r = append(r, SealedFromMessage(e))
+	}
+	return r
+}
+
+// SealedToMessages reverses SealedFromMessages.
+func SealedToMessages(elements []*SealedMessage) []ecies.Message {
+	var r []ecies.Message
+	for _, e := range elements {
+		r = append(r, SealedToMessage(e))
+	}
+	return r
+}
@@ -1,3 +1,19 @@
 module github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared
 
 go 1.21.4
+
+require (
+	github.com/mdlayher/vsock v1.2.1
+	golang.org/x/crypto v0.27.0
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240528184218-531527333157
+	google.golang.org/grpc v1.65.0
+	google.golang.org/protobuf v1.34.2
+)
+
+require (
+	github.com/mdlayher/socket v0.4.1 // indirect
+	golang.org/x/net v0.25.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.25.0 // indirect
+	golang.org/x/text v0.18.0 // indirect
+)
@@ -0,0 +1,116 @@
+// Package merkle implements the Merkle tree of RFC 6962 (Certificate
+// Transparency), along with its inclusion proofs. Leaves and interior nodes are
+// hashed with different prefixes, so that a leaf can't pass for a node.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// LeafHash returns the hash of a leaf's data.
+func LeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Root returns the root of the tree whose leaves have the given hashes. The
+// tree must not be empty.
+func Root(leafHashes [][]byte) []byte {
+	if len(leafHashes) == 1 {
+		return leafHashes[0]
+	}
+	k := split(len(leafHashes))
+	return nodeHash(Root(leafHashes[:k]), Root(leafHashes[k:]))
+}
+
+// Proof returns the inclusion proof of leaf index, from the leaf up to the
+// root.
+func Proof(leafHashes [][]byte, index int) [][]byte {
+	if len(leafHashes) == 1 {
+		return [][]byte{}
+	}
+	k := split(len(leafHashes))
+	if index < k {
+		return append(Proof(leafHashes[:k], index), Root(leafHashes[k:]))
+	}
+	return append(Proof(leafHashes[k:], index-k), Root(leafHashes[:k]))
+}
+
+// Proofs returns the inclusion proofs of all the leaves, in one pass over the
+// tree, rather than one per leaf.
+func Proofs(leafHashes [][]byte) [][][]byte {
+	proofs := make([][][]byte, len(leafHashes))
+	proofsInto(leafHashes, proofs)
+	return proofs
+}
+
+// proofsInto fills proofs and returns the root.
+func proofsInto(leafHashes [][]byte, proofs [][][]byte) []byte {
+	if len(leafHashes) == 1 {
+		proofs[0] = [][]byte{}
+		return leafHashes[0]
+	}
+	k := split(len(leafHashes))
+	left := proofsInto(leafHashes[:k], proofs[:k])
+	right := proofsInto(leafHashes[k:], proofs[k:])
+	for i := range proofs[:k] {
+		proofs[i] = append(proofs[i], right)
+	}
+	for i := range proofs[k:] {
+		proofs[k+i] = append(proofs[k+i], left)
+	}
+	return nodeHash(left, right)
+}
+
+var ErrInvalidProof = errors.New("invalid inclusion proof")
+
+// Verify checks that leafHash is leaf index of the tree of the given size and
+// root. It follows RFC 9162, section 2.1.3.2.
+func Verify(root, leafHash []byte, index, size int, proof [][]byte) error {
+	if index < 0 || index >= size {
+		return ErrInvalidProof
+	}
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range proof {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(r, root) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// split returns the largest power of two smaller than n, n > 1.
+func split(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
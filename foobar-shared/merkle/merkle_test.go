@@ -0,0 +1,70 @@
+package merkle
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func leaves(n int) [][]byte {
+	var hashes [][]byte
+	for i := 0; i < n; i++ {
+		hashes = append(hashes, LeafHash([]byte(fmt.Sprintf("leaf %d", i))))
+	}
+	return hashes
+}
+
+func TestProofs(t *testing.T) {
+	for size := 1; size <= 17; size++ {
+		hashes := leaves(size)
+		root := Root(hashes)
+		proofs := Proofs(hashes)
+		for i := 0; i < size; i++ {
+			proof := Proof(hashes, i)
+			if err := Verify(root, hashes[i], i, size, proof); err != nil {
+				t.Errorf("size %d, leaf %d: %s", size, i, err)
+			}
+			if fmt.Sprint(proofs[i]) != fmt.Sprint(proof) {
+				t.Errorf("size %d, leaf %d: Proofs and Proof differ", size, i)
+			}
+		}
+	}
+}
+
+func TestInvalidProofs(t *testing.T) {
+	hashes := leaves(5)
+	root := Root(hashes)
+	proof := Proof(hashes, 2)
+
+	tests := []struct {
+		name  string
+		leaf  []byte
+		index int
+		size  int
+		proof [][]byte
+	}{
+		{"other leaf", hashes[3], 2, 5, proof},
+		{"other index", hashes[2], 3, 5, proof},
+		{"other size", hashes[2], 2, 9, proof},
+		{"index out of range", hashes[2], 5, 5, proof},
+		{"truncated proof", hashes[2], 2, 5, proof[:len(proof)-1]},
+		{"extended proof", hashes[2], 2, 5, append(append([][]byte{}, proof...), root)},
+	}
+	for _, tt := range tests {
+		if err := Verify(root, tt.leaf, tt.index, tt.size, tt.proof); err != ErrInvalidProof {
+			t.Errorf("%s: got %v, want ErrInvalidProof", tt.name, err)
+		}
+	}
+}
+
+// A single leaf is the root. Otherwise, nodes are hashed differently from
+// leaves.
+func TestRoot(t *testing.T) {
+	hashes := leaves(2)
+	if got := Root(hashes[:1]); !bytes.Equal(got, hashes[0]) {
+		t.Errorf("got %02x, want %02x", got, hashes[0])
+	}
+	if got, want := Root(hashes), nodeHash(hashes[0], hashes[1]); !bytes.Equal(got, want) {
+		t.Errorf("got %02x, want %02x", got, want)
+	}
+}
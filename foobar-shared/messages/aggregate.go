@@ -0,0 +1,160 @@
+package messages
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Requests aggregate statistics over many ciphertexts, whose plaintexts are
+// decimal numbers. Only the aggregates leave the enclave, never the individual
+// values. The items and the other fields mean the same as in
+// BatchDecryptRequest, except that the ciphertexts must be bound to
+// PurposeAggregate (see Binding), and that an item can only appear once.
+type AggregateRequest struct {
+	SessionId        string              `json:"sessionId,omitempty"`
+	AttestationNonce []byte              `json:"attestationNonce,omitempty"`
+	Parameters       AggregateParameters `json:"parameters"`
+	Items            []BatchDecryptItem  `json:"items"`
+}
+
+// MinCohort, if set, is the minimum number of values the enclave aggregates:
+// smaller cohorts fail with COHORT_TOO_SMALL. With Epsilon, the noisy count is
+// compared to it, the outcome doesn't reveal the exact count.
+//
+// Values are clamped to Bounds, if set. Epsilon, if set, adds differential
+// privacy: the enclave adds Laplace noise to the count, the sum and the
+// histogram, splitting epsilon between them. The mean is derived from the noisy
+// sum and count. Epsilon requires Bounds, which determine how much a single
+// value can change the sum. Epsilon is the privacy loss of this query only: the
+// enclave keeps no budget across queries, and the losses of repeated queries
+// over the same values add up.
+//
+// Buckets, if set, are the ascending boundaries of a histogram. Bucket i counts
+// the values below Buckets[i] and at or above Buckets[i-1], the last bucket
+// counts the values at or above the last boundary.
+type AggregateParameters struct {
+	MinCohort int              `json:"minCohort,omitempty"`
+	Epsilon   float64          `json:"epsilon,omitempty"`
+	Bounds    *AggregateBounds `json:"bounds,omitempty"`
+	Buckets   []float64        `json:"buckets,omitempty"`
+}
+
+type AggregateBounds struct {
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+}
+
+// The enclave rejects histograms with more boundaries.
+const MaxAggregateBuckets = 1000
+
+func (r *AggregateRequest) Validate() error {
+	if len(r.Items) == 0 || len(r.Items) > MaxBatchDecryptItems {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: fmt.Sprintf("got %d items, expected 1 to %d", len(r.Items), MaxBatchDecryptItems)}
+	}
+	if err := r.Parameters.validate(); err != nil {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: err.Error()}
+	}
+	// A repeated item would count its value more than once, which the noise
+	// isn't scaled to.
+	seen := map[[sha256.Size]byte]bool{}
+	for _, item := range r.Items {
+		digest := sha256.Sum256(append(append([]byte{}, item.Nonce...), item.Ciphertext...))
+		if seen[digest] {
+			return &Error{Code: ErrorCodeInvalidRequest, Message: "a ciphertext appears more than once"}
+		}
+		seen[digest] = true
+	}
+	return validateAttestationNonce(r.AttestationNonce)
+}
+
+func (p AggregateParameters) validate() error {
+	finite := func(f float64) bool { return !math.IsNaN(f) && !math.IsInf(f, 0) }
+	if p.MinCohort < 0 {
+		return fmt.Errorf("invalid minCohort: %d", p.MinCohort)
+	}
+	if p.Epsilon < 0 || !finite(p.Epsilon) {
+		return fmt.Errorf("invalid epsilon: %g", p.Epsilon)
+	}
+	if p.Bounds != nil && (!finite(p.Bounds.Lower) || !finite(p.Bounds.Upper) || p.Bounds.Lower >= p.Bounds.Upper) {
+		return fmt.Errorf("invalid bounds: [%g, %g]", p.Bounds.Lower, p.Bounds.Upper)
+	}
+	if p.Epsilon > 0 && p.Bounds == nil {
+		return fmt.Errorf("epsilon requires bounds")
+	}
+	if len(p.Buckets) > MaxAggregateBuckets {
+		return fmt.Errorf("got %d buckets, at most %d are allowed", len(p.Buckets), MaxAggregateBuckets)
+	}
+	for i, b := range p.Buckets {
+		if !finite(b) || (i > 0 && b <= p.Buckets[i-1]) {
+			return fmt.Errorf("buckets must be finite and ascending")
+		}
+	}
+	return nil
+}
+
+// Response is an attestation which contains
+// AggregateResponseAttestationUserData, and the result it commits to.
+// SignedResult is the same user data and result, signed with the enclave's
+// signing key (see package signing).
+type AggregateResponse struct {
+	Attestation  []byte          `json:"attestation"`
+	Result       AggregateResult `json:"result"`
+	SignedResult string          `json:"signedResult,omitempty"`
+}
+
+// Rejected is the number of items which couldn't be decrypted or aren't
+// numbers. They are left out of the aggregates. With Epsilon, Rejected is
+// unset: the caller knows how many items it sent, the exact number of rejected
+// items would reveal the exact count.
+type AggregateResult struct {
+	Count     float64   `json:"count"`
+	Sum       float64   `json:"sum"`
+	Mean      float64   `json:"mean"`
+	Histogram []float64 `json:"histogram,omitempty"`
+	Rejected  *int      `json:"rejected,omitempty"`
+}
+
+// InitialRequest is the SHA-256 of the AggregateRequest, as in
+// DecryptResponseAttestationUserData. InputDigest identifies the set of items,
+// see InputSetDigest. The parameters and the result are committed to by their
+// hashes, see AggregateParameters.Hash and AggregateResult.Hash: the NSM
+// limits user data to 512 bytes, which a histogram can exceed.
+type AggregateResponseAttestationUserData struct {
+	InitialRequest []byte `json:"request"`
+	InputDigest    []byte `json:"inputDigest"`
+	ParametersHash []byte `json:"parametersHash"`
+	ResultHash     []byte `json:"resultHash"`
+}
+
+// Hash is the SHA-256 of the JSON encoding of the parameters.
+func (p AggregateParameters) Hash() []byte {
+	b, _ := json.Marshal(p)
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+// Hash is the SHA-256 of the JSON encoding of the result.
+func (r AggregateResult) Hash() []byte {
+	b, _ := json.Marshal(r)
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+// InputSetDigest is the SHA-256 of the sorted digests of the items (see
+// BatchDecryptItem.Digest). It doesn't depend on the order of the items.
+func InputSetDigest(items []BatchDecryptItem) []byte {
+	digests := make([][]byte, len(items))
+	for i, item := range items {
+		digests[i] = item.Digest()
+	}
+	sort.Slice(digests, func(i, j int) bool { return bytes.Compare(digests[i], digests[j]) < 0 })
+	h := sha256.New()
+	for _, digest := range digests {
+		h.Write(digest)
+	}
+	return h.Sum(nil)
+}
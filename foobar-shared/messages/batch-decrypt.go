@@ -0,0 +1,91 @@
+package messages
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/merkle"
+)
+
+// Requests the decryption of many ciphertexts at once, with a single
+// attestation. The items are decrypted concurrently. SessionId, if set, is the
+// decrypt session whose RSA key KMS encrypted all the shared secrets to, the
+// session ends with the batch. The computation runs on each plaintext. The
+// other fields mean the same as in DecryptRequest.
+type BatchDecryptRequest struct {
+	SessionId        string             `json:"sessionId,omitempty"`
+	AttestationNonce []byte             `json:"attestationNonce,omitempty"`
+	Computation      string             `json:"computation,omitempty"`
+	Parameters       []byte             `json:"parameters,omitempty"`
+	WasmModule       []byte             `json:"wasmModule,omitempty"`
+	Items            []BatchDecryptItem `json:"items"`
+}
+
+// The enclave rejects larger batches.
+const MaxBatchDecryptItems = 4096
+
+type BatchDecryptItem struct {
+	KeyId                 string `json:"keyId"`
+	EncryptedSharedSecret []byte `json:"sharedSecret"`
+	Nonce                 []byte `json:"nonce"`
+	Ciphertext            []byte `json:"ciphertext"`
+	OneShotUntil          int64  `json:"oneShotUntil,omitempty"`
+}
+
+func (r *BatchDecryptRequest) Validate() error {
+	if len(r.Items) == 0 || len(r.Items) > MaxBatchDecryptItems {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: fmt.Sprintf("got %d items, expected 1 to %d", len(r.Items), MaxBatchDecryptItems)}
+	}
+	if err := validateComputation(r.Computation, r.Parameters, r.WasmModule); err != nil {
+		return err
+	}
+	return validateAttestationNonce(r.AttestationNonce)
+}
+
+// Digest identifies the item in the Merkle tree: it is the SHA-256 of the
+// item's JSON encoding, regardless of the protocol.
+func (i BatchDecryptItem) Digest() []byte {
+	b, _ := json.Marshal(i)
+	digest := sha256.Sum256(b)
+	return digest[:]
+}
+
+// Response is an attestation which contains
+// BatchDecryptResponseAttestationUserData, and the result of each item, in the
+// order of the items.
+type BatchDecryptResponse struct {
+	Attestation []byte               `json:"attestation"`
+	Results     []BatchDecryptResult `json:"results"`
+}
+
+// Error is set instead of Result if the item failed. Proof is the inclusion
+// proof of the item's leaf in the attested Merkle tree. SignedResult is Result,
+// signed with the enclave's signing key (see package signing), and isn't part
+// of the leaf.
+type BatchDecryptResult struct {
+	Result       *ComputationResult `json:"result,omitempty"`
+	Error        *Error             `json:"error,omitempty"`
+	Proof        [][]byte           `json:"proof"`
+	SignedResult string             `json:"signedResult,omitempty"`
+}
+
+// LeafHash returns the hash of the item's leaf in the Merkle tree. The leaf is
+// the JSON encoding of the item's digest and result, without the proof.
+func (r BatchDecryptResult) LeafHash(itemDigest []byte) []byte {
+	b, _ := json.Marshal(struct {
+		Request []byte             `json:"request"`
+		Result  *ComputationResult `json:"result,omitempty"`
+		Error   *Error             `json:"error,omitempty"`
+	}{itemDigest, r.Result, r.Error})
+	return merkle.LeafHash(b)
+}
+
+// InitialRequest is the SHA-256 of the BatchDecryptRequest, as in
+// DecryptResponseAttestationUserData. MerkleRoot is the root of the Merkle
+// tree whose Size leaves are the items' results.
+type BatchDecryptResponseAttestationUserData struct {
+	InitialRequest []byte `json:"request"`
+	MerkleRoot     []byte `json:"merkleRoot"`
+	Size           int    `json:"size"`
+}
@@ -0,0 +1,136 @@
+package messages
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+)
+
+// DecryptRequest and BatchDecryptRequest name the computation the enclave runs
+// on the plaintexts, and its parameters. The parameters are opaque bytes,
+// usually JSON, whose meaning depends on the computation. Instead of naming
+// one, requests can carry a WebAssembly module.
+
+// Used when the request doesn't name a computation. It counts the letter 'a'.
+const DefaultComputation = "count"
+
+// The enclave rejects larger parameters.
+const MaxParametersSize = 64 * 1024
+
+// Computation of requests which carry a WebAssembly module. The module
+// computes the result, see foobar-enclave/computations for the interface it
+// must export.
+const WasmComputation = "wasm"
+
+// The enclave rejects larger WebAssembly modules.
+const MaxWasmModuleSize = 8 << 20
+
+func validateComputation(computation string, parameters []byte, wasmModule []byte) error {
+	if len(computation) > 128 {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: "computation name is too long"}
+	}
+	if len(parameters) > MaxParametersSize {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: fmt.Sprintf("parameters are %d bytes, at most %d are allowed", len(parameters), MaxParametersSize)}
+	}
+	if len(wasmModule) > 0 {
+		if computation != "" && computation != WasmComputation {
+			return &Error{Code: ErrorCodeInvalidRequest, Message: fmt.Sprintf("a WebAssembly module was sent for computation %q", computation)}
+		}
+		if len(wasmModule) > MaxWasmModuleSize {
+			return &Error{Code: ErrorCodeInvalidRequest, Message: fmt.Sprintf("wasmModule is %d bytes, at most %d are allowed", len(wasmModule), MaxWasmModuleSize)}
+		}
+	}
+	return nil
+}
+
+// ModuleHash returns the SHA-256 of a WebAssembly module, as recorded in
+// ComputationResult.
+func ModuleHash(module []byte) []byte {
+	h := sha256.Sum256(module)
+	return h[:]
+}
+
+// ParametersHash returns the SHA-256 of the parameters, as recorded in
+// ComputationResult.
+func ParametersHash(parameters []byte) []byte {
+	h := sha256.Sum256(parameters)
+	return h[:]
+}
+
+// The types of computation results.
+type ValueType string
+
+const (
+	ValueTypeInt    ValueType = "int"
+	ValueTypeBool   ValueType = "bool"
+	ValueTypeString ValueType = "string"
+	ValueTypeBytes  ValueType = "bytes"
+)
+
+// Value is a typed computation result. Value holds the JSON encoding of a Go
+// value of the corresponding type, e.g. a number for ValueTypeInt or a base64
+// string for ValueTypeBytes.
+type Value struct {
+	Type  ValueType       `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+func newValue(t ValueType, v any) Value {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return Value{Type: t, Value: b}
+}
+
+func IntValue(v int64) Value     { return newValue(ValueTypeInt, v) }
+func BoolValue(v bool) Value     { return newValue(ValueTypeBool, v) }
+func StringValue(v string) Value { return newValue(ValueTypeString, v) }
+func BytesValue(v []byte) Value  { return newValue(ValueTypeBytes, v) }
+
+func (v Value) decode(t ValueType, dst any) error {
+	if v.Type != t {
+		return fmt.Errorf("value is of type %q, not %q", v.Type, t)
+	}
+	return json.Unmarshal(v.Value, dst)
+}
+
+func (v Value) Int() (int64, error) {
+	var i int64
+	err := v.decode(ValueTypeInt, &i)
+	return i, err
+}
+
+func (v Value) Bool() (bool, error) {
+	var b bool
+	err := v.decode(ValueTypeBool, &b)
+	return b, err
+}
+
+func (v Value) Text() (string, error) {
+	var s string
+	err := v.decode(ValueTypeString, &s)
+	return s, err
+}
+
+func (v Value) Bytes() ([]byte, error) {
+	var b []byte
+	err := v.decode(ValueTypeBytes, &b)
+	return b, err
+}
+
+// String formats the value for humans.
+func (v Value) String() string {
+	return string(v.Value)
+}
+
+// ComputationResult is the attested result of a computation. It records which
+// computation ran, and with which parameters. ModuleHash is set if the
+// computation is a WebAssembly module, whether it came with the request or was
+// registered in the enclave.
+type ComputationResult struct {
+	Computation    string `json:"computation"`
+	ParametersHash []byte `json:"parametersHash"`
+	ModuleHash     []byte `json:"moduleHash,omitempty"`
+	Value
+}
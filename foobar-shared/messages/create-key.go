@@ -6,6 +6,15 @@ type CreateKeyRequest struct {
 	AccountId   string      `json:"accountId"`
 	AwsIamRole  string      `json:"awsIamRole"`
 	Credentials Credentials `json:"credentials"`
+
+	AttestationNonce []byte `json:"attestationNonce,omitempty"`
+}
+
+func (r *CreateKeyRequest) Validate() error {
+	if r.Region == "" || r.AccountId == "" || r.AwsIamRole == "" {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: "region, accountId and awsIamRole are required"}
+	}
+	return validateAttestationNonce(r.AttestationNonce)
 }
 
 // Response is an attestation which contains the keyid and related information.
@@ -13,10 +22,13 @@ type CreateKeyResponse struct {
 	Attestation []byte `json:"attestation"`
 }
 
+// PolicyHash is the SHA-256 of the key policy, see Key. It lets the enclave
+// restore the key after a restart, see RegisterKeyRequest.
 type CreateKeyResponseAttestationUserData struct {
-	KeyId     string `json:"keyId"`
-	PublicKey []byte `json:"pubKey"`
-	Region    string
+	KeyId      string `json:"keyId"`
+	PublicKey  []byte `json:"pubKey"`
+	Region     string
+	PolicyHash []byte `json:"policyHash,omitempty"`
 }
 
 // Credentials struct as returned by
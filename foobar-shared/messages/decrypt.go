@@ -1,21 +1,111 @@
 package messages
 
+import (
+	"fmt"
+	"strings"
+)
+
 // Requests decryption. EncryptedCek comes from KMS and is formatted as CMS.
 // RSA is used to encrypt an AES key, which then encrypts the CEK with AES-CMS.
+//
+// KeyId is the KMS key the shared secret was derived with. The enclave only
+// decrypts with keys it created. It is bound to the ciphertext as AES-GCM
+// additional data: the enclave can't tell which key KMS used, but a ciphertext
+// only decrypts under the key id it was encrypted for.
+//
+// SessionId is the decrypt session whose RSA key KMS encrypted the shared
+// secret to (see GetAttestationRequest). Without it, the enclave uses its
+// current or previous RSA key.
+//
+// Computation is run on the plaintext, with Parameters. It defaults to
+// DefaultComputation, or to WasmComputation if WasmModule is set.
+//
+// OneShotUntil, if set, comes from a one-shot ciphertext: the enclave decrypts
+// it at most once, and only until then (Unix seconds). It is bound to the
+// ciphertext as AES-GCM additional data, see AdditionalData.
 type DecryptRequest struct {
+	KeyId                 string `json:"keyId"`
+	SessionId             string `json:"sessionId,omitempty"`
 	EncryptedSharedSecret []byte `json:"sharedSecret"`
 	Nonce                 []byte `json:"nonce"`
 	Ciphertext            []byte `json:"ciphertext"`
+	AttestationNonce      []byte `json:"attestationNonce,omitempty"`
+	OneShotUntil          int64  `json:"oneShotUntil,omitempty"`
+	Computation           string `json:"computation,omitempty"`
+	Parameters            []byte `json:"parameters,omitempty"`
+	WasmModule            []byte `json:"wasmModule,omitempty"`
+}
+
+func (r *DecryptRequest) Validate() error {
+	if r.KeyId == "" {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: "keyId is required"}
+	}
+	if r.OneShotUntil < 0 {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: fmt.Sprintf("invalid oneShotUntil: %d", r.OneShotUntil)}
+	}
+	if err := validateComputation(r.Computation, r.Parameters, r.WasmModule); err != nil {
+		return err
+	}
+	return validateAttestationNonce(r.AttestationNonce)
+}
+
+// Binding restricts what the enclave does with a ciphertext. It is part of the
+// ciphertext's AES-GCM additional data, and isn't sent along with it: the
+// enclave derives it from the request, a ciphertext therefore only decrypts
+// for the use it is bound to.
+type Binding struct {
+	// RecipientHash is the SHA-256 of the only recipient public key the
+	// ciphertext can be re-encrypted to (see ReEncryptRequest). Such a
+	// ciphertext can't be used otherwise.
+	RecipientHash []byte
+
+	// Party names the party which supplies the ciphertext to an intersection
+	// (see IntersectRequest). Such a ciphertext can only be part of that
+	// party's set.
+	Party string
+
+	// Purpose restricts the ciphertext to one operation, e.g. PurposeAggregate.
+	// Such a ciphertext can't be decrypted, batch decrypted or re-encrypted.
+	Purpose string
+}
+
+// PurposeAggregate binds a ciphertext to aggregates (see AggregateRequest): its
+// plaintext never leaves the enclave on its own.
+const PurposeAggregate = "aggregate"
+
+// AdditionalData returns the AES-GCM additional data of a ciphertext encrypted
+// for keyId, so that the key id, the one-shot flag and the binding can't be
+// changed or removed.
+func AdditionalData(keyId string, oneShotUntil int64, binding Binding) []byte {
+	parts := []string{fmt.Sprintf("foobar-key:%q", keyId)}
+	if oneShotUntil != 0 {
+		parts = append(parts, fmt.Sprintf("foobar-one-shot-until:%d", oneShotUntil))
+	}
+	if binding.RecipientHash != nil {
+		parts = append(parts, fmt.Sprintf("foobar-recipient:%x", binding.RecipientHash))
+	}
+	if binding.Party != "" {
+		parts = append(parts, fmt.Sprintf("foobar-party:%q", binding.Party))
+	}
+	if binding.Purpose != "" {
+		parts = append(parts, fmt.Sprintf("foobar-purpose:%q", binding.Purpose))
+	}
+	return []byte(strings.Join(parts, "\n"))
 }
 
 // Response is an attestation which contains DecryptResponseAttestationUserData.
+// SignedResult is the same result, signed with the enclave's signing key (see
+// package signing).
 type DecryptResponse struct {
-	Attestation []byte `json:"attestation"`
+	Attestation  []byte `json:"attestation"`
+	SignedResult string `json:"signedResult,omitempty"`
 }
 
 // InitialRequest is a SHA-256 of the DecryptRequest and is used to tie the
-// request with the result.
+// request with the result. Over gRPC, the hash covers the deterministic
+// protobuf encoding of the request.
 type DecryptResponseAttestationUserData struct {
-	InitialRequest []byte `json:"request"`
-	Count          int    `json:"count"`
+	InitialRequest []byte            `json:"request"`
+	KeyId          string            `json:"keyId"`
+	Result         ComputationResult `json:"result"`
 }
@@ -0,0 +1,95 @@
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type ErrorCode string
+
+const (
+	// The request is malformed or has missing or invalid fields. Retrying the
+	// same request fails again.
+	ErrorCodeInvalidRequest ErrorCode = "INVALID_REQUEST"
+
+	// The Nitro Secure Module failed, e.g. while generating an attestation.
+	ErrorCodeNsmFailure ErrorCode = "NSM_FAILURE"
+
+	// A call to AWS KMS failed. Retryable is set for throttling and network
+	// errors, but not e.g. for access denied errors.
+	ErrorCodeKmsFailure ErrorCode = "KMS_FAILURE"
+
+	// The encrypted shared secret or the ciphertext could not be decrypted,
+	// e.g. because it was tampered with or encrypted for a different key.
+	ErrorCodeDecryptionFailed ErrorCode = "DECRYPTION_FAILED"
+
+	// The key isn't one the enclave created, or the enclave restarted since it
+	// created it.
+	ErrorCodeUnknownKey ErrorCode = "UNKNOWN_KEY"
+
+	// The decrypt session doesn't exist, expired or was already used. A new
+	// session is needed.
+	ErrorCodeSessionNotFound ErrorCode = "SESSION_NOT_FOUND"
+
+	// The one-shot ciphertext was already decrypted.
+	ErrorCodeReplay ErrorCode = "REPLAY"
+
+	// The computation failed on the plaintext, e.g. a WebAssembly module
+	// trapped or ran out of fuel.
+	ErrorCodeComputationFailed ErrorCode = "COMPUTATION_FAILED"
+
+	// An aggregate would cover fewer values than the requested minimum cohort,
+	// or a set of an intersection fewer than the enclave's minimum.
+	ErrorCodeCohortTooSmall ErrorCode = "COHORT_TOO_SMALL"
+
+	// The result doesn't fit in the attestation: the NSM limits user data to
+	// 512 bytes. batch-decrypt, whose attestation commits to the results by a
+	// Merkle root, doesn't have this limit.
+	ErrorCodeResultTooLarge ErrorCode = "RESULT_TOO_LARGE"
+
+	// The request didn't complete in time, either because of the client's
+	// timeout or the operation's.
+	ErrorCodeDeadlineExceeded ErrorCode = "DEADLINE_EXCEEDED"
+
+	// The enclave is shutting down.
+	ErrorCodeUnavailable ErrorCode = "UNAVAILABLE"
+
+	// An attestation sent to the enclave doesn't chain to the NSM's root, or
+	// was produced by a different enclave image.
+	ErrorCodeAttestationRejected ErrorCode = "ATTESTATION_REJECTED"
+
+	// The client is not allowed to use the enclave.
+	ErrorCodeUnauthorized ErrorCode = "UNAUTHORIZED"
+
+	// The client speaks another protocol version than the enclave, see
+	// ProtocolVersion.
+	ErrorCodeIncompatibleProtocol ErrorCode = "INCOMPATIBLE_PROTOCOL"
+
+	// Any other failure inside the enclave.
+	ErrorCodeInternal ErrorCode = "INTERNAL"
+)
+
+// Error is returned by the enclave instead of a response. It implements the
+// error interface, callers can use errors.As and branch on Code.
+type Error struct {
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+	Retryable bool      `json:"retryable"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// UnmarshalJSON also accepts the bare strings sent by enclaves which predate
+// error codes. Code is left empty, so that the handshake can report them as
+// incompatible.
+func (e *Error) UnmarshalJSON(b []byte) error {
+	var message string
+	if err := json.Unmarshal(b, &message); err == nil {
+		*e = Error{Message: message}
+		return nil
+	}
+	type plain Error
+	return json.Unmarshal(b, (*plain)(e))
+}
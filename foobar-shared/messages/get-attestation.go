@@ -1,11 +1,57 @@
 package messages
 
+import "time"
+
 // Requests a fresh attestation. KMS requires attestations no older than
 // 5 minutes.
+//
+// OpenSession opens a decrypt session: the attestation then carries a fresh RSA
+// key, which decrypts a single DecryptRequest with the same SessionId. The
+// enclave destroys the key after that use, or once the session expires, so
+// that a later compromise doesn't expose the shared secret.
+//
+// SessionId attests the key of an open session again and restarts its
+// expiry, for clients which need KMS to encrypt more shared secrets to it than
+// one attestation's 5 minutes allow.
 type GetAttestationRequest struct {
+	OpenSession      bool   `json:"openSession,omitempty"`
+	SessionId        string `json:"sessionId,omitempty"`
+	AttestationNonce []byte `json:"attestationNonce,omitempty"`
+}
+
+func (r *GetAttestationRequest) Validate() error {
+	if r.OpenSession && r.SessionId != "" {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: "openSession and sessionId are mutually exclusive"}
+	}
+	return validateAttestationNonce(r.AttestationNonce)
 }
 
-// Returns an attestation. The public_key contains an ephemeral RSA key.
+// Returns an attestation. The public_key contains the session's RSA key, or the
+// enclave's current RSA key without a session. The user_data contains
+// GetAttestationResponseAttestationUserData.
 type GetAttestationResponse struct {
 	Attestation []byte `json:"attestation"`
+	SessionId   string `json:"sessionId,omitempty"`
+}
+
+type GetAttestationResponseAttestationUserData struct {
+	RsaKey    RsaKey `json:"rsaKey"`
+	SessionId string `json:"sessionId,omitempty"`
+	Health    Health `json:"health"`
+}
+
+// RsaKey describes an ephemeral RSA key of the enclave. Fingerprint is the
+// SHA-256 of the public key (PKIX, DER), i.e. of the attestation's public_key.
+// The enclave rotates the key, the previous key keeps decrypting for a while.
+type RsaKey struct {
+	Bits        int       `json:"bits"`
+	Fingerprint []byte    `json:"fingerprint"`
+	GeneratedAt time.Time `json:"generatedAt"`
+}
+
+// Health counters, since the enclave started.
+type Health struct {
+	// Panics which were recovered from. The enclave kept running, but a
+	// non-zero value points at a bug.
+	Panics uint64 `json:"panics"`
 }
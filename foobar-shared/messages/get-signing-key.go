@@ -0,0 +1,26 @@
+package messages
+
+// Requests the enclave's signing key, which signs the computation results of
+// DecryptResponse and BatchDecryptResult (see package signing). The enclave
+// generates the key when it starts, and never exports its private part: a
+// restarted enclave has a new key.
+type GetSigningKeyRequest struct {
+	AttestationNonce []byte `json:"attestationNonce,omitempty"`
+}
+
+func (r *GetSigningKeyRequest) Validate() error {
+	return validateAttestationNonce(r.AttestationNonce)
+}
+
+// Response is an attestation which contains
+// GetSigningKeyResponseAttestationUserData.
+type GetSigningKeyResponse struct {
+	Attestation []byte `json:"attestation"`
+}
+
+// PublicKey is the Ed25519 public key, PKIX, ASN.1 DER encoded. Thumbprint is
+// the kid of the signed results, see signing.Thumbprint.
+type GetSigningKeyResponseAttestationUserData struct {
+	PublicKey  []byte `json:"publicKey"`
+	Thumbprint string `json:"thumbprint"`
+}
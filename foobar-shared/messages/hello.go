@@ -0,0 +1,25 @@
+package messages
+
+// Version of the protocol between foobar-instance and foobar-enclave. Bump it
+// whenever a change to the messages or the framing breaks compatibility.
+// Adding a new operation doesn't require a bump: clients check the list of
+// operations the enclave supports.
+//
+// Version 2 added request ids and out of order responses. Version 3 replaced
+// the error string with Error. Version 4 made DecryptRequest.KeyId required.
+// Version 5 replaced the count of 'a' with ComputationResult.
+const ProtocolVersion = 5
+
+// Sent by the instance before any other request on a connection. The
+// instance waits for the response before sending more requests.
+type HelloRequest struct {
+	ProtocolVersion int `json:"protocolVersion"`
+}
+
+// Describes the enclave. Enclaves built before the handshake was introduced
+// reply with an "unexpected command" error instead.
+type HelloResponse struct {
+	ProtocolVersion int      `json:"protocolVersion"`
+	BuildVersion    string   `json:"buildVersion"`
+	Operations      []string `json:"operations"`
+}
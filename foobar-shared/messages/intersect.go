@@ -0,0 +1,107 @@
+package messages
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/ecies"
+)
+
+// Requests the intersection of two sets of ciphertexts, e.g. two parties'
+// lists of identifiers. Plaintexts match when their bytes are equal. Only the
+// size of the intersection leaves the enclave, or, if Recipient is set, the
+// intersecting plaintexts sealed to Recipient (see package ecies), which the
+// parent instance can't read. The items and the other fields mean the same as
+// in BatchDecryptRequest, both sets use the same session.
+//
+// Each party binds its ciphertexts to its name (see Binding.Party): the
+// enclave only decrypts the Left items for LeftParty and the Right ones for
+// RightParty, so that a party can't move the other's ciphertexts into its own
+// set. The same ciphertext can't be in both sets either. Each set must hold a
+// minimum number of distinct values, which the enclave enforces and attests
+// (see IntersectResponseAttestationUserData.MinSetSize).
+type IntersectRequest struct {
+	SessionId        string             `json:"sessionId,omitempty"`
+	AttestationNonce []byte             `json:"attestationNonce,omitempty"`
+	Left             []BatchDecryptItem `json:"left"`
+	Right            []BatchDecryptItem `json:"right"`
+	LeftParty        string             `json:"leftParty"`
+	RightParty       string             `json:"rightParty"`
+	// Recipient is an elliptic curve public key, PKIX, ASN.1 DER encoded. Both
+	// parties must have bound their ciphertexts to it (see
+	// Binding.RecipientHash).
+	Recipient []byte `json:"recipient,omitempty"`
+}
+
+// Party names are attested, this keeps the user data small.
+const MaxPartySize = 64
+
+func (r *IntersectRequest) Validate() error {
+	for _, items := range [][]BatchDecryptItem{r.Left, r.Right} {
+		if len(items) == 0 || len(items) > MaxBatchDecryptItems {
+			return &Error{Code: ErrorCodeInvalidRequest, Message: fmt.Sprintf("got %d items, expected 1 to %d per set", len(items), MaxBatchDecryptItems)}
+		}
+	}
+	if r.LeftParty == "" || r.RightParty == "" || r.LeftParty == r.RightParty || len(r.LeftParty) > MaxPartySize || len(r.RightParty) > MaxPartySize {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: fmt.Sprintf("leftParty and rightParty are required, must differ and must not exceed %d bytes", MaxPartySize)}
+	}
+	// The shared secret is re-derived for each request, the nonce and the
+	// ciphertext identify the message.
+	left := map[[sha256.Size]byte]bool{}
+	for _, item := range r.Left {
+		left[sha256.Sum256(append(append([]byte{}, item.Nonce...), item.Ciphertext...))] = true
+	}
+	for _, item := range r.Right {
+		if left[sha256.Sum256(append(append([]byte{}, item.Nonce...), item.Ciphertext...))] {
+			return &Error{Code: ErrorCodeInvalidRequest, Message: "a ciphertext is in both sets"}
+		}
+	}
+	if r.Recipient != nil {
+		if _, err := ecies.ParsePublicKey(r.Recipient); err != nil {
+			return &Error{Code: ErrorCodeInvalidRequest, Message: fmt.Sprintf("invalid recipient: %s", err)}
+		}
+	}
+	return validateAttestationNonce(r.AttestationNonce)
+}
+
+// Response is an attestation which contains
+// IntersectResponseAttestationUserData. Elements are the intersecting
+// plaintexts, distinct and sorted, sealed to the recipient if the request had
+// one. SignedResult is the same user data, signed with the enclave's signing
+// key (see package signing).
+type IntersectResponse struct {
+	Attestation  []byte          `json:"attestation"`
+	Elements     []ecies.Message `json:"elements,omitempty"`
+	SignedResult string          `json:"signedResult,omitempty"`
+}
+
+// InitialRequest is the SHA-256 of the IntersectRequest, as in
+// DecryptResponseAttestationUserData. LeftDigest and RightDigest identify the
+// sets of items, see InputSetDigest, and LeftParty and RightParty the parties
+// whose ciphertexts they hold. Size is the number of distinct plaintexts
+// in both sets. Items which couldn't be decrypted are counted as rejected, and
+// left out. RecipientHash is the SHA-256 of the recipient and ElementsHash the
+// one of the elements, see ElementsHash, when the request had a recipient.
+// MinSetSize is the minimum number of distinct values the enclave required of
+// each set.
+type IntersectResponseAttestationUserData struct {
+	InitialRequest []byte `json:"request"`
+	LeftDigest     []byte `json:"leftDigest"`
+	RightDigest    []byte `json:"rightDigest"`
+	LeftParty      string `json:"leftParty"`
+	RightParty     string `json:"rightParty"`
+	Size           int    `json:"size"`
+	LeftRejected   int    `json:"leftRejected"`
+	RightRejected  int    `json:"rightRejected"`
+	MinSetSize     int    `json:"minSetSize"`
+	RecipientHash  []byte `json:"recipientHash,omitempty"`
+	ElementsHash   []byte `json:"elementsHash,omitempty"`
+}
+
+// ElementsHash is the SHA-256 of the JSON encoding of the elements.
+func ElementsHash(elements []ecies.Message) []byte {
+	b, _ := json.Marshal(elements)
+	h := sha256.Sum256(b)
+	return h[:]
+}
@@ -0,0 +1,48 @@
+package messages
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"time"
+)
+
+// Requests the keys created by the enclave since it started.
+type ListKeysRequest struct {
+}
+
+// Response is an attestation which contains
+// ListKeysResponseAttestationUserData, and the keys it commits to.
+type ListKeysResponse struct {
+	Attestation []byte `json:"attestation"`
+	Keys        []Key  `json:"keys"`
+}
+
+// The keys are committed to by their hash, see KeysHash: the NSM limits user
+// data to 512 bytes, which two keys already exceed.
+type ListKeysResponseAttestationUserData struct {
+	Count    int    `json:"count"`
+	KeysHash []byte `json:"keysHash"`
+}
+
+// Key is a KMS key created by the enclave. PolicyHash is the SHA-256 of the key
+// policy the enclave sent to KMS.
+type Key struct {
+	KeyId      string    `json:"keyId"`
+	Region     string    `json:"region"`
+	PublicKey  []byte    `json:"pubKey"`
+	PolicyHash []byte    `json:"policyHash"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// KeysHash is the SHA-256 of the JSON encoding of keys, in UTC, which doesn't
+// depend on how the keys were transported.
+func KeysHash(keys []Key) []byte {
+	normalized := []Key{}
+	for _, key := range keys {
+		key.CreatedAt = key.CreatedAt.UTC()
+		normalized = append(normalized, key)
+	}
+	b, _ := json.Marshal(normalized)
+	h := sha256.Sum256(b)
+	return h[:]
+}
@@ -1,16 +1,133 @@
 package messages
 
+import "fmt"
+
 // These messages define the API between the foobar-instance and foobar-enclave.
 // Only one of each field is expected to be set at any given time.
+//
+// Id is chosen by the client and copied into the response. The enclave handles
+// the requests of a connection concurrently, responses can therefore arrive in
+// a different order than the requests were sent.
+//
+// TimeoutMs is how long the client is willing to wait for the response. The
+// enclave gives up on the request after that, or after the operation's own
+// timeout if it is shorter. It is relative, since the enclave's clock may not
+// match the instance's.
 type FoobarRequest struct {
+	Id             uint64                 `json:"id,omitempty"`
+	TimeoutMs      int64                  `json:"timeoutMs,omitempty"`
+	Hello          *HelloRequest          `json:"hello,omitempty"`
 	CreateKey      *CreateKeyRequest      `json:"createKey,omitempty"`
 	GetAttestation *GetAttestationRequest `json:"getAttestation,omitempty"`
 	Decrypt        *DecryptRequest        `json:"decrypt,omitempty"`
+	Status         *StatusRequest         `json:"status,omitempty"`
+	ListKeys       *ListKeysRequest       `json:"listKeys,omitempty"`
+	BatchDecrypt   *BatchDecryptRequest   `json:"batchDecrypt,omitempty"`
+	Aggregate      *AggregateRequest      `json:"aggregate,omitempty"`
+	Intersect      *IntersectRequest      `json:"intersect,omitempty"`
+	ReEncrypt      *ReEncryptRequest      `json:"reEncrypt,omitempty"`
+	GetSigningKey  *GetSigningKeyRequest  `json:"getSigningKey,omitempty"`
+	RegisterKey    *RegisterKeyRequest    `json:"registerKey,omitempty"`
 }
 
 type FoobarResponse struct {
+	Id             uint64                  `json:"id,omitempty"`
+	Hello          *HelloResponse          `json:"hello,omitempty"`
 	CreateKey      *CreateKeyResponse      `json:"createKey,omitempty"`
 	GetAttestation *GetAttestationResponse `json:"getAttestation,omitempty"`
 	Decrypt        *DecryptResponse        `json:"decrypt,omitempty"`
-	Error          *string                 `json:"error,omitempty"`
+	Status         *StatusResponse         `json:"status,omitempty"`
+	ListKeys       *ListKeysResponse       `json:"listKeys,omitempty"`
+	BatchDecrypt   *BatchDecryptResponse   `json:"batchDecrypt,omitempty"`
+	Aggregate      *AggregateResponse      `json:"aggregate,omitempty"`
+	Intersect      *IntersectResponse      `json:"intersect,omitempty"`
+	ReEncrypt      *ReEncryptResponse      `json:"reEncrypt,omitempty"`
+	GetSigningKey  *GetSigningKeyResponse  `json:"getSigningKey,omitempty"`
+	RegisterKey    *RegisterKeyResponse    `json:"registerKey,omitempty"`
+	Error          *Error                  `json:"error,omitempty"`
+}
+
+// Operation names, as reported in HelloResponse. They match the JSON field
+// names in FoobarRequest.
+const (
+	OperationHello          = "hello"
+	OperationCreateKey      = "createKey"
+	OperationGetAttestation = "getAttestation"
+	OperationDecrypt        = "decrypt"
+	OperationStatus         = "status"
+	OperationListKeys       = "listKeys"
+	OperationBatchDecrypt   = "batchDecrypt"
+	OperationAggregate      = "aggregate"
+	OperationIntersect      = "intersect"
+	OperationReEncrypt      = "reEncrypt"
+	OperationGetSigningKey  = "getSigningKey"
+	OperationRegisterKey    = "registerKey"
+)
+
+// Operation returns the name of the operation set in the request, or an empty
+// string if none is set.
+func (r FoobarRequest) Operation() string {
+	switch {
+	case r.Hello != nil:
+		return OperationHello
+	case r.CreateKey != nil:
+		return OperationCreateKey
+	case r.GetAttestation != nil:
+		return OperationGetAttestation
+	case r.Decrypt != nil:
+		return OperationDecrypt
+	case r.Status != nil:
+		return OperationStatus
+	case r.ListKeys != nil:
+		return OperationListKeys
+	case r.BatchDecrypt != nil:
+		return OperationBatchDecrypt
+	case r.Aggregate != nil:
+		return OperationAggregate
+	case r.Intersect != nil:
+		return OperationIntersect
+	case r.ReEncrypt != nil:
+		return OperationReEncrypt
+	case r.GetSigningKey != nil:
+		return OperationGetSigningKey
+	case r.RegisterKey != nil:
+		return OperationRegisterKey
+	default:
+		return ""
+	}
+}
+
+// Validate checks that exactly one operation is set, along with the
+// operation's own validation, if any.
+func (r FoobarRequest) Validate() error {
+	count := 0
+	for _, set := range []bool{r.Hello != nil, r.CreateKey != nil, r.GetAttestation != nil, r.Decrypt != nil, r.Status != nil, r.ListKeys != nil, r.BatchDecrypt != nil, r.Aggregate != nil, r.Intersect != nil, r.ReEncrypt != nil, r.GetSigningKey != nil, r.RegisterKey != nil} {
+		if set {
+			count++
+		}
+	}
+	if count != 1 {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: fmt.Sprintf("expected exactly one operation, got %d", count)}
+	}
+	switch {
+	case r.CreateKey != nil:
+		return r.CreateKey.Validate()
+	case r.GetAttestation != nil:
+		return r.GetAttestation.Validate()
+	case r.Decrypt != nil:
+		return r.Decrypt.Validate()
+	case r.BatchDecrypt != nil:
+		return r.BatchDecrypt.Validate()
+	case r.Aggregate != nil:
+		return r.Aggregate.Validate()
+	case r.Intersect != nil:
+		return r.Intersect.Validate()
+	case r.ReEncrypt != nil:
+		return r.ReEncrypt.Validate()
+	case r.GetSigningKey != nil:
+		return r.GetSigningKey.Validate()
+	case r.RegisterKey != nil:
+		return r.RegisterKey.Validate()
+	}
+	return nil
 }
@@ -0,0 +1,18 @@
+package messages
+
+import "fmt"
+
+// CreateKeyRequest, GetAttestationRequest and DecryptRequest accept an
+// AttestationNonce, chosen by the client. The enclave places it in the nonce
+// field of the attestation it returns, so that an attestation captured earlier
+// can't be passed off as the response.
+
+// The NSM rejects larger nonces.
+const MaxAttestationNonceSize = 512
+
+func validateAttestationNonce(nonce []byte) error {
+	if len(nonce) > MaxAttestationNonceSize {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: fmt.Sprintf("attestationNonce is %d bytes, at most %d are allowed", len(nonce), MaxAttestationNonceSize)}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package messages
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/ecies"
+)
+
+// Requests the re-encryption of a ciphertext to either:
+//   - RecipientAttestation, the create-key attestation of another foobar key.
+//     The enclave verifies it was produced by the same enclave image, see
+//     RegisterKeyRequest. Any ciphertext can be re-encrypted to such a key,
+//     except bound ones (see Binding), which don't decrypt for it, and one-shot
+//     ones: the new ciphertext would be reusable.
+//   - Recipient, an elliptic curve public key, PKIX, ASN.1 DER encoded, e.g. a
+//     service's ECDH key. The data owner must have bound the ciphertext to it
+//     (see Binding), otherwise it doesn't decrypt: the enclave can't tell who
+//     holds the private key.
+//
+// The plaintext never leaves the enclave in the clear. The other fields mean
+// the same as in DecryptRequest.
+type ReEncryptRequest struct {
+	KeyId                 string `json:"keyId"`
+	SessionId             string `json:"sessionId,omitempty"`
+	EncryptedSharedSecret []byte `json:"sharedSecret"`
+	Nonce                 []byte `json:"nonce"`
+	Ciphertext            []byte `json:"ciphertext"`
+	AttestationNonce      []byte `json:"attestationNonce,omitempty"`
+	OneShotUntil          int64  `json:"oneShotUntil,omitempty"`
+	Recipient             []byte `json:"recipient,omitempty"`
+	RecipientAttestation  []byte `json:"recipientAttestation,omitempty"`
+}
+
+func (r *ReEncryptRequest) Validate() error {
+	if r.KeyId == "" {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: "keyId is required"}
+	}
+	if r.OneShotUntil < 0 {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: fmt.Sprintf("invalid oneShotUntil: %d", r.OneShotUntil)}
+	}
+	if (r.Recipient == nil) == (r.RecipientAttestation == nil) {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: "expected either recipient or recipientAttestation"}
+	}
+	if r.RecipientAttestation != nil && r.OneShotUntil != 0 {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: "one-shot ciphertexts can't be re-encrypted to a foobar key"}
+	}
+	if r.Recipient != nil {
+		if _, err := ecies.ParsePublicKey(r.Recipient); err != nil {
+			return &Error{Code: ErrorCodeInvalidRequest, Message: fmt.Sprintf("invalid recipient: %s", err)}
+		}
+	}
+	if len(r.RecipientAttestation) > MaxAttestationSize {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: "recipientAttestation must not exceed 16 KiB"}
+	}
+	return validateAttestationNonce(r.AttestationNonce)
+}
+
+// Response is an attestation which contains
+// ReEncryptResponseAttestationUserData, and the new ciphertext, sealed to the
+// recipient (see package ecies). Its JSON encoding is the one of the encrypt
+// command's ciphertexts. SignedResult is the same user data, signed with the
+// enclave's signing key (see package signing).
+type ReEncryptResponse struct {
+	Attestation  []byte        `json:"attestation"`
+	Ciphertext   ecies.Message `json:"ciphertext"`
+	SignedResult string        `json:"signedResult,omitempty"`
+}
+
+// InitialRequest is the SHA-256 of the ReEncryptRequest, as in
+// DecryptResponseAttestationUserData. RecipientHash is the SHA-256 of the
+// recipient's public key, and RecipientKeyId its key id if it is a foobar key.
+// CiphertextHash is the SHA-256 of the new ciphertext, see CiphertextHash. The
+// ciphertext itself can exceed the NSM's 512 bytes of user data.
+type ReEncryptResponseAttestationUserData struct {
+	InitialRequest []byte `json:"request"`
+	KeyId          string `json:"keyId"`
+	RecipientHash  []byte `json:"recipientHash"`
+	RecipientKeyId string `json:"recipientKeyId,omitempty"`
+	CiphertextHash []byte `json:"ciphertextHash"`
+}
+
+// CiphertextHash is the SHA-256 of the JSON encoding of the ciphertext.
+func CiphertextHash(ciphertext ecies.Message) []byte {
+	b, _ := json.Marshal(ciphertext)
+	h := sha256.Sum256(b)
+	return h[:]
+}
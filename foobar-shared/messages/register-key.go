@@ -0,0 +1,26 @@
+package messages
+
+// Registers a key created by an earlier run of the enclave, e.g. before a
+// restart. Attestation is the key's CreateKeyResponse attestation: the enclave
+// only accepts it if it chains to the NSM's root and has the enclave's own
+// PCR0, i.e. if the same enclave image created the key. Registering a known
+// key does nothing.
+type RegisterKeyRequest struct {
+	Attestation []byte `json:"attestation"`
+}
+
+// Attestation documents are a few KiB, this leaves plenty of room.
+const MaxAttestationSize = 16 << 10
+
+func (r *RegisterKeyRequest) Validate() error {
+	if len(r.Attestation) == 0 || len(r.Attestation) > MaxAttestationSize {
+		return &Error{Code: ErrorCodeInvalidRequest, Message: "attestation is required and must not exceed 16 KiB"}
+	}
+	return nil
+}
+
+// Registered is false if the enclave already knew the key.
+type RegisterKeyResponse struct {
+	KeyId      string `json:"keyId"`
+	Registered bool   `json:"registered"`
+}
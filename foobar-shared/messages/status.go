@@ -0,0 +1,64 @@
+package messages
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+)
+
+// Requests the status of the enclave.
+type StatusRequest struct {
+}
+
+// Response is an attestation which contains StatusResponseAttestationUserData,
+// and the status it commits to. The PCRs are part of the attestation document
+// itself.
+type StatusResponse struct {
+	Attestation []byte        `json:"attestation"`
+	Status      EnclaveStatus `json:"status"`
+}
+
+// The status is committed to by its hash, see EnclaveStatus.Hash: the NSM
+// limits user data to 512 bytes, which the keys and counters exceed after a
+// while.
+type StatusResponseAttestationUserData struct {
+	StatusHash []byte `json:"statusHash"`
+}
+
+type EnclaveStatus struct {
+	BuildVersion string `json:"buildVersion"`
+	UptimeMs     int64  `json:"uptimeMs"`
+
+	// The current RSA key, i.e. the key KMS encrypts shared secrets to.
+	RsaKey RsaKey `json:"rsaKey"`
+
+	// KMS keys created by this enclave since it started.
+	KeyIds []string `json:"keyIds"`
+
+	// Decrypt sessions which were opened but not used yet.
+	OpenSessions int `json:"openSessions"`
+
+	// Requests handled per operation and errors returned per error code.
+	Requests map[string]uint64 `json:"requests"`
+	Errors   map[string]uint64 `json:"errors"`
+
+	Health Health `json:"health"`
+}
+
+// Hash is the SHA-256 of the JSON encoding of the status. Empty and missing
+// lists and counters, and time zones, don't change it: they depend on how the
+// status was transported.
+func (s EnclaveStatus) Hash() []byte {
+	s.RsaKey.GeneratedAt = s.RsaKey.GeneratedAt.UTC()
+	if s.KeyIds == nil {
+		s.KeyIds = []string{}
+	}
+	if s.Requests == nil {
+		s.Requests = map[string]uint64{}
+	}
+	if s.Errors == nil {
+		s.Errors = map[string]uint64{}
+	}
+	b, _ := json.Marshal(s)
+	h := sha256.Sum256(b)
+	return h[:]
+}
@@ -0,0 +1,137 @@
+// Package signing verifies the computation results signed by the enclave, for
+// consumers who don't want to parse Nitro attestations. The enclave generates
+// an Ed25519 key when it starts, and attests its public key once (see
+// messages.GetSigningKeyRequest). Trusting that key is then enough to check
+// any result.
+//
+// A signed result is a JWS, in the compact serialization (RFC 7515), signed
+// with EdDSA (RFC 8037):
+//
+//	BASE64URL(header) "." BASE64URL(payload) "." BASE64URL(signature)
+//
+// BASE64URL is unpadded. The header is {"alg":"EdDSA","kid":Thumbprint(key)},
+// the payload is the JSON encoding of Payload, and the signature is Ed25519's
+// over the first two parts, joined by the dot. Generic JOSE libraries can
+// therefore verify results too.
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// Payload is what the enclave signs. Request identifies the request: the
+// SHA-256 of the request, as in messages.DecryptResponseAttestationUserData,
+// or the digest of a batch item (see messages.BatchDecryptItem). KeyId is the
+// KMS key the ciphertext was decrypted with, unset for the requests over sets
+// of items, and IssuedAt when the result was signed, in Unix seconds.
+//
+// One of the other fields is set, depending on the operation. Result is the
+// computation result of decrypt and batch-decrypt. Aggregate, Intersect and
+// ReEncrypt are the user data the enclave attests for these operations, next
+// to AggregateResult, which the attestation only covers by its hash.
+type Payload struct {
+	Request         []byte                                         `json:"request"`
+	KeyId           string                                         `json:"keyId,omitempty"`
+	Result          *messages.ComputationResult                    `json:"result,omitempty"`
+	Aggregate       *messages.AggregateResponseAttestationUserData `json:"aggregate,omitempty"`
+	AggregateResult *messages.AggregateResult                      `json:"aggregateResult,omitempty"`
+	Intersect       *messages.IntersectResponseAttestationUserData `json:"intersect,omitempty"`
+	ReEncrypt       *messages.ReEncryptResponseAttestationUserData `json:"reEncrypt,omitempty"`
+	IssuedAt        int64                                          `json:"iat"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+const algorithm = "EdDSA"
+
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// Thumbprint identifies a signing key: it is the JWK thumbprint (RFC 7638) of
+// the public key, base64url encoded.
+func Thumbprint(publicKey ed25519.PublicKey) string {
+	// The members are in lexicographic order, without whitespace.
+	jwk := fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, base64.RawURLEncoding.EncodeToString(publicKey))
+	h := sha256.Sum256([]byte(jwk))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// ParsePublicKey parses a PKIX, ASN.1 DER Ed25519 public key, as attested by
+// the enclave.
+func ParsePublicKey(der []byte) (ed25519.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 public key")
+	}
+	return publicKey, nil
+}
+
+// Sign returns the signed result.
+func Sign(key ed25519.PrivateKey, payload Payload) (string, error) {
+	headerBytes, err := json.Marshal(header{Alg: algorithm, Kid: Thumbprint(key.Public().(ed25519.PublicKey))})
+	if err != nil {
+		return "", err
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerBytes) + "." + base64.RawURLEncoding.EncodeToString(payloadBytes)
+	signature := ed25519.Sign(key, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks that signedResult was signed with publicKey and returns its
+// payload.
+func Verify(publicKey ed25519.PublicKey, signedResult string) (*Payload, error) {
+	parts := strings.Split(signedResult, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: got %d parts, expected 3", ErrInvalidSignature, len(parts))
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSignature, err)
+	}
+	var h header
+	if err := json.Unmarshal(headerBytes, &h); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSignature, err)
+	}
+	if h.Alg != algorithm {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidSignature, h.Alg)
+	}
+	if h.Kid != Thumbprint(publicKey) {
+		return nil, fmt.Errorf("%w: signed by key %s, expected %s", ErrInvalidSignature, h.Kid, Thumbprint(publicKey))
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSignature, err)
+	}
+	if !ed25519.Verify(publicKey, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSignature, err)
+	}
+	var payload Payload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSignature, err)
+	}
+	return &payload, nil
+}
@@ -0,0 +1,71 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zxsdotch/aws-nitro-enclave-experiments/foobar-shared/messages"
+)
+
+// From RFC 8037, appendix A.3.
+func TestThumbprint(t *testing.T) {
+	x, err := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := Thumbprint(ed25519.PublicKey(x)), "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := Payload{
+		Request:  []byte{1, 2, 3},
+		KeyId:    "key",
+		Result:   &messages.ComputationResult{Computation: "count", Value: messages.IntValue(4)},
+		IssuedAt: 1700000000,
+	}
+	signedResult, err := Sign(key, payload)
+	if err != nil {
+		t.Fatalf("Sign failed: %s", err)
+	}
+	got, err := Verify(publicKey, signedResult)
+	if err != nil {
+		t.Fatalf("Verify failed: %s", err)
+	}
+	if !reflect.DeepEqual(*got, payload) {
+		t.Errorf("got %+v, want %+v", *got, payload)
+	}
+
+	otherPublicKey, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	parts := strings.Split(signedResult, ".")
+	forged, _ := Sign(otherKey, payload)
+	tests := []struct {
+		name         string
+		publicKey    ed25519.PublicKey
+		signedResult string
+	}{
+		{"other key", otherPublicKey, signedResult},
+		{"forged", publicKey, forged},
+		{"forged with the key's id", publicKey, parts[0] + "." + strings.SplitN(forged, ".", 2)[1]},
+		{"altered payload", publicKey, parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"keyId":"other"}`)) + "." + parts[2]},
+		{"algorithm none", publicKey, base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."},
+		{"truncated", publicKey, parts[0] + "." + parts[1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Verify(tt.publicKey, tt.signedResult); !errors.Is(err, ErrInvalidSignature) {
+				t.Errorf("got %v, want %v", err, ErrInvalidSignature)
+			}
+		})
+	}
+}
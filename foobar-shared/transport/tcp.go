@@ -0,0 +1,25 @@
+package transport
+
+import (
+	"context"
+	"net"
+)
+
+// TCP is meant for local development and CI, where both sides run as regular
+// processes or containers.
+type TCP struct {
+	Address string
+}
+
+func (t TCP) Dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", t.Address)
+}
+
+func (t TCP) Listen() (net.Listener, error) {
+	return net.Listen("tcp", t.Address)
+}
+
+func (t TCP) String() string {
+	return "tcp://" + t.Address
+}
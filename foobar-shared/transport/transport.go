@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// The instance and the enclave talk to each other over vsock. Abstracting the
+// socket type lets the whole create-key/encrypt/decrypt flow run on machines
+// without Nitro hardware, e.g. a laptop or a CI container, by using TCP or Unix
+// sockets instead.
+//
+// Addresses are written as URLs:
+//   vsock://16:1000       (context id and port)
+//   vsock://:1000         (local context id, only meaningful when listening)
+//   tcp://127.0.0.1:1000
+//   unix:///tmp/foobar-enclave.sock
+
+// Dialer opens connections to a fixed remote address.
+type Dialer interface {
+	Dial(ctx context.Context) (net.Conn, error)
+	String() string
+}
+
+// Listener accepts connections on a fixed local address.
+type Listener interface {
+	Listen() (net.Listener, error)
+	String() string
+}
+
+// Endpoint is an address which can be used by both sides of a connection.
+type Endpoint interface {
+	Dialer
+	Listener
+}
+
+// Parse converts an address into an Endpoint.
+func Parse(address string) (Endpoint, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transport address %q: %w", address, err)
+	}
+
+	switch u.Scheme {
+	case "vsock":
+		var contextID uint64
+		if u.Hostname() != "" {
+			contextID, err = strconv.ParseUint(u.Hostname(), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid vsock context id in %q: %w", address, err)
+			}
+		}
+		port, err := strconv.ParseUint(u.Port(), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vsock port in %q: %w", address, err)
+		}
+		return Vsock{ContextID: uint32(contextID), Port: uint32(port)}, nil
+	case "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("missing host in %q", address)
+		}
+		return TCP{Address: u.Host}, nil
+	case "unix":
+		// Accept both unix:///abs/path and unix://relative/path.
+		path := u.Host + u.Path
+		if path == "" {
+			return nil, fmt.Errorf("missing path in %q", address)
+		}
+		return Unix{Path: path}, nil
+	default:
+		return nil, fmt.Errorf("unsupported transport %q in %q", u.Scheme, address)
+	}
+}
@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		address string
+		want    Endpoint
+	}{
+		{"vsock://16:1000", Vsock{ContextID: 16, Port: 1000}},
+		{"vsock://:1000", Vsock{Port: 1000}},
+		{"tcp://127.0.0.1:1000", TCP{Address: "127.0.0.1:1000"}},
+		{"unix:///tmp/foobar-enclave.sock", Unix{Path: "/tmp/foobar-enclave.sock"}},
+		{"unix://foobar-enclave.sock", Unix{Path: "foobar-enclave.sock"}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.address)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %s", tt.address, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %#v, want %#v", tt.address, got, tt.want)
+		}
+		if got.String() != tt.address {
+			t.Errorf("Parse(%q).String() = %q", tt.address, got.String())
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, address := range []string{
+		"vsock://16",
+		"vsock://abc:1000",
+		"vsock://16:99999999999",
+		"tcp://",
+		"unix://",
+		"http://127.0.0.1:1000",
+		"127.0.0.1:1000",
+		"%",
+	} {
+		if got, err := Parse(address); err == nil {
+			t.Errorf("Parse(%q) = %#v, want an error", address, got)
+		}
+	}
+}
+
+// roundTrip listens on e, dials it and checks that bytes make it across.
+func roundTrip(t *testing.T, e Endpoint) {
+	t.Helper()
+	l, err := e.Listen()
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	conn, err := e.Dial(context.Background())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("Accept failed")
+	}
+	defer server.Close()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestTCP(t *testing.T) {
+	// Reserve a free port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+	roundTrip(t, TCP{Address: address})
+}
+
+func TestUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "foobar.sock")
+	roundTrip(t, Unix{Path: path})
+
+	// A process which died leaves its socket behind, Listen replaces it.
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatalf("expected a stale socket: %s", err)
+	}
+	roundTrip(t, Unix{Path: path})
+}
+
+// Listen doesn't remove anything but a socket.
+func TestUnixNotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "foobar.sock")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := (Unix{Path: path}).Listen(); err == nil {
+		l.Close()
+		t.Fatal("Listen replaced a regular file")
+	}
+	if got, err := os.ReadFile(path); err != nil || string(got) != "data" {
+		t.Errorf("got %q, %v, want the file left alone", got, err)
+	}
+}
+
+func TestUnixDialNoListener(t *testing.T) {
+	if _, err := (Unix{Path: filepath.Join(t.TempDir(), "missing.sock")}).Dial(context.Background()); err == nil {
+		t.Error("Dial succeeded without a listener")
+	}
+}
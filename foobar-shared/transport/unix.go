@@ -0,0 +1,41 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+)
+
+// Unix is meant for local development, where both sides run on the same host.
+type Unix struct {
+	Path string
+}
+
+func (u Unix) Dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", u.Path)
+}
+
+// Listen removes a stale socket left behind by a previous run. Any other kind
+// of file at Path is left alone.
+func (u Unix) Listen() (net.Listener, error) {
+	info, err := os.Lstat(u.Path)
+	if err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", u.Path)
+		}
+		if err := os.Remove(u.Path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", u.Path)
+}
+
+func (u Unix) String() string {
+	return "unix://" + u.Path
+}
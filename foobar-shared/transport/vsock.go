@@ -0,0 +1,35 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/mdlayher/vsock"
+)
+
+// Vsock is the transport used on real Nitro hardware. A ContextID of 0 (which
+// belongs to the hypervisor and is never a valid peer) means "local context
+// id" when listening.
+type Vsock struct {
+	ContextID uint32
+	Port      uint32
+}
+
+func (v Vsock) Dial(_ context.Context) (net.Conn, error) {
+	return vsock.Dial(v.ContextID, v.Port, nil)
+}
+
+func (v Vsock) Listen() (net.Listener, error) {
+	if v.ContextID == 0 {
+		return vsock.Listen(v.Port, nil)
+	}
+	return vsock.ListenContextID(v.ContextID, v.Port, nil)
+}
+
+func (v Vsock) String() string {
+	if v.ContextID == 0 {
+		return fmt.Sprintf("vsock://:%d", v.Port)
+	}
+	return fmt.Sprintf("vsock://%d:%d", v.ContextID, v.Port)
+}
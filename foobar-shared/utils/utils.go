@@ -1,6 +1,9 @@
 package utils
 
-import "log"
+import (
+	"log"
+	"os"
+)
 
 func PanicOnErr(e error) {
 	if e != nil {
@@ -11,3 +14,12 @@ func PanicOnErr(e error) {
 func Ref[T any](v T) *T {
 	return &v
 }
+
+// Getenv returns the value of the environment variable named by key, or
+// fallback if the variable is unset or empty.
+func Getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,73 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Messages between the instance and the enclave are framed: a 4-byte
+// big-endian length followed by that many bytes of payload (a JSON encoded
+// FoobarRequest or FoobarResponse). Unlike newline-delimited messages, frames
+// can carry arbitrarily large ciphertexts up to MaxFrameSize, and a truncated
+// frame is detected instead of being silently dropped.
+
+// MaxFrameSize bounds the memory a peer can make the other side allocate.
+const MaxFrameSize = 64 << 20
+
+const headerSize = 4
+
+var ErrFrameTooLarge = fmt.Errorf("frame exceeds %d bytes", MaxFrameSize)
+
+// WriteFrame writes payload as a single frame.
+func WriteFrame(w io.Writer, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	frame := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[headerSize:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads a single frame. It returns io.EOF if the connection was
+// closed cleanly between two frames, io.ErrUnexpectedEOF if it was closed in
+// the middle of a frame and ErrFrameTooLarge if the peer announced a frame
+// larger than MaxFrameSize. After an error, the stream is no longer in sync
+// and the connection should be closed.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	size, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return ReadPayload(r, size)
+}
+
+// ReadHeader reads the length of the next frame, without allocating its
+// payload. This lets readers wait, e.g. for memory to be available, before
+// calling ReadPayload. Errors are the same as ReadFrame's.
+func ReadHeader(r io.Reader) (int, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return 0, ErrFrameTooLarge
+	}
+	return int(size), nil
+}
+
+// ReadPayload reads the size bytes of payload which follow a header.
+func ReadPayload(r io.Reader, size int) ([]byte, error) {
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,80 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	payloads := [][]byte{{}, []byte("hello"), bytes.Repeat([]byte{'a'}, 1<<20)}
+	for _, p := range payloads {
+		if err := WriteFrame(&buf, p); err != nil {
+			t.Fatalf("WriteFrame failed: %s", err)
+		}
+	}
+	for _, p := range payloads {
+		got, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatalf("ReadFrame failed: %s", err)
+		}
+		if !bytes.Equal(got, p) {
+			t.Errorf("got %d bytes, want %d bytes", len(got), len(p))
+		}
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Errorf("got %v, want io.EOF", err)
+	}
+}
+
+func TestTruncatedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	WriteFrame(&buf, []byte("hello"))
+	for _, n := range []int{2, headerSize + 2} {
+		_, err := ReadFrame(bytes.NewReader(buf.Bytes()[:n]))
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("truncated at %d: got %v, want io.ErrUnexpectedEOF", n, err)
+		}
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	if err := WriteFrame(io.Discard, make([]byte, MaxFrameSize+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("WriteFrame: got %v, want ErrFrameTooLarge", err)
+	}
+
+	var header [headerSize]byte
+	binary.BigEndian.PutUint32(header[:], MaxFrameSize+1)
+	if _, err := ReadFrame(bytes.NewReader(header[:])); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("ReadFrame: got %v, want ErrFrameTooLarge", err)
+	}
+}
+
+// ReadHeader and ReadPayload are ReadFrame in two steps.
+func TestReadHeaderThenPayload(t *testing.T) {
+	var buf bytes.Buffer
+	WriteFrame(&buf, []byte("hello"))
+	WriteFrame(&buf, []byte("world"))
+	for _, want := range []string{"hello", "world"} {
+		size, err := ReadHeader(&buf)
+		if err != nil {
+			t.Fatalf("ReadHeader failed: %s", err)
+		}
+		if size != len(want) {
+			t.Errorf("got size %d, want %d", size, len(want))
+		}
+		got, err := ReadPayload(&buf, size)
+		if err != nil {
+			t.Fatalf("ReadPayload failed: %s", err)
+		}
+		if string(got) != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if _, err := ReadPayload(bytes.NewReader([]byte("he")), 5); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}